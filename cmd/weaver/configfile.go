@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/configfile"
+)
+
+// applyConfigFile loads the file named by -config, or a weaver.yaml or weaver.toml
+// found in the current directory (or the root, when a single -root is given), and
+// fills in every option that was not set on the command line, using the -profile
+// settings when one is named. Rules from the file come first, so rules given as
+// flags take precedence over them.
+func applyConfigFile(flags *flag.FlagSet, cfg *config) error {
+	path := cfg.ConfigPath
+	if path == "" {
+		dir := "."
+		if len(cfg.Roots) == 1 {
+			dir = cfg.Roots[0]
+		}
+		found, err := configfile.Find(dir)
+		if err != nil {
+			return err
+		}
+		if found == "" {
+			if cfg.Profile != "" {
+				return fmt.Errorf("-profile %s needs a config file; none found in %s", cfg.Profile, dir)
+			}
+			return nil
+		}
+		path = found
+	}
+	file, err := configfile.Load(path)
+	if err != nil {
+		return err
+	}
+	settings, err := file.Resolve(cfg.Profile)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	applySettings(cfg, set, file.Path, settings)
+	return nil
+}
+
+func applySettings(cfg *config, set map[string]bool, source string, s configfile.Settings) {
+	if len(s.Roots) > 0 && !set["root"] {
+		cfg.Roots = s.Roots
+	}
+	if s.Out != nil && !set["out"] {
+		cfg.Out = *s.Out
+	}
+	if s.Format != nil && !set["format"] {
+		cfg.Format = *s.Format
+	}
+	if s.MaxDepth != nil && !set["max-depth"] {
+		cfg.MaxDepth = *s.MaxDepth
+	}
+	if s.Jobs != nil && !set["jobs"] {
+		cfg.Jobs = *s.Jobs
+	}
+	if s.MaxFileSize != nil && !set["max-file-size"] {
+		cfg.MaxFileSize = *s.MaxFileSize
+	}
+	if s.MaxBytes != nil && !set["max-bytes"] {
+		cfg.MaxBytes = *s.MaxBytes
+	}
+	if s.MaxLines != nil && !set["max-lines"] {
+		cfg.MaxLines = *s.MaxLines
+	}
+	if s.BudgetPolicy != nil && !set["budget-policy"] {
+		cfg.BudgetPolicy = *s.BudgetPolicy
+	}
+	if s.Tokenizer != nil && !set["tokenizer"] {
+		cfg.Tokenizer = *s.Tokenizer
+	}
+	if s.MaxTokens != nil && !set["max-tokens"] {
+		cfg.MaxTokens = *s.MaxTokens
+	}
+	applyBool(&cfg.IncludeTree, s.IncludeTree, set["include-tree"])
+	applyBool(&cfg.IncludeTreeCompact, s.IncludeTreeCompact, set["include-tree-compact"])
+	applyBool(&cfg.SkipContents, s.SkipContents, set["skip-contents"])
+	applyBool(&cfg.SkipBinary, s.SkipBinary, set["skip-binary"])
+	applyBool(&cfg.SkipOversize, s.SkipOversize, set["skip-oversize"])
+	applyBool(&cfg.FileMetadata, s.FileMetadata, set["file-metadata"])
+	applyBool(&cfg.NoTimestamp, s.NoTimestamp, set["no-timestamp"])
+	applyBool(&cfg.CountTokens, s.CountTokens, set["count-tokens"])
+	applyBool(&cfg.RespectGitignore, s.RespectGitignore, set["respect-gitignore"])
+	applyBool(&cfg.GitExcludes, s.GitExcludes, set["git-excludes"])
+	applyBool(&cfg.StrictGitignore, s.StrictGitignore, set["strict-gitignore"])
+	applyBool(&cfg.IgnoreCase, s.IgnoreCase, set["ignore-case"])
+
+	specs := make([]ruleSpec, 0, len(s.Rules)+len(cfg.RuleSpecs))
+	for _, rule := range s.Rules {
+		specs = append(specs, ruleSpec{
+			Mode:       rule.Mode,
+			Path:       rule.File,
+			Pattern:    strings.Join(rule.Patterns, "\n"),
+			IgnoreCase: rule.IgnoreCase,
+			Root:       rule.Root,
+			Preset:     rule.Preset,
+			Source:     source,
+			Lines:      rule.PatternLines,
+		})
+	}
+	cfg.RuleSpecs = append(specs, cfg.RuleSpecs...)
+}
+
+func applyBool(dst *bool, value *bool, setByFlag bool) {
+	if value != nil && !setByFlag {
+		*dst = *value
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aatuh/weaver/internal/adapters/fs"
+	"github.com/aatuh/weaver/internal/app"
+)
+
+// runDiff compares two combined outputs, or a combined output and a root
+// directory, printing a unified diff for each changed file and listing the
+// files only one side has.
+func runDiff(args []string, w io.Writer) error {
+	var cfg config
+	flags := newFlagSet("weaver diff", &cfg)
+	flags.Usage = func() {
+		usage(os.Stderr, flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("diff requires two combined files, or a combined file and a root directory")
+	}
+	if err := applyConfigFile(flags, &cfg); err != nil {
+		return err
+	}
+
+	var (
+		sides    [2]app.Parsed
+		roots    [2]bool
+		snapshot string
+	)
+	// A root is combined in the format of the output it is compared with, so
+	// that both sides carry the same newline and encoding conventions.
+	format := app.FormatJSON
+	for i, arg := range flags.Args() {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			roots[i] = true
+			continue
+		}
+		data, err := readCombined(arg)
+		if err != nil {
+			return err
+		}
+		if sides[i], err = app.Parse(data); err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+		if snapshot == "" {
+			format = sides[i].Format
+			if arg != "-" {
+				snapshot = arg
+			}
+		}
+	}
+	for i, arg := range flags.Args() {
+		if !roots[i] {
+			continue
+		}
+		parsed, err := combineRoot(cfg, arg, format, snapshot)
+		if err != nil {
+			return err
+		}
+		sides[i] = parsed
+	}
+	return writeDiff(w, sides[0].Files, sides[1].Files)
+}
+
+// combineRoot combines root with the flags given to diff and reads the result
+// back. The snapshot file, when it lies inside the root, is left out.
+func combineRoot(cfg config, root string, format app.Format, snapshot string) (app.Parsed, error) {
+	cfg.Roots = []string{root}
+	cfg.Format = format
+	snapshotAbs := ""
+	if snapshot != "" {
+		abs, err := filepath.Abs(snapshot)
+		if err != nil {
+			return app.Parsed{}, fmt.Errorf("resolve %s: %w", snapshot, err)
+		}
+		snapshotAbs = abs
+	}
+	opts, err := buildOptions(&cfg, snapshotAbs)
+	if err != nil {
+		return app.Parsed{}, err
+	}
+	var buf bytes.Buffer
+	opts.Output = &buf
+	combiner := app.Combiner{FS: fs.OSFS{}}
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		return app.Parsed{}, err
+	}
+	return app.Parse(buf.Bytes())
+}
+
+// writeDiff prints a unified diff for each file whose contents changed from
+// before to after, in the order of before, then lists the files whose
+// contents could not be compared and the files added and removed.
+func writeDiff(w io.Writer, before, after []app.ParsedFile) error {
+	afterByPath := make(map[string]app.ParsedFile, len(after))
+	for _, file := range after {
+		afterByPath[file.Path] = file
+	}
+	beforePaths := make(map[string]bool, len(before))
+	var report []string
+	var removed []string
+	for _, old := range before {
+		beforePaths[old.Path] = true
+		current, ok := afterByPath[old.Path]
+		if !ok {
+			removed = append(removed, old.Path)
+			continue
+		}
+		if reason := omittedReason(old, current); reason != "" {
+			report = append(report, fmt.Sprintf("not compared %s (%s)\n", old.Path, reason))
+			continue
+		}
+		if _, err := io.WriteString(w, fileDiff(old.Path, old.Content, current.Content)); err != nil {
+			return err
+		}
+	}
+	for _, file := range after {
+		if !beforePaths[file.Path] {
+			report = append(report, fmt.Sprintf("added %s\n", file.Path))
+		}
+	}
+	for _, display := range removed {
+		report = append(report, fmt.Sprintf("removed %s\n", display))
+	}
+	for _, line := range report {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// omittedReason says why two versions of a file cannot be compared, or
+// returns "" when both carry their contents.
+func omittedReason(before, after app.ParsedFile) string {
+	switch {
+	case before.Omitted != "" && after.Omitted != "" && before.Omitted != after.Omitted:
+		return before.Omitted + " before, " + after.Omitted + " after"
+	case before.Omitted != "":
+		return before.Omitted
+	case after.Omitted != "":
+		return after.Omitted
+	}
+	return ""
+}
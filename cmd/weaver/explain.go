@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/adapters/fs"
+	"github.com/aatuh/weaver/internal/app"
+	"github.com/aatuh/weaver/internal/bytesize"
+)
+
+// runExplain prints, for each path argument, every rule that matched it and the final decision.
+func runExplain(args []string, w io.Writer) error {
+	var cfg config
+	flags := newFlagSet("weaver explain", &cfg)
+	flags.Usage = func() {
+		usage(os.Stderr, flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("explain requires at least one path")
+	}
+	if err := applyConfigFile(flags, &cfg); err != nil {
+		return err
+	}
+
+	outAbs := ""
+	if cfg.Out != "" && cfg.Out != "-" {
+		abs, err := filepath.Abs(cfg.Out)
+		if err != nil {
+			return fmt.Errorf("resolve output: %w", err)
+		}
+		outAbs = abs
+	}
+	opts, err := buildOptions(&cfg, outAbs)
+	if err != nil {
+		return err
+	}
+
+	combiner := app.Combiner{FS: fs.OSFS{}}
+	for _, arg := range flags.Args() {
+		rootIndex, rel, err := resolveExplainPath(opts.Roots, opts.RootLabels, arg)
+		if err != nil {
+			return err
+		}
+		isDir := strings.HasSuffix(arg, "/")
+		fullPath := filepath.Join(opts.Roots[rootIndex], filepath.FromSlash(rel))
+		if info, err := os.Stat(fullPath); err == nil {
+			isDir = info.IsDir()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("stat %s: %w", arg, err)
+		}
+
+		explanation, err := combiner.Explain(opts, rootIndex, rel, isDir)
+		if err != nil {
+			return err
+		}
+		display := rel
+		if len(opts.Roots) > 1 {
+			display = path.Join(opts.RootLabels[rootIndex], rel)
+		}
+		if err := writeExplanation(w, display, explanation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveExplainPath finds the root containing arg and returns the slash-separated
+// path relative to it. Paths are resolved against the working directory first; with
+// several roots, a display path such as "web/src/app.ts" selects the root by label.
+func resolveExplainPath(roots, labels []string, arg string) (int, string, error) {
+	cleaned := strings.TrimSuffix(filepath.Clean(arg), string(filepath.Separator))
+	abs, err := filepath.Abs(cleaned)
+	if err != nil {
+		return 0, "", fmt.Errorf("resolve %q: %w", arg, err)
+	}
+
+	best := -1
+	bestRel := ""
+	for i, root := range roots {
+		rel, ok := relativeIfWithin(root, abs)
+		if !ok {
+			continue
+		}
+		if best == -1 || len(root) > len(roots[best]) {
+			best = i
+			bestRel = rel
+		}
+	}
+	if best != -1 {
+		return best, bestRel, nil
+	}
+
+	slashed := filepath.ToSlash(cleaned)
+	if len(roots) > 1 {
+		for i, label := range labels {
+			if rel, ok := strings.CutPrefix(slashed, label+"/"); ok && rel != "" {
+				return i, rel, nil
+			}
+		}
+	}
+	if len(roots) == 1 && !filepath.IsAbs(cleaned) && slashed != ".." && !strings.HasPrefix(slashed, "../") {
+		return 0, slashed, nil
+	}
+	return 0, "", fmt.Errorf("%s is not inside any root", arg)
+}
+
+func writeExplanation(w io.Writer, display string, explanation app.Explanation) error {
+	verdict := "excluded"
+	if explanation.Included() {
+		verdict = "included"
+	}
+	if explanation.IsDir {
+		display += "/"
+		verdict = "not walked"
+		if explanation.Included() {
+			verdict = "walked"
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s: %s\n", display, verdict); err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, len(explanation.Matches)+3)
+	if explanation.SkippedParent != "" {
+		// The parent's matching rules are among the path's own matches listed below.
+		lines = append(lines, fmt.Sprintf("parent directory %s/ is not walked", explanation.SkippedParent))
+	}
+	if explanation.BeyondMaxDepth {
+		lines = append(lines, "deeper than -max-depth")
+	}
+	if explanation.Excluded {
+		lines = append(lines, "excluded as the output file")
+	}
+	if explanation.Oversized {
+		action := "contents replaced by a placeholder"
+		if explanation.SkipOversize {
+			action = "left out"
+		}
+		lines = append(lines, fmt.Sprintf("%s is over -max-file-size; %s", bytesize.Format(explanation.Size), action))
+	}
+	lines = append(lines, formatMatches(explanation)...)
+	if len(explanation.Matches) == 0 && !explanation.Excluded {
+		lines = append(lines, "no rule matched")
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintf(w, "  %s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatMatches lists matched rules like git check-ignore -v, prefixed by their rule set.
+func formatMatches(explanation app.Explanation) []string {
+	lines := make([]string, 0, len(explanation.Matches))
+	for _, match := range explanation.Matches {
+		line := fmt.Sprintf("[%d %s] %s\t%s", match.RuleSet+1, match.Mode.String(), match.Rule.String(), match.Path)
+		lines = append(lines, line)
+	}
+	return lines
+}
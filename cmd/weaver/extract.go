@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/app"
+	"github.com/aatuh/weaver/internal/diff"
+)
+
+// runExtract recreates the files in a combined output under a directory.
+// Files whose contents were omitted from the output, or do not match the hash
+// recorded for them, are reported and left alone.
+func runExtract(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("weaver extract", flag.ExitOnError)
+	dir := flags.String("dir", ".", "Directory to write the files into")
+	showDiff := flags.Bool("diff", false, "Print a unified diff for each existing file before overwriting it")
+	dryRun := flags.Bool("dry-run", false, "Report what would be written without writing anything")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s extract [flags] <combined-file>\n\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(os.Stderr, "Extract writes the files in a weaver output back into a directory.")
+		fmt.Fprintln(os.Stderr, "Use '-' to read the output from stdin.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("extract requires exactly one combined file")
+	}
+
+	data, err := readCombined(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	parsed, err := app.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+	dirAbs, err := filepath.Abs(*dir)
+	if err != nil {
+		return fmt.Errorf("resolve directory: %w", err)
+	}
+
+	for _, file := range parsed.Files {
+		if file.Omitted != "" {
+			fmt.Fprintf(w, "skipped %s (%s)\n", file.Path, file.Omitted)
+			continue
+		}
+		if !file.Intact() {
+			fmt.Fprintf(w, "skipped %s (content does not match its hash)\n", file.Path)
+			continue
+		}
+		target, err := extractTarget(dirAbs, file.Path)
+		if err != nil {
+			return err
+		}
+		existing, err := os.ReadFile(target)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("read %s: %w", file.Path, err)
+		}
+		switch {
+		case exists && bytes.Equal(existing, file.Content):
+			fmt.Fprintf(w, "unchanged %s\n", file.Path)
+			continue
+		case exists:
+			if *showDiff {
+				if _, err := io.WriteString(w, fileDiff(file.Path, existing, file.Content)); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(w, "updated %s\n", file.Path)
+		default:
+			fmt.Fprintf(w, "created %s\n", file.Path)
+		}
+		if *dryRun {
+			continue
+		}
+		if err := writeExtracted(target, file.Content); err != nil {
+			return fmt.Errorf("write %s: %w", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// readCombined reads a combined output from a file, or from stdin for "-".
+func readCombined(name string) ([]byte, error) {
+	if name == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read stdin: %w", err)
+		}
+		return data, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read combined file: %w", err)
+	}
+	return data, nil
+}
+
+// extractTarget resolves a display path from a combined output to a file under
+// dirAbs. It refuses paths that would land outside the directory: absolute
+// paths, paths with ".." components, and paths through a symbolic link.
+func extractTarget(dirAbs, display string) (string, error) {
+	if display == "" || path.IsAbs(display) || filepath.IsAbs(display) || filepath.VolumeName(display) != "" || strings.Contains(display, "\\") {
+		return "", fmt.Errorf("refusing to extract %q: not a relative path", display)
+	}
+	for _, part := range strings.Split(display, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("refusing to extract %q: path leaves the target directory", display)
+		}
+	}
+	cleaned := path.Clean(display)
+	if cleaned == "." {
+		return "", fmt.Errorf("refusing to extract %q: not a file path", display)
+	}
+
+	current := dirAbs
+	for _, part := range strings.Split(cleaned, "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("stat %s: %w", display, err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q: %s is a symbolic link", display, current)
+		}
+	}
+	return filepath.Join(dirAbs, filepath.FromSlash(cleaned)), nil
+}
+
+// fileDiff describes the change between two versions of a file, or returns
+// "" when they are equal.
+func fileDiff(display string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	}
+	if bytes.IndexByte(before, 0) >= 0 || bytes.IndexByte(after, 0) >= 0 {
+		return fmt.Sprintf("Binary files a/%s and b/%s differ\n", display, display)
+	}
+	return diff.Unified("a/"+display, "b/"+display, before, after)
+}
+
+// writeExtracted writes contents to target, creating parent directories and
+// keeping the mode of a file it replaces.
+func writeExtracted(target string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	mode := fs.FileMode(0o644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return os.WriteFile(target, contents, mode)
+}
@@ -7,44 +7,190 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aatuh/weaver/internal/adapters/fs"
 	"github.com/aatuh/weaver/internal/app"
+	"github.com/aatuh/weaver/internal/bytesize"
 	"github.com/aatuh/weaver/internal/filter"
 	"github.com/aatuh/weaver/internal/gitignore"
+	"github.com/aatuh/weaver/internal/presets"
+	"github.com/aatuh/weaver/internal/tokenizer"
 )
 
 func main() {
-	var (
-		outFlag            = flag.String("out", "", "Output file path ('-' for stdout, defaults to stdout)")
-		includeTree        = flag.Bool("include-tree", false, "Include JSON file tree of included files")
-		includeTreeCompact = flag.Bool("include-tree-compact", false, "Include JSON file tree as a one-line payload")
-		maxDepth           = flag.Int("max-depth", -1, "Max directory depth to include (-1 for no limit, 0 for root only)")
-		skipContents       = flag.Bool("skip-contents", false, "Skip writing file contents (header and optional tree only)")
-		skipBinary         = flag.Bool("skip-binary", false, "Replace binary file contents with a placeholder line")
-	)
-	var roots []string
-	flag.Var(rootsFlag{Roots: &roots}, "root", "Root directory to scan (repeatable, defaults to current directory)")
-	var ruleSpecs []ruleSpec
-	flag.Var(ruleFlag{Mode: filter.ModeBlacklist, Specs: &ruleSpecs}, "blacklist", "Path to gitignore-style file to blacklist (repeatable)")
-	flag.Var(ruleFlag{Mode: filter.ModeWhitelist, Specs: &ruleSpecs}, "whitelist", "Path to gitignore-style file to whitelist (repeatable)")
-	flag.Var(rulePatternFlag{Mode: filter.ModeBlacklist, Specs: &ruleSpecs}, "blacklist-pattern", "Inline gitignore-style blacklist pattern (repeatable)")
-	flag.Var(rulePatternFlag{Mode: filter.ModeWhitelist, Specs: &ruleSpecs}, "whitelist-pattern", "Inline gitignore-style whitelist pattern (repeatable)")
+	args := os.Args[1:]
+	var err error
+	switch {
+	case len(args) > 0 && args[0] == "explain":
+		err = runExplain(args[1:], os.Stdout)
+	case len(args) > 0 && args[0] == "extract":
+		err = runExtract(args[1:], os.Stdout)
+	case len(args) > 0 && args[0] == "diff":
+		err = runDiff(args[1:], os.Stdout)
+	default:
+		err = runCombine(args)
+	}
+	if err != nil {
+		exitWithError(err)
+	}
+}
+
+// config holds the flag values shared by the combine, explain and diff commands.
+type config struct {
+	Out                string
+	Format             app.Format
+	IncludeTree        bool
+	IncludeTreeCompact bool
+	MaxDepth           int
+	SkipContents       bool
+	SkipBinary         bool
+	MaxFileSize        int64
+	SkipOversize       bool
+	FileMetadata       bool
+	NoTimestamp        bool
+	Jobs               int
+	MaxBytes           int64
+	MaxLines           int64
+	BudgetPolicy       app.BudgetPolicy
+	CountTokens        bool
+	Tokenizer          string
+	MaxTokens          int64
+	RespectGitignore   bool
+	GitExcludes        bool
+	StrictGitignore    bool
+	IgnoreCase         bool
+	ConfigPath         string
+	Profile            string
+	Roots              []string
+	RuleSpecs          []ruleSpec
+}
+
+func newFlagSet(name string, cfg *config) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&cfg.Profile, "profile", "", "Named profile from the config file to apply")
+	flags.StringVar(&cfg.ConfigPath, "config", "", "Path to a weaver.yaml or weaver.toml file (default: one found in the current directory, or in the root when a single -root is given)")
+	flags.StringVar(&cfg.Out, "out", "", "Output file path ('-' for stdout, defaults to stdout)")
+	flags.Var(formatFlag{Format: &cfg.Format}, "format", fmt.Sprintf("Output format: %s", strings.Join(app.FormatNames(), ", ")))
+	flags.BoolVar(&cfg.IncludeTree, "include-tree", false, "Include JSON file tree of included files")
+	flags.BoolVar(&cfg.IncludeTreeCompact, "include-tree-compact", false, "Include JSON file tree as a one-line payload")
+	flags.IntVar(&cfg.MaxDepth, "max-depth", -1, "Max directory depth to include (-1 for no limit, 0 for root only)")
+	flags.BoolVar(&cfg.SkipContents, "skip-contents", false, "Skip writing file contents (header and optional tree only)")
+	flags.BoolVar(&cfg.SkipBinary, "skip-binary", false, "Replace binary file contents with a placeholder line")
+	flags.Var(sizeFlag{Size: &cfg.MaxFileSize}, "max-file-size", "Largest file whose contents are written, such as 512K or 10MB (0 for no limit)")
+	flags.BoolVar(&cfg.SkipOversize, "skip-oversize", false, "Leave out files over -max-file-size instead of writing a placeholder")
+	flags.BoolVar(&cfg.FileMetadata, "file-metadata", false, "Add each file's size, line count, SHA-256, mtime, mode and language to its marker or record; mtimes are not reproducible")
+	flags.BoolVar(&cfg.NoTimestamp, "no-timestamp", false, "Leave the generation time out of the header, for byte-identical output from identical input")
+	flags.IntVar(&cfg.Jobs, "jobs", 0, "Number of directories walked and files read at once (0 for one per CPU; the output does not depend on it)")
+	flags.Var(sizeFlag{Size: &cfg.MaxBytes}, "max-bytes", "Output budget in bytes, such as 200K (0 for no limit)")
+	flags.Int64Var(&cfg.MaxLines, "max-lines", 0, "Output budget in lines (0 for no limit)")
+	flags.Var(budgetPolicyFlag{Policy: &cfg.BudgetPolicy}, "budget-policy", "How to fit the output budget: 'drop' leaves out low-priority files, 'truncate' cuts large files to their head and tail")
+	flags.BoolVar(&cfg.CountTokens, "count-tokens", false, "Report token counts in the header and tree")
+	flags.StringVar(&cfg.Tokenizer, "tokenizer", "bpe", fmt.Sprintf("Token counter: %s", strings.Join(tokenizer.Names(), " or ")))
+	flags.Int64Var(&cfg.MaxTokens, "max-tokens", 0, "Output budget in tokens, fitted with -budget-policy (0 for no limit; implies -count-tokens)")
+	flags.BoolVar(&cfg.RespectGitignore, "respect-gitignore", false, "Apply .gitignore files found while walking, and those above the root in its repository, relative to their directories")
+	flags.BoolVar(&cfg.GitExcludes, "git-excludes", false, "Apply the repository's .git/info/exclude and the global core.excludesFile")
+	flags.BoolVar(&cfg.StrictGitignore, "strict-gitignore", false, "Evaluate rules with git's exact semantics (paths under an excluded directory cannot be re-included)")
+	flags.BoolVar(&cfg.IgnoreCase, "ignore-case", false, "Match every rule regardless of letter case, like git's core.ignorecase")
+	flags.Var(rootsFlag{Roots: &cfg.Roots}, "root", "Root directory to scan (repeatable, defaults to current directory)")
+	flags.Var(ruleFlag{Mode: filter.ModeBlacklist, Specs: &cfg.RuleSpecs}, "blacklist", "Path to gitignore-style file to blacklist (repeatable, 'label=path' limits it to one root)")
+	flags.Var(ruleFlag{Mode: filter.ModeWhitelist, Specs: &cfg.RuleSpecs}, "whitelist", "Path to gitignore-style file to whitelist (repeatable, 'label=path' limits it to one root)")
+	flags.Var(ruleFlag{Mode: filter.ModeBlacklist, IgnoreCase: true, Specs: &cfg.RuleSpecs}, "blacklist-icase", "Path to gitignore-style file to blacklist, matched case-insensitively (repeatable, 'label=path' limits it to one root)")
+	flags.Var(ruleFlag{Mode: filter.ModeWhitelist, IgnoreCase: true, Specs: &cfg.RuleSpecs}, "whitelist-icase", "Path to gitignore-style file to whitelist, matched case-insensitively (repeatable, 'label=path' limits it to one root)")
+	flags.Var(rulePatternFlag{Mode: filter.ModeBlacklist, Specs: &cfg.RuleSpecs}, "blacklist-pattern", "Inline gitignore-style blacklist pattern (repeatable, 'label=pattern' limits it to one root)")
+	flags.Var(rulePatternFlag{Mode: filter.ModeWhitelist, Specs: &cfg.RuleSpecs}, "whitelist-pattern", "Inline gitignore-style whitelist pattern (repeatable, 'label=pattern' limits it to one root)")
+	flags.Var(presetFlag{Specs: &cfg.RuleSpecs}, "preset", fmt.Sprintf("Built-in blacklist for an ecosystem: %s (repeatable, 'label=preset' limits it to one root)", strings.Join(presets.Names(), ", ")))
+	return flags
+}
 
-	flag.Usage = func() {
-		usage(os.Stderr)
+func runCombine(args []string) error {
+	var cfg config
+	flags := newFlagSet("weaver", &cfg)
+	flags.Usage = func() {
+		usage(os.Stderr, flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), ", "))
+	}
+	if err := applyConfigFile(flags, &cfg); err != nil {
+		return err
 	}
 
-	flag.Parse()
+	outAbs, err := resolveOutput(cfg.Out)
+	if err != nil {
+		return err
+	}
+	opts, err := buildOptions(&cfg, outAbs)
+	if err != nil {
+		return err
+	}
+	combiner := app.Combiner{FS: fs.OSFS{}}
+	epoch, ok, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	if ok {
+		combiner.Clock = func() time.Time { return epoch }
+		opts.Reproducible = true
+	}
 
-	if flag.NArg() > 0 {
-		exitWithError(fmt.Errorf("unexpected arguments: %s", strings.Join(flag.Args(), ", ")))
+	// The output is created only once the options are known to be valid, so a
+	// mistake on the command line leaves an existing file untouched.
+	outWriter, err := openOutput(outAbs)
+	if err != nil {
+		return err
 	}
-	if *maxDepth < -1 {
-		exitWithError(fmt.Errorf("max-depth must be -1 (no limit) or a non-negative integer"))
+	defer outWriter.Close()
+	opts.Output = outWriter
+	return combiner.Combine(context.Background(), opts)
+}
+
+// sourceDateEpoch reads the SOURCE_DATE_EPOCH environment variable, which
+// reproducible builds use to fix the time recorded in their outputs.
+func sourceDateEpoch() (time.Time, bool, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("SOURCE_DATE_EPOCH must be a number of seconds since the Unix epoch, got %q", value)
+	}
+	return time.Unix(seconds, 0), true, nil
+}
+
+// buildOptions resolves roots and rule files into combine options. The output
+// file, when outAbs is set, is excluded from every root that contains it.
+func buildOptions(cfg *config, outAbs string) (app.Options, error) {
+	if cfg.MaxDepth < -1 {
+		return app.Options{}, fmt.Errorf("max-depth must be -1 (no limit) or a non-negative integer")
+	}
+	if cfg.Jobs < 0 {
+		return app.Options{}, fmt.Errorf("jobs must be 0 (one per CPU) or positive")
+	}
+	jobs := cfg.Jobs
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+	if cfg.MaxLines < 0 || cfg.MaxTokens < 0 {
+		return app.Options{}, fmt.Errorf("max-lines and max-tokens must be 0 (no limit) or positive")
+	}
+	var counter tokenizer.Counter
+	if cfg.CountTokens || cfg.MaxTokens > 0 {
+		var err error
+		if counter, err = tokenizer.New(cfg.Tokenizer); err != nil {
+			return app.Options{}, err
+		}
 	}
 
+	roots := cfg.Roots
 	if len(roots) == 0 {
 		roots = []string{"."}
 	}
@@ -52,22 +198,16 @@ func main() {
 	for _, root := range roots {
 		rootAbs, err := filepath.Abs(root)
 		if err != nil {
-			exitWithError(fmt.Errorf("resolve root %q: %w", root, err))
+			return app.Options{}, fmt.Errorf("resolve root %q: %w", root, err)
 		}
 		rootAbs = filepath.Clean(rootAbs)
 		if err := validateRoot(rootAbs); err != nil {
-			exitWithError(err)
+			return app.Options{}, err
 		}
 		rootsAbs = append(rootsAbs, rootAbs)
 	}
 	rootLabels := makeRootLabels(rootsAbs)
 
-	outWriter, outAbs, err := prepareOutput(*outFlag)
-	if err != nil {
-		exitWithError(err)
-	}
-	defer outWriter.Close()
-
 	excludedPaths := make([][]string, len(rootsAbs))
 	if outAbs != "" {
 		for i, root := range rootsAbs {
@@ -77,37 +217,66 @@ func main() {
 		}
 	}
 
-	baseMode := filter.ModeBlacklist
-	if len(ruleSpecs) > 0 {
-		baseMode = ruleSpecs[0].Mode
+	ruleSpecs, err := scopeRuleSpecs(cfg.RuleSpecs, rootLabels)
+	if err != nil {
+		return app.Options{}, err
 	}
 	filters := make([]filter.PathFilter, len(rootsAbs))
+	var nestedRules []*filter.NestedRules
+	if cfg.RespectGitignore {
+		nestedRules = make([]*filter.NestedRules, len(rootsAbs))
+	}
 	for i, root := range rootsAbs {
-		ruleSets, err := loadRuleSets(root, ruleSpecs)
+		rootSpecs := specsForRoot(ruleSpecs, rootLabels[i])
+		baseMode := baseModeFor(rootSpecs)
+		var nested *filter.NestedRules
+		if cfg.RespectGitignore {
+			nested = filter.NewNestedRules(gitignoreFileName)
+			nested.IgnoreCase = cfg.IgnoreCase
+			nestedRules[i] = nested
+		}
+		ruleSets, err := loadRuleSets(root, rootSpecs, ruleLoadOptions{
+			IgnoreCase:  cfg.IgnoreCase,
+			GitExcludes: cfg.GitExcludes,
+			Nested:      nested,
+		})
 		if err != nil {
-			exitWithError(err)
+			return app.Options{}, err
+		}
+		var baseFilter filter.PathFilter
+		if cfg.StrictGitignore {
+			baseFilter = filter.NewStrictRuleSetFilter(ruleSets, baseMode)
+		} else {
+			baseFilter = filter.NewRuleSetFilter(ruleSets, baseMode)
 		}
-		baseFilter := filter.NewRuleSetFilter(ruleSets, baseMode)
 		filters[i] = filter.NewExcludePathFilter(baseFilter, excludedPaths[i])
 	}
 
-	combiner := app.Combiner{FS: fs.OSFS{}}
-	opts := app.Options{
+	return app.Options{
 		Roots:              rootsAbs,
 		RootLabels:         rootLabels,
 		Filters:            filters,
-		IncludeTree:        *includeTree,
-		IncludeTreeCompact: *includeTreeCompact,
-		MaxDepth:           *maxDepth,
-		SkipContents:       *skipContents,
-		SkipBinary:         *skipBinary,
-		Output:             outWriter,
-		ModeLabel:          formatRuleModes(ruleSpecs),
-	}
-
-	if err := combiner.Combine(context.Background(), opts); err != nil {
-		exitWithError(err)
-	}
+		NestedRules:        nestedRules,
+		IncludeTree:        cfg.IncludeTree,
+		IncludeTreeCompact: cfg.IncludeTreeCompact,
+		MaxDepth:           cfg.MaxDepth,
+		SkipContents:       cfg.SkipContents,
+		SkipBinary:         cfg.SkipBinary,
+		MaxFileSize:        cfg.MaxFileSize,
+		SkipOversize:       cfg.SkipOversize,
+		FileMetadata:       cfg.FileMetadata,
+		NoTimestamp:        cfg.NoTimestamp,
+		Reproducible:       cfg.NoTimestamp,
+		Jobs:               jobs,
+		MaxBytes:           cfg.MaxBytes,
+		MaxLines:           cfg.MaxLines,
+		BudgetPolicy:       cfg.BudgetPolicy,
+		Tokens:             counter,
+		MaxTokens:          cfg.MaxTokens,
+		Format:             cfg.Format,
+		Profile:            cfg.Profile,
+		ModeLabel:          formatRuleModes(implicitRuleLabels(cfg.GitExcludes, cfg.RespectGitignore), ruleSpecs),
+	}, nil
 }
 
 func validateRoot(root string) error {
@@ -121,22 +290,30 @@ func validateRoot(root string) error {
 	return nil
 }
 
-func prepareOutput(outPath string) (io.WriteCloser, string, error) {
+// resolveOutput returns the absolute path of the output file, or "" when the
+// output goes to stdout.
+func resolveOutput(outPath string) (string, error) {
 	if outPath == "" || outPath == "-" {
-		return nopCloser{Writer: os.Stdout}, "", nil
+		return "", nil
 	}
-
 	outAbs, err := filepath.Abs(outPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("resolve output: %w", err)
+		return "", fmt.Errorf("resolve output: %w", err)
+	}
+	return outAbs, nil
+}
+
+// openOutput creates the output file at outAbs, or returns stdout when it is "".
+func openOutput(outAbs string) (io.WriteCloser, error) {
+	if outAbs == "" {
+		return nopCloser{Writer: os.Stdout}, nil
 	}
 	// #nosec G304 -- output path is user-provided by design.
 	file, err := os.Create(outAbs)
 	if err != nil {
-		return nil, "", fmt.Errorf("create output: %w", err)
+		return nil, fmt.Errorf("create output: %w", err)
 	}
-
-	return file, outAbs, nil
+	return file, nil
 }
 
 func relativeIfWithin(rootAbs, targetAbs string) (string, bool) {
@@ -166,10 +343,81 @@ func (n nopCloser) Close() error {
 	return nil
 }
 
+const gitignoreFileName = ".gitignore"
+
 type ruleSpec struct {
-	Mode    filter.Mode
-	Path    string
-	Pattern string
+	Mode       filter.Mode
+	Path       string
+	Pattern    string
+	IgnoreCase bool
+	// Root is the label of the only root the spec applies to; empty applies it to every root.
+	Root string
+	// Preset names a built-in blacklist instead of a rule file or pattern.
+	Preset string
+	// Source names where the spec came from in diagnostics, such as a config file.
+	// Lines maps each line of Pattern to its line in that source.
+	Source string
+	Lines  []int
+}
+
+type sizeFlag struct {
+	Size *int64
+}
+
+func (f sizeFlag) String() string {
+	if f.Size == nil || *f.Size == 0 {
+		return ""
+	}
+	return strconv.FormatInt(*f.Size, 10)
+}
+
+func (f sizeFlag) Set(value string) error {
+	size, err := bytesize.Parse(value)
+	if err != nil {
+		return err
+	}
+	*f.Size = size
+	return nil
+}
+
+type budgetPolicyFlag struct {
+	Policy *app.BudgetPolicy
+}
+
+func (f budgetPolicyFlag) String() string {
+	if f.Policy == nil {
+		return app.BudgetDrop.String()
+	}
+	return f.Policy.String()
+}
+
+func (f budgetPolicyFlag) Set(value string) error {
+	policy, err := app.ParseBudgetPolicy(value)
+	if err != nil {
+		return err
+	}
+	*f.Policy = policy
+	return nil
+}
+
+type formatFlag struct {
+	Format *app.Format
+}
+
+func (f formatFlag) String() string {
+	if f.Format == nil {
+		return app.FormatText.String()
+	}
+	return f.Format.String()
+}
+
+func (f formatFlag) Set(value string) error {
+	format, err := app.ParseFormat(value)
+	if err != nil {
+		return err
+	}
+	*f.Format = format
+	return nil
 }
 
 type rootsFlag struct {
@@ -196,8 +444,9 @@ func (f rootsFlag) Set(value string) error {
 }
 
 type ruleFlag struct {
-	Mode  filter.Mode
-	Specs *[]ruleSpec
+	Mode       filter.Mode
+	IgnoreCase bool
+	Specs      *[]ruleSpec
 }
 
 func (f ruleFlag) String() string {
@@ -206,7 +455,7 @@ func (f ruleFlag) String() string {
 	}
 	parts := make([]string, 0, len(*f.Specs))
 	for _, spec := range *f.Specs {
-		if spec.Mode == f.Mode && spec.Path != "" {
+		if spec.Mode == f.Mode && spec.Path != "" && spec.IgnoreCase == f.IgnoreCase {
 			parts = append(parts, spec.Path)
 		}
 	}
@@ -221,7 +470,7 @@ func (f ruleFlag) Set(value string) error {
 	if f.Specs == nil {
 		return fmt.Errorf("rule destination is not configured")
 	}
-	*f.Specs = append(*f.Specs, ruleSpec{Mode: f.Mode, Path: value})
+	*f.Specs = append(*f.Specs, ruleSpec{Mode: f.Mode, Path: value, IgnoreCase: f.IgnoreCase})
 	return nil
 }
 
@@ -254,6 +503,112 @@ func (f rulePatternFlag) Set(value string) error {
 	return nil
 }
 
+// scopeRuleSpecs splits a "label=value" rule file or pattern into a spec scoped to the
+// root with that label. Values whose text before "=" is not a root label are kept whole.
+func scopeRuleSpecs(specs []ruleSpec, rootLabels []string) ([]ruleSpec, error) {
+	scoped := make([]ruleSpec, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Root != "" {
+			if !slices.Contains(rootLabels, spec.Root) {
+				return nil, fmt.Errorf("unknown root %q in %s (roots: %s)", spec.Root, spec.describe(), strings.Join(rootLabels, ", "))
+			}
+			scoped = append(scoped, spec)
+			continue
+		}
+		value := spec.Path
+		if spec.Pattern != "" {
+			value = spec.Pattern
+		}
+		label, rest, ok := strings.Cut(value, "=")
+		if !ok {
+			scoped = append(scoped, spec)
+			continue
+		}
+		if slices.Contains(rootLabels, label) {
+			if strings.TrimSpace(rest) == "" {
+				return nil, fmt.Errorf("%s rule for root %q is empty", spec.Mode.String(), label)
+			}
+			spec.Root = label
+			if spec.Pattern != "" {
+				spec.Pattern = rest
+			} else {
+				spec.Path = rest
+			}
+			scoped = append(scoped, spec)
+			continue
+		}
+		scoped = append(scoped, spec)
+	}
+	return scoped, nil
+}
+
+// specsForRoot returns the specs that apply to the root with the given label, in order.
+func specsForRoot(specs []ruleSpec, label string) []ruleSpec {
+	out := make([]ruleSpec, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Root == "" || spec.Root == label {
+			out = append(out, spec)
+		}
+	}
+	return out
+}
+
+func (s ruleSpec) describe() string {
+	switch {
+	case s.Preset != "":
+		return "preset " + s.Preset
+	case s.Source != "":
+		return fmt.Sprintf("%s rule from %s", s.Mode.String(), s.Source)
+	default:
+		return s.Mode.String() + " rule"
+	}
+}
+
+type presetFlag struct {
+	Specs *[]ruleSpec
+}
+
+func (f presetFlag) String() string {
+	if f.Specs == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*f.Specs))
+	for _, spec := range *f.Specs {
+		if spec.Preset != "" {
+			parts = append(parts, spec.Preset)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f presetFlag) Set(value string) error {
+	if f.Specs == nil {
+		return fmt.Errorf("rule destination is not configured")
+	}
+	label, name, scoped := strings.Cut(value, "=")
+	if !scoped {
+		name = label
+		label = ""
+	}
+	preset, err := presets.Canonical(name)
+	if err != nil {
+		return err
+	}
+	*f.Specs = append(*f.Specs, ruleSpec{Mode: filter.ModeBlacklist, Preset: preset, Root: label})
+	return nil
+}
+
+// baseModeFor returns the mode of the first rule file or pattern. Presets only
+// remove junk, so they do not turn a whitelist run into a blacklist one.
+func baseModeFor(specs []ruleSpec) filter.Mode {
+	for _, spec := range specs {
+		if spec.Preset == "" {
+			return spec.Mode
+		}
+	}
+	return filter.ModeBlacklist
+}
+
 func resolveRulePath(rootAbs, rulePath string) string {
 	if rulePath == "" {
 		return rulePath
@@ -270,19 +625,63 @@ func resolveRulePath(rootAbs, rulePath string) string {
 	return filepath.Join(rootAbs, rulePath)
 }
 
-func loadRuleSets(rootAbs string, ruleSpecs []ruleSpec) ([]filter.RuleSet, error) {
-	ruleSets := make([]filter.RuleSet, 0, len(ruleSpecs))
+// ruleLoadOptions controls the rule sets loadRuleSets builds besides the
+// explicit specs.
+type ruleLoadOptions struct {
+	// IgnoreCase makes every rule match case-insensitively; otherwise only
+	// specs that ask for it do.
+	IgnoreCase bool
+	// GitExcludes adds the global excludes file and info/exclude.
+	GitExcludes bool
+	// Nested, when set, holds the in-tree .gitignore rules.
+	Nested *filter.NestedRules
+}
+
+// loadRuleSets builds a root's rule set chain, lowest precedence first, as git
+// orders them: the git excludes, then in-tree .gitignore files, then the rule
+// files and inline patterns of ruleSpecs in order, which override both.
+func loadRuleSets(rootAbs string, ruleSpecs []ruleSpec, opts ruleLoadOptions) ([]filter.RuleSet, error) {
+	ruleSets := make([]filter.RuleSet, 0, len(ruleSpecs)+3)
+	if opts.GitExcludes {
+		excludeSets, err := loadGitExcludeRuleSets(rootAbs, opts.IgnoreCase)
+		if err != nil {
+			return nil, err
+		}
+		ruleSets = append(ruleSets, excludeSets...)
+	}
+	if opts.Nested != nil {
+		if err := loadAncestorRules(rootAbs, opts.Nested); err != nil {
+			return nil, err
+		}
+		ruleSets = append(ruleSets, filter.RuleSet{Mode: filter.ModeBlacklist, Nested: opts.Nested})
+	}
 	for _, spec := range ruleSpecs {
+		parseOpts := gitignore.ParseOptions{IgnoreCase: opts.IgnoreCase || spec.IgnoreCase}
+		if spec.Preset != "" {
+			matcher, err := presets.Load(spec.Preset, parseOpts)
+			if err != nil {
+				return nil, err
+			}
+			ruleSets = append(ruleSets, filter.RuleSet{Mode: filter.ModeBlacklist, Matcher: matcher})
+			continue
+		}
 		if spec.Pattern != "" {
-			matcher, err := gitignore.Parse(strings.NewReader(spec.Pattern))
+			parseOpts.Source = spec.Source
+			if parseOpts.Source == "" {
+				parseOpts.Source = fmt.Sprintf("-%s-pattern", spec.Mode.String())
+			}
+			matcher, err := gitignore.ParseWithOptions(strings.NewReader(spec.Pattern), parseOpts)
 			if err != nil {
 				return nil, fmt.Errorf("parse %s pattern %q: %w", spec.Mode.String(), spec.Pattern, err)
 			}
+			if len(spec.Lines) > 0 {
+				matcher = remapRuleLines(matcher, spec.Lines)
+			}
 			ruleSets = append(ruleSets, filter.RuleSet{Mode: spec.Mode, Matcher: matcher})
 			continue
 		}
 		rulePath := resolveRulePath(rootAbs, spec.Path)
-		matcher, err := gitignore.LoadFile(rulePath)
+		matcher, err := gitignore.LoadFileWithOptions(rulePath, parseOpts)
 		if err != nil {
 			return nil, fmt.Errorf("load %s rules from %s: %w", spec.Mode.String(), rulePath, err)
 		}
@@ -291,16 +690,110 @@ func loadRuleSets(rootAbs string, ruleSpecs []ruleSpec) ([]filter.RuleSet, error
 	return ruleSets, nil
 }
 
-func formatRuleModes(ruleSpecs []ruleSpec) string {
-	if len(ruleSpecs) == 0 {
-		return ""
+// remapRuleLines replaces each rule's line within the joined patterns with its line in the spec's source.
+func remapRuleLines(matcher *gitignore.Matcher, lines []int) *gitignore.Matcher {
+	rules := append([]gitignore.Rule(nil), matcher.Rules()...)
+	for i := range rules {
+		if rules[i].Line >= 1 && rules[i].Line <= len(lines) {
+			rules[i].Line = lines[rules[i].Line-1]
+		}
+	}
+	return gitignore.NewMatcher(rules)
+}
+
+// loadAncestorRules loads the nested rule files in the directories between the
+// top of the root's repository and the root, which git applies to the root as
+// well. Outside a repository there are none.
+func loadAncestorRules(rootAbs string, nested *filter.NestedRules) error {
+	repo, inRepo, err := gitignore.FindRepository(rootAbs)
+	if err != nil {
+		return fmt.Errorf("find git repository for %s: %w", rootAbs, err)
+	}
+	if !inRepo {
+		return nil
+	}
+	rel, ok := relativeIfWithin(repo.WorkTree, rootAbs)
+	if !ok {
+		return nil
+	}
+	dir := repo.WorkTree
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		rulePath := filepath.Join(dir, nested.FileName)
+		matcher, err := gitignore.LoadFileWithOptions(rulePath, gitignore.ParseOptions{IgnoreCase: nested.IgnoreCase})
+		if err != nil {
+			return fmt.Errorf("load %s: %w", rulePath, err)
+		}
+		nested.AddAncestor(strings.Join(parts[i:], "/"), matcher)
+		dir = filepath.Join(dir, parts[i])
+	}
+	return nil
+}
+
+// loadGitExcludeRuleSets loads the global excludes file and the repository's
+// info/exclude, lowest precedence first. Their patterns are anchored at the
+// work tree, so the root's position inside it becomes the rule set prefix.
+func loadGitExcludeRuleSets(rootAbs string, ignoreCase bool) ([]filter.RuleSet, error) {
+	repo, inRepo, err := gitignore.FindRepository(rootAbs)
+	if err != nil {
+		return nil, fmt.Errorf("find git repository for %s: %w", rootAbs, err)
+	}
+	prefix := ""
+	if inRepo {
+		if rel, ok := relativeIfWithin(repo.WorkTree, rootAbs); ok {
+			prefix = rel
+		}
+	}
+
+	paths := make([]string, 0, 2)
+	globalPath, err := gitignore.GlobalExcludesFile(repo)
+	if err != nil {
+		return nil, err
+	}
+	if globalPath != "" {
+		paths = append(paths, globalPath)
 	}
-	if len(ruleSpecs) == 1 {
-		return ruleSpecs[0].Mode.String()
+	if inRepo {
+		paths = append(paths, repo.InfoExcludePath())
 	}
-	parts := make([]string, 0, len(ruleSpecs))
+
+	ruleSets := make([]filter.RuleSet, 0, len(paths))
+	for _, rulePath := range paths {
+		matcher, err := gitignore.LoadFileWithOptions(rulePath, gitignore.ParseOptions{IgnoreCase: ignoreCase})
+		if err != nil {
+			return nil, fmt.Errorf("load git excludes from %s: %w", rulePath, err)
+		}
+		if len(matcher.Rules()) == 0 {
+			continue
+		}
+		ruleSets = append(ruleSets, filter.RuleSet{Mode: filter.ModeBlacklist, Matcher: matcher, Prefix: prefix})
+	}
+	return ruleSets, nil
+}
+
+func implicitRuleLabels(gitExcludes, respectGitignore bool) []string {
+	labels := make([]string, 0, 2)
+	if gitExcludes {
+		labels = append(labels, "git-excludes")
+	}
+	if respectGitignore {
+		labels = append(labels, "gitignore")
+	}
+	return labels
+}
+
+func formatRuleModes(implicit []string, ruleSpecs []ruleSpec) string {
+	parts := make([]string, 0, len(implicit)+len(ruleSpecs))
+	parts = append(parts, implicit...)
 	for _, spec := range ruleSpecs {
-		parts = append(parts, spec.Mode.String())
+		part := spec.Mode.String()
+		if spec.Preset != "" {
+			part = "preset:" + spec.Preset
+		}
+		if spec.Root != "" {
+			part = spec.Root + ":" + part
+		}
+		parts = append(parts, part)
 	}
 	return strings.Join(parts, " -> ")
 }
@@ -361,25 +854,51 @@ func makeUniqueLabels(labels []string) []string {
 	return out
 }
 
-func usage(w io.Writer) {
-	fmt.Fprintf(w, "Usage: %s [flags]\n\n", filepath.Base(os.Args[0]))
+func usage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s [flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, "       %s explain [flags] <path>...\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, "       %s extract [flags] <combined-file>\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(w, "       %s diff [flags] <combined-file|root> <combined-file|root>\n\n", filepath.Base(os.Args[0]))
 	fmt.Fprintln(w, "Weaver combines files from a directory into a single text file.")
 	fmt.Fprintln(w, "Filtering is configured by one or more gitignore-style rule files.")
+	fmt.Fprintln(w, "Options may also come from a weaver.yaml or weaver.toml file; flags override it.")
 	fmt.Fprintln(w, "Rule files are evaluated in order; later matches override earlier ones.")
 	fmt.Fprintln(w, "If no rule files are provided, all files are included.")
+	fmt.Fprintln(w, "The explain command reports which rules decided each path.")
+	fmt.Fprintln(w, "The extract command writes the files in a combined output back into a directory.")
+	fmt.Fprintln(w, "The diff command compares two combined outputs, or one against a root, file by file.")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Flags:")
-	output := flag.CommandLine.Output()
-	flag.CommandLine.SetOutput(w)
-	flag.PrintDefaults()
-	flag.CommandLine.SetOutput(output)
+	output := flags.Output()
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+	flags.SetOutput(output)
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Examples:")
 	fmt.Fprintln(w, "  weaver -root . -out combined.txt")
 	fmt.Fprintln(w, "  weaver -root . -blacklist-pattern \"*.log\" -out -")
 	fmt.Fprintln(w, "  weaver -root . -include-tree -out -")
+	fmt.Fprintln(w, "  weaver -root . -format markdown -out combined.md")
+	fmt.Fprintln(w, "  weaver -root . -format xml -skip-binary -out -")
+	fmt.Fprintln(w, "  weaver -root . -format jsonl -out files.jsonl")
 	fmt.Fprintln(w, "  weaver -root . -include-tree-compact -out -")
 	fmt.Fprintln(w, "  weaver -root . -max-depth 2 -skip-binary -out -")
+	fmt.Fprintln(w, "  weaver -root . -max-file-size 256K -out -")
+	fmt.Fprintln(w, "  weaver -root . -file-metadata -out -")
+	fmt.Fprintln(w, "  weaver -root . -no-timestamp -out combined.txt")
+	fmt.Fprintln(w, "  weaver -root . -max-bytes 400K -budget-policy truncate -out -")
+	fmt.Fprintln(w, "  weaver -root . -max-tokens 100000 -include-tree -out -")
 	fmt.Fprintln(w, "  weaver -root ./api -root ./web -out -")
+	fmt.Fprintln(w, "  weaver -root ./api -root ./web -whitelist api=api.allow -whitelist web=web.allow -out -")
 	fmt.Fprintln(w, "  weaver -blacklist .gitignore -out -")
+	fmt.Fprintln(w, "  weaver -respect-gitignore -out -")
+	fmt.Fprintln(w, "  weaver -respect-gitignore -git-excludes -out -")
+	fmt.Fprintln(w, "  weaver -whitelist-icase allow.txt -out -")
+	fmt.Fprintln(w, "  weaver -preset node -preset go -out -")
+	fmt.Fprintln(w, "  weaver -config ci/weaver.yaml -out -")
+	fmt.Fprintln(w, "  weaver -profile review -out review.txt")
+	fmt.Fprintln(w, "  weaver explain -respect-gitignore -whitelist allow.txt src/debug.log")
+	fmt.Fprintln(w, "  weaver extract -dir ./restored -diff combined.txt")
+	fmt.Fprintln(w, "  weaver diff release-1.0.txt release-1.1.txt")
+	fmt.Fprintln(w, "  weaver diff -respect-gitignore release-1.1.txt .")
 }
@@ -3,9 +3,12 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aatuh/weaver/internal/filter"
+	"github.com/aatuh/weaver/internal/gitignore"
 )
 
 func TestResolveRulePathPrefersCwd(t *testing.T) {
@@ -72,7 +75,7 @@ func TestLoadRuleSetsInlinePattern(t *testing.T) {
 	rootAbs := t.TempDir()
 	ruleSets, err := loadRuleSets(rootAbs, []ruleSpec{
 		{Mode: filter.ModeBlacklist, Pattern: "*.log"},
-	})
+	}, ruleLoadOptions{})
 	if err != nil {
 		t.Fatalf("load rule sets: %v", err)
 	}
@@ -85,3 +88,480 @@ func TestLoadRuleSetsInlinePattern(t *testing.T) {
 		t.Fatalf("expected .txt to be included with inline pattern")
 	}
 }
+
+func TestLoadRuleSetsIgnoreCasePerFile(t *testing.T) {
+	rootAbs := t.TempDir()
+	if err := os.WriteFile(filepath.Join(rootAbs, "allow.txt"), []byte("readme.md\ndocs/\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	specs := []ruleSpec{
+		{Mode: filter.ModeWhitelist, Path: "allow.txt", IgnoreCase: true},
+		{Mode: filter.ModeBlacklist, Pattern: "*.tmp"},
+	}
+	ruleSets, err := loadRuleSets(rootAbs, specs, ruleLoadOptions{})
+	if err != nil {
+		t.Fatalf("load rule sets: %v", err)
+	}
+
+	pathFilter := filter.NewRuleSetFilter(ruleSets, filter.ModeWhitelist)
+	if decision := pathFilter.Evaluate("README.MD", false); !decision.Include {
+		t.Fatalf("expected README.MD to match readme.md case-insensitively")
+	}
+	if decision := pathFilter.Evaluate("Docs/guide.txt", false); !decision.Include {
+		t.Fatalf("expected Docs/ to match docs/ case-insensitively")
+	}
+	if decision := pathFilter.Evaluate("Docs/scratch.TMP", false); !decision.Include {
+		t.Fatalf("expected the inline pattern to stay case-sensitive")
+	}
+
+	ruleSets, err = loadRuleSets(rootAbs, specs, ruleLoadOptions{IgnoreCase: true})
+	if err != nil {
+		t.Fatalf("load rule sets: %v", err)
+	}
+	pathFilter = filter.NewRuleSetFilter(ruleSets, filter.ModeWhitelist)
+	if decision := pathFilter.Evaluate("Docs/scratch.TMP", false); decision.Include {
+		t.Fatalf("expected -ignore-case to apply to inline patterns")
+	}
+}
+
+func TestPresetDoesNotSetBaseMode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "node_modules"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	var cfg config
+	flags := newFlagSet("weaver", &cfg)
+	if err := flags.Parse([]string{"-root", dir, "-whitelist-pattern", "*.js", "-preset", "node"}); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	opts, err := buildOptions(&cfg, "")
+	if err != nil {
+		t.Fatalf("build options: %v", err)
+	}
+
+	pathFilter := opts.Filters[0]
+	if decision := pathFilter.Evaluate("index.js", false); !decision.Include {
+		t.Fatalf("expected the whitelist to include index.js")
+	}
+	if decision := pathFilter.Evaluate("README.md", false); decision.Include {
+		t.Fatalf("expected the whitelist to set the base mode")
+	}
+	if decision := pathFilter.Evaluate("node_modules", true); decision.Include {
+		t.Fatalf("expected the node preset to exclude node_modules/")
+	}
+	if opts.ModeLabel != "whitelist -> preset:node" {
+		t.Fatalf("unexpected mode label %q", opts.ModeLabel)
+	}
+
+	if err := flags.Set("preset", "cobol"); err == nil {
+		t.Fatalf("expected an unknown preset to be rejected")
+	}
+}
+
+func TestLoadGitExcludeRuleSetsAnchorsAtWorkTree(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	globalIgnore := filepath.Join(home, "global.ignore")
+	if err := os.WriteFile(globalIgnore, []byte("*.swp\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	gitconfig := "[core]\n\texcludesFile = ~/global.ignore\n"
+	if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitconfig), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	repo := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repo, ".git", "info"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, ".git", "info", "exclude"), []byte("/sub/local.txt\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rootAbs := filepath.Join(repo, "sub")
+	if err := os.MkdirAll(rootAbs, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	// An explicit whitelist overrides the git excludes below it.
+	ruleSets, err := loadRuleSets(rootAbs, []ruleSpec{
+		{Mode: filter.ModeWhitelist, Pattern: "keep.swp"},
+	}, ruleLoadOptions{GitExcludes: true})
+	if err != nil {
+		t.Fatalf("load rule sets: %v", err)
+	}
+	if len(ruleSets) != 3 {
+		t.Fatalf("expected global, info/exclude and whitelist rule sets, got %d", len(ruleSets))
+	}
+
+	pathFilter := filter.NewRuleSetFilter(ruleSets, filter.ModeBlacklist)
+	if decision := pathFilter.Evaluate("local.txt", false); decision.Include {
+		t.Fatalf("expected info/exclude rule anchored at the work tree to match")
+	}
+	if decision := pathFilter.Evaluate("notes.swp", false); decision.Include {
+		t.Fatalf("expected global excludes to apply")
+	}
+	if decision := pathFilter.Evaluate("keep.swp", false); !decision.Include {
+		t.Fatalf("expected the explicit whitelist to override the git excludes")
+	}
+
+	// A relative excludesFile in the repository config is resolved against the
+	// work tree, not the working directory.
+	if err := os.WriteFile(filepath.Join(repo, "repo.ignore"), []byte("*.tmp\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, ".git", "config"), []byte("[core]\n\texcludesFile = repo.ignore\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	ruleSets, err = loadGitExcludeRuleSets(rootAbs, false)
+	if err != nil {
+		t.Fatalf("load git excludes: %v", err)
+	}
+	pathFilter = filter.NewRuleSetFilter(ruleSets, filter.ModeBlacklist)
+	if decision := pathFilter.Evaluate("scratch.tmp", false); decision.Include {
+		t.Fatalf("expected a relative excludesFile to resolve against the work tree")
+	}
+	if decision := pathFilter.Evaluate("main.go", false); !decision.Include {
+		t.Fatalf("expected main.go to be included")
+	}
+}
+
+func TestLoadRuleSetsAppliesGitignoresAboveTheRoot(t *testing.T) {
+	repo := t.TempDir()
+	rootAbs := filepath.Join(repo, "services", "api")
+	if err := os.MkdirAll(rootAbs, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, ".gitignore"), []byte("*.log\n/services/api/secret.txt\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "services", ".gitignore"), []byte("!keep.log\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	nested := filter.NewNestedRules(gitignoreFileName)
+	ruleSets, err := loadRuleSets(rootAbs, nil, ruleLoadOptions{Nested: nested})
+	if err != nil {
+		t.Fatalf("load rule sets: %v", err)
+	}
+	pathFilter := filter.NewRuleSetFilter(ruleSets, filter.ModeBlacklist)
+	for path, include := range map[string]bool{
+		"debug.log":      false,
+		"pkg/trace.log":  false,
+		"keep.log":       true,
+		"secret.txt":     false,
+		"pkg/secret.txt": true,
+		"main.go":        true,
+	} {
+		if decision := pathFilter.Evaluate(path, false); decision.Include != include {
+			t.Fatalf("expected include=%v for %s", include, path)
+		}
+	}
+
+	// The root's own .gitignore, loaded during the walk, takes precedence.
+	matcher, err := gitignore.Parse(strings.NewReader("!debug.log\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	nested.Add("", matcher)
+	if decision := pathFilter.Evaluate("debug.log", false); !decision.Include {
+		t.Fatalf("expected the root's own rules to override the ones above it")
+	}
+}
+
+func TestBuildOptionsScopesRulesToRootLabels(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	defer func() {
+		if err := os.Chdir(cwd); err != nil {
+			t.Fatalf("restore cwd: %v", err)
+		}
+	}()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	for _, name := range []string{"api", "web"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "web.allow"), []byte("*.ts\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cfg := config{
+		MaxDepth: -1,
+		Roots:    []string{"api", "web"},
+		RuleSpecs: []ruleSpec{
+			{Mode: filter.ModeWhitelist, Path: "web=web.allow"},
+			{Mode: filter.ModeBlacklist, Pattern: "api=*_test.go"},
+			{Mode: filter.ModeBlacklist, Pattern: "*.tmp"},
+		},
+	}
+	opts, err := buildOptions(&cfg, "")
+	if err != nil {
+		t.Fatalf("build options: %v", err)
+	}
+
+	api, web := opts.Filters[0], opts.Filters[1]
+	if decision := api.Evaluate("main.go", false); !decision.Include {
+		t.Fatalf("expected the web whitelist not to apply to api")
+	}
+	if decision := api.Evaluate("main_test.go", false); decision.Include {
+		t.Fatalf("expected the api pattern to exclude main_test.go")
+	}
+	if decision := web.Evaluate("app.ts", false); !decision.Include {
+		t.Fatalf("expected the web whitelist to include app.ts")
+	}
+	if decision := web.Evaluate("main.go", false); decision.Include {
+		t.Fatalf("expected the web whitelist to exclude main.go")
+	}
+	if decision := web.Evaluate("cache.tmp", false); decision.Include {
+		t.Fatalf("expected unscoped patterns to apply to every root")
+	}
+	if opts.ModeLabel != "web:whitelist -> api:blacklist -> blacklist" {
+		t.Fatalf("unexpected mode label %q", opts.ModeLabel)
+	}
+
+	// Text before "=" that names no root is part of the file name or pattern.
+	cfg.RuleSpecs = []ruleSpec{
+		{Mode: filter.ModeBlacklist, Path: "wbe=web.allow"},
+		{Mode: filter.ModeBlacklist, Pattern: "key=value.txt"},
+	}
+	opts, err = buildOptions(&cfg, "")
+	if err != nil {
+		t.Fatalf("build options: %v", err)
+	}
+	if decision := opts.Filters[0].Evaluate("key=value.txt", false); decision.Include {
+		t.Fatalf("expected a pattern containing = to be kept whole")
+	}
+	if decision := opts.Filters[1].Evaluate("main.go", false); !decision.Include {
+		t.Fatalf("expected a missing rule file to load empty")
+	}
+}
+
+func TestApplyConfigFileLetsFlagsOverride(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "weaver.yaml")
+	content := "max-depth: 3\nskip-binary: true\nout: combined.txt\nrules:\n  - mode: blacklist\n    patterns:\n      - \"*.log\"\n"
+	if err := os.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var cfg config
+	flags := newFlagSet("weaver", &cfg)
+	if err := flags.Parse([]string{"-config", configPath, "-max-depth", "1", "-root", dir, "-whitelist-pattern", "*.md"}); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	if err := applyConfigFile(flags, &cfg); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+
+	if cfg.MaxDepth != 1 {
+		t.Fatalf("expected -max-depth to override the file, got %d", cfg.MaxDepth)
+	}
+	if !cfg.SkipBinary || cfg.Out != filepath.Join(dir, "combined.txt") {
+		t.Fatalf("expected file settings to apply, got %+v", cfg)
+	}
+	if len(cfg.RuleSpecs) != 2 || cfg.RuleSpecs[0].Pattern != "*.log" || cfg.RuleSpecs[1].Pattern != "*.md" {
+		t.Fatalf("expected file rules before flag rules, got %+v", cfg.RuleSpecs)
+	}
+
+	ruleSets, err := loadRuleSets(dir, cfg.RuleSpecs[:1], ruleLoadOptions{})
+	if err != nil {
+		t.Fatalf("load rule sets: %v", err)
+	}
+	rule, ok := ruleSets[0].Matcher.Match("debug.log", false)
+	if !ok || rule.String() != configPath+":7:*.log" {
+		t.Fatalf("expected the pattern to point at its config line, got %q", rule.String())
+	}
+}
+
+func TestRunExtractWritesFilesInsideTheDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	combined := filepath.Join(t.TempDir(), "combined.txt")
+	content := "# Weaver Combined File\n# Root: x\n\n" +
+		"--- BEGIN FILE: a.txt ---\nnew\n--- END FILE: a.txt ---\n\n" +
+		"--- BEGIN FILE: sub/b.txt ---\nb\n--- END FILE: sub/b.txt ---\n\n" +
+		"--- BEGIN FILE: logo.png ---\n[binary content omitted]\n--- END FILE: logo.png ---\n\n"
+	if err := os.WriteFile(combined, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var out strings.Builder
+	if err := runExtract([]string{"-dir", dir, "-diff", combined}, &out); err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	for _, want := range []string{"-old\n+new\n", "updated a.txt\n", "created sub/b.txt\n", "skipped logo.png (binary)\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in report:\n%s", want, out.String())
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt")); err != nil || string(data) != "b\n" {
+		t.Fatalf("expected sub/b.txt to be written, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "logo.png")); !os.IsNotExist(err) {
+		t.Fatalf("expected the omitted file to be left alone, got %v", err)
+	}
+}
+
+func TestRunExtractRoundTripsEachFormat(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"dos.txt":  "one\r\ntwo\r\n",
+		"logo.png": "\x89PNG\r\n\x1a\n\x00\xff",
+		"main.go":  "package main\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	for _, format := range []string{"text", "markdown", "xml", "json", "jsonl"} {
+		t.Run(format, func(t *testing.T) {
+			combined := filepath.Join(t.TempDir(), "combined")
+			if err := runCombine([]string{"-root", root, "-out", combined, "-format", format, "-file-metadata"}); err != nil {
+				t.Fatalf("combine: %v", err)
+			}
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "logo.png"), []byte(files["logo.png"]), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			var out strings.Builder
+			if err := runExtract([]string{"-dir", dir, combined}, &out); err != nil {
+				t.Fatalf("extract: %v", err)
+			}
+			for name, content := range files {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil || string(data) != content {
+					t.Fatalf("expected %s to round-trip, got %q, %v\n%s", name, data, err, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunExtractSkipsContentsThatDoNotMatchTheirHash(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("real\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	combined := filepath.Join(t.TempDir(), "combined.xml")
+	content := "<documents>\n" +
+		"<document index=\"1\" sha256=\"" + strings.Repeat("0", 64) + "\">\n<source>a.txt</source>\n<document_content>\nmangled\n</document_content>\n</document>\n" +
+		"<document index=\"2\" lossy=\"true\">\n<source>b.txt</source>\n<document_content>\nbell\ufffd\n</document_content>\n</document>\n" +
+		"</documents>\n"
+	if err := os.WriteFile(combined, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var out strings.Builder
+	if err := runExtract([]string{"-dir", dir, combined}, &out); err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	want := "skipped a.txt (content does not match its hash)\nskipped b.txt (lossy)\n"
+	if out.String() != want {
+		t.Fatalf("expected report %q, got %q", want, out.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(data) != "real\n" {
+		t.Fatalf("expected a.txt to be left alone, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected the lossy file to be left alone, got %v", err)
+	}
+}
+
+func TestExtractTargetRefusesPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	for _, display := range []string{"../evil.txt", "a/../../evil.txt", "/etc/passwd", "link/evil.txt", "", "."} {
+		if _, err := extractTarget(dir, display); err == nil {
+			t.Fatalf("expected %q to be refused", display)
+		}
+	}
+	target, err := extractTarget(dir, "a/./b.txt")
+	if err != nil || target != filepath.Join(dir, "a", "b.txt") {
+		t.Fatalf("unexpected target %q, %v", target, err)
+	}
+}
+
+func TestRunDiffComparesOutputWithRoot(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	write("a.txt", "one\ntwo\n")
+	write("b.txt", "gone\n")
+	write("logo.png", "\x00\x01")
+	snapshot := filepath.Join(root, "snapshot.txt")
+	content := "# Weaver Combined File\n# Root: x\n\n" +
+		"--- BEGIN FILE: a.txt ---\none\n2\n--- END FILE: a.txt ---\n\n" +
+		"--- BEGIN FILE: logo.png ---\n[binary content omitted]\n--- END FILE: logo.png ---\n\n" +
+		"--- BEGIN FILE: old.txt ---\nold\n--- END FILE: old.txt ---\n\n"
+	if err := os.WriteFile(snapshot, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var out strings.Builder
+	if err := runDiff([]string{"-skip-binary", snapshot, root}, &out); err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	want := "--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-2\n+two\n" +
+		"not compared logo.png (binary)\n" +
+		"added b.txt\n" +
+		"removed old.txt\n"
+	if out.String() != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestSourceDateEpochFixesTheClock(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	epoch, ok, err := sourceDateEpoch()
+	if err != nil || !ok || !epoch.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected epoch %v, %v, %v", epoch, ok, err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, _, err := sourceDateEpoch(); err == nil {
+		t.Fatalf("expected a malformed SOURCE_DATE_EPOCH to fail")
+	}
+}
+
+func TestRunCombineLeavesOutputAloneOnInvalidOptions(t *testing.T) {
+	root := t.TempDir()
+	out := filepath.Join(t.TempDir(), "combined.txt")
+	if err := os.WriteFile(out, []byte("previous run\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := runCombine([]string{"-root", root, "-out", out, "-max-depth", "-2"}); err == nil {
+		t.Fatalf("expected an invalid max-depth to fail")
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if err := runCombine([]string{"-root", root, "-out", out}); err == nil {
+		t.Fatalf("expected a malformed SOURCE_DATE_EPOCH to fail")
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(data) != "previous run\n" {
+		t.Fatalf("expected the output file to be left alone, got %q", data)
+	}
+}
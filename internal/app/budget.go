@@ -0,0 +1,686 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/bytesize"
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+// BudgetPolicy decides how Combine fits the selected files into Options.MaxBytes
+// and Options.MaxLines.
+type BudgetPolicy int
+
+const (
+	// BudgetDrop leaves out the lowest-priority files until the output fits.
+	BudgetDrop BudgetPolicy = iota
+	// BudgetTruncate keeps every file but cuts the largest ones down to their
+	// first and last lines, all to the same allowance. Files are dropped, in
+	// BudgetDrop's order, only when even their truncation markers and header
+	// lines do not fit.
+	BudgetTruncate
+)
+
+func (p BudgetPolicy) String() string {
+	switch p {
+	case BudgetDrop:
+		return "drop"
+	case BudgetTruncate:
+		return "truncate"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseBudgetPolicy reads a policy name as printed by String.
+func ParseBudgetPolicy(value string) (BudgetPolicy, error) {
+	switch value {
+	case "drop":
+		return BudgetDrop, nil
+	case "truncate":
+		return BudgetTruncate, nil
+	}
+	return 0, fmt.Errorf("budget policy must be \"drop\" or \"truncate\", got %q", value)
+}
+
+// budgetReport lists the files Combine changed to fit the budget.
+type budgetReport struct {
+	dropped   []string
+	truncated []truncation
+	// tokens is the token count of the whole output, when counting.
+	tokens int64
+}
+
+type truncation struct {
+	display    string
+	keptLines  int
+	totalLines int
+	// The kept lines end at headEnd and resume at tailStart, offsets into
+	// the file.
+	headEnd   int64
+	tailStart int64
+}
+
+// fields returns the header fields for the token count and the budget.
+func (r budgetReport) fields(opts Options) []headerField {
+	var fields []headerField
+	if opts.Tokens != nil {
+		fields = append(fields, headerField{key: "tokens", label: "Tokens", value: fmt.Sprintf("%d (%s)", r.tokens, opts.Tokens.Name())})
+	}
+	if opts.MaxBytes <= 0 && opts.MaxLines <= 0 && opts.MaxTokens <= 0 {
+		return fields
+	}
+	limits := make([]string, 0, 3)
+	if opts.MaxBytes > 0 {
+		limits = append(limits, bytesize.Format(opts.MaxBytes))
+	}
+	if opts.MaxLines > 0 {
+		limits = append(limits, fmt.Sprintf("%d lines", opts.MaxLines))
+	}
+	if opts.MaxTokens > 0 {
+		limits = append(limits, fmt.Sprintf("%d tokens", opts.MaxTokens))
+	}
+	fields = append(fields, headerField{key: "budget", label: "Budget", value: fmt.Sprintf("%s (%s)", strings.Join(limits, ", "), opts.BudgetPolicy)})
+	if len(r.dropped) > 0 {
+		fields = append(fields, headerField{key: "dropped", label: "Dropped to fit the budget", value: fmt.Sprint(len(r.dropped)), itemKey: "file", items: r.dropped})
+	}
+	if len(r.truncated) > 0 {
+		items := make([]string, len(r.truncated))
+		for i, t := range r.truncated {
+			items[i] = fmt.Sprintf("%s (kept %d of %d lines)", t.display, t.keptLines, t.totalLines)
+		}
+		fields = append(fields, headerField{key: "truncated", label: "Truncated to fit the budget", value: fmt.Sprint(len(r.truncated)), itemKey: "file", items: items})
+	}
+	return fields
+}
+
+// budget is an amount of output in bytes, lines and tokens.
+type budget struct {
+	bytes  int64
+	lines  int64
+	tokens int64
+}
+
+var unlimited = budget{bytes: math.MaxInt64, lines: math.MaxInt64, tokens: math.MaxInt64}
+
+func (b budget) fits(limit budget) bool {
+	return b.bytes <= limit.bytes && b.lines <= limit.lines && b.tokens <= limit.tokens
+}
+
+func (b budget) add(other budget) budget {
+	return budget{bytes: b.bytes + other.bytes, lines: b.lines + other.lines, tokens: b.tokens + other.tokens}
+}
+
+func (b budget) sub(other budget) budget {
+	return budget{bytes: b.bytes - other.bytes, lines: b.lines - other.lines, tokens: b.tokens - other.tokens}
+}
+
+func budgetLimit(opts Options) budget {
+	limit := unlimited
+	if opts.MaxBytes > 0 {
+		limit.bytes = opts.MaxBytes
+	}
+	if opts.MaxLines > 0 {
+		limit.lines = opts.MaxLines
+	}
+	if opts.MaxTokens > 0 {
+		limit.tokens = opts.MaxTokens
+	}
+	return limit
+}
+
+// fitBudget measures every entry and counts its tokens when there is a
+// counter, streaming the files on up to Options.Jobs goroutines, then returns
+// the entries to write, with the cuts the policy made. The header and trees
+// count against the budget too, and since they list what was dropped or
+// truncated, planning repeats with the space they leave until everything fits.
+func (c Combiner) fitBudget(ctx context.Context, entries []fileEntry, opts Options, skipped int) ([]fileEntry, budgetReport, error) {
+	limit := budgetLimit(opts)
+	var lineCounter tokenizer.Counter
+	if opts.MaxTokens > 0 && opts.BudgetPolicy == BudgetTruncate {
+		lineCounter = opts.Tokens
+	}
+	measured := make([]budgetEntry, len(entries))
+	err := forEachEntry(ctx, jobCount(opts), len(entries), func(i int, buf []byte) error {
+		if err := c.measureEntry(&entries[i], opts, buf); err != nil {
+			return err
+		}
+		var profile *lineProfile
+		if opts.BudgetPolicy == BudgetTruncate {
+			profile = c.newLineProfile(entries[i], opts, limit, lineCounter)
+		}
+		entry, err := newBudgetEntry(entries[i], opts, profile)
+		measured[i] = entry
+		return err
+	})
+	if err != nil {
+		return nil, budgetReport{}, err
+	}
+
+	remaining := limit
+	maxFiles := len(measured)
+	if opts.BudgetPolicy == BudgetTruncate {
+		// A body larger than the whole budget is cut whenever the files do
+		// not fit, so its lines are profiled up front, in parallel; planning
+		// profiles others as it comes to cut them.
+		err := forEachEntry(ctx, jobCount(opts), len(measured), func(i int, _ []byte) error {
+			if profile := measured[i].profile; profile != nil && !measured[i].bodyCost.fits(limit) {
+				return profile.load().err
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, budgetReport{}, err
+		}
+		if maxFiles, err = c.truncatedFileCount(measured, limit, opts, skipped); err != nil {
+			return nil, budgetReport{}, err
+		}
+	}
+	for {
+		kept, report := planBudget(measured, remaining, maxFiles, opts)
+		for _, entry := range measured {
+			if entry.profile != nil && entry.profile.err != nil {
+				return nil, budgetReport{}, entry.profile.err
+			}
+		}
+		if err := c.measureCuts(ctx, kept, opts); err != nil {
+			return nil, budgetReport{}, err
+		}
+		var planned, sections budget
+		files := make([]fileEntry, len(kept))
+		for i, entry := range kept {
+			planned = planned.add(entry.cost)
+			files[i] = entry.fileEntry
+			files[i].index = i + 1
+			// Markers can depend on the position, which planning may have
+			// changed, so the sections are measured again.
+			cost, err := sectionCost(opts, files[i])
+			if err != nil {
+				return nil, budgetReport{}, err
+			}
+			sections = sections.add(cost)
+		}
+		preamble, err := c.measurePreamble(opts, files, skipped, &report, sections.tokens)
+		if err != nil {
+			return nil, budgetReport{}, err
+		}
+		if used := preamble.add(sections); used.fits(limit) {
+			return files, report, nil
+		}
+		if len(kept) == 0 {
+			return nil, budgetReport{}, fmt.Errorf("output budget is too small for the header: it needs %s, %d lines and %d tokens", bytesize.Format(preamble.bytes), preamble.lines, preamble.tokens)
+		}
+		// The files fit the space planned for them, so the preamble grew past
+		// what it left; plan again with less, and less than planned wherever
+		// the files overran it.
+		left := limit.sub(preamble)
+		remaining = budget{
+			bytes:  tighten(remaining.bytes, left.bytes, planned.bytes, sections.bytes),
+			lines:  tighten(remaining.lines, left.lines, planned.lines, sections.lines),
+			tokens: tighten(remaining.tokens, left.tokens, planned.tokens, sections.tokens),
+		}
+	}
+}
+
+// measureCuts streams the bodies planning cut, on up to Options.Jobs
+// goroutines, to replace the costs it estimated from their lines with exact
+// ones. A body cut down to its marker was measured when it was cut.
+func (c Combiner) measureCuts(ctx context.Context, kept []budgetEntry, opts Options) error {
+	return forEachEntry(ctx, jobCount(opts), len(kept), func(i int, buf []byte) error {
+		entry := &kept[i]
+		if entry.truncated == nil || entry.truncated.keptLines == 0 {
+			return nil
+		}
+		if err := c.measureBody(&entry.fileEntry, opts, buf); err != nil {
+			return err
+		}
+		cost, err := sectionCost(opts, entry.fileEntry)
+		entry.cost = cost
+		return err
+	})
+}
+
+// tighten returns the space to plan with next in one dimension. used is what
+// the files planned at planned took; when it exceeds left, the next plan must
+// be smaller than planned, or it would come out the same.
+func tighten(remaining, left, planned, used int64) int64 {
+	if used > left {
+		return min(remaining, planned-(used-left))
+	}
+	return min(remaining, left)
+}
+
+// measurePreamble renders the header, the trees and the footer to measure them. The header
+// reports the total token count, which includes its own tokens, so the total
+// is recomputed until it no longer changes.
+func (c Combiner) measurePreamble(opts Options, entries []fileEntry, skipped int, report *budgetReport, sectionTokens int64) (budget, error) {
+	var preamble budget
+	for attempt := 0; attempt < 4; attempt++ {
+		report.tokens = sectionTokens + preamble.tokens
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		if err := c.writePreamble(writer, opts, entries, skipped, *report); err != nil {
+			return budget{}, err
+		}
+		if err := writeFooter(writer, opts.Format); err != nil {
+			return budget{}, err
+		}
+		if err := writer.Flush(); err != nil {
+			return budget{}, err
+		}
+		measured := budget{bytes: int64(buf.Len()), lines: int64(bytes.Count(buf.Bytes(), []byte{'\n'}))}
+		if opts.Tokens != nil {
+			measured.tokens = int64(opts.Tokens.Count(buf.Bytes()))
+		}
+		if measured == preamble {
+			break
+		}
+		preamble = measured
+	}
+	return preamble, nil
+}
+
+// budgetEntry is a measured entry with its cost and, for truncation, what it
+// takes to cut its body.
+type budgetEntry struct {
+	fileEntry
+	depth int
+	// cost is the whole section; markers and bodyCost are its parts.
+	cost    budget
+	markers budget
+	// totalLines counts the lines of a body truncation may cut, and profile
+	// describes the ones a cut may keep.
+	totalLines int
+	profile    *lineProfile
+	// marker is the cost of the widest truncation marker the body could need.
+	marker budget
+}
+
+// newBudgetEntry prices a measured entry. profile is read when truncation
+// comes to cut its body.
+func newBudgetEntry(entry fileEntry, opts Options, profile *lineProfile) (budgetEntry, error) {
+	e := budgetEntry{fileEntry: entry, depth: strings.Count(entry.display, "/")}
+	cost, err := sectionCost(opts, entry)
+	if err != nil {
+		return e, err
+	}
+	e.cost = cost
+	e.markers = cost.sub(entry.bodyCost)
+	if opts.SkipContents || entry.placeholder || (opts.Format.structured() && base64Content(entry)) {
+		return e, nil
+	}
+	// In the structured formats the body is one JSON string, whose line
+	// breaks are escaped.
+	e.totalLines = int(entry.bodyCost.lines)
+	if opts.Format.structured() {
+		e.totalLines = entry.lines
+	}
+	if e.totalLines == 0 {
+		return e, nil
+	}
+	e.profile = profile
+
+	counter := opts.Tokens
+	marker := omittedMarker(e.totalLines, e.totalLines)
+	e.marker = budget{bytes: int64(len(marker)), lines: 1}
+	if counter != nil {
+		e.marker.tokens = int64(counter.Count([]byte(marker)))
+	}
+	if opts.Format.structured() {
+		// A truncated record also notes the lines it kept.
+		noted := entry
+		noted.truncated = &truncation{keptLines: e.totalLines, totalLines: e.totalLines}
+		notedCost, err := sectionCost(opts, noted)
+		if err != nil {
+			return e, err
+		}
+		e.marker = budget{bytes: escapedLen([]byte(marker))}.add(notedCost.sub(cost))
+		if counter != nil {
+			e.marker.tokens += escapedTokens(counter, []byte(marker))
+		}
+	}
+	return e, nil
+}
+
+// sectionCost measures the entry's section as it would be written: the
+// markers, or the rest of the record in the structured formats, and the body
+// as measured when it was read. Without the contents, only the structured
+// formats write a section.
+func sectionCost(opts Options, entry fileEntry) (budget, error) {
+	if opts.SkipContents && !opts.Format.structured() {
+		return budget{}, nil
+	}
+	measure := func(text []byte) budget {
+		cost := budget{bytes: int64(len(text)), lines: int64(bytes.Count(text, []byte{'\n'}))}
+		if opts.Tokens != nil {
+			cost.tokens = int64(opts.Tokens.Count(text))
+		}
+		return cost
+	}
+	if opts.Format.structured() {
+		record, err := jsonSection(opts, entry, !opts.SkipContents)
+		if err != nil {
+			return budget{}, fmt.Errorf("encode %s: %w", entry.display, err)
+		}
+		if opts.SkipContents || entry.placeholder {
+			return measure(record), nil
+		}
+		before, after, err := splitRecord(record)
+		if err != nil {
+			return budget{}, fmt.Errorf("encode %s: %w", entry.display, err)
+		}
+		return measure(before).add(measure(after)).add(entry.bodyCost), nil
+	}
+	begin, end := sectionMarkers(opts, entry)
+	return measure([]byte(begin + end)).add(entry.bodyCost), nil
+}
+
+// escapedLen returns the length of text encoded in a JSON string, without
+// the quotes.
+func escapedLen(text []byte) int64 {
+	payload, err := marshalJSON(string(text), "")
+	if err != nil {
+		return int64(len(text))
+	}
+	return int64(len(payload) - 2)
+}
+
+// escapedTokens counts the tokens of text encoded in a JSON string, without
+// the quotes.
+func escapedTokens(counter tokenizer.Counter, text []byte) int64 {
+	payload, err := marshalJSON(string(text), "")
+	if err != nil {
+		return int64(counter.Count(text))
+	}
+	return int64(counter.Count(payload[1 : len(payload)-1]))
+}
+
+// planBudget chooses the entries to write within limit. Truncation keeps at
+// most maxFiles of them.
+func planBudget(entries []budgetEntry, limit budget, maxFiles int, opts Options) ([]budgetEntry, budgetReport) {
+	if opts.BudgetPolicy == BudgetTruncate {
+		return planTruncate(entries, limit, maxFiles, opts)
+	}
+	return planDrop(entries, limit)
+}
+
+// planDrop keeps files in priority order while they fit: shallower paths
+// first, then smaller files, then by path. A file that does not fit is dropped,
+// but smaller files after it may still be kept.
+func planDrop(entries []budgetEntry, limit budget) ([]budgetEntry, budgetReport) {
+	keep := keepByPriority(entries, limit, len(entries))
+	kept := make([]budgetEntry, 0, len(entries))
+	var report budgetReport
+	for i, entry := range entries {
+		if keep[i] {
+			kept = append(kept, entry)
+		} else {
+			report.dropped = append(report.dropped, entry.display)
+		}
+	}
+	return kept, report
+}
+
+// keepByPriority reports which entries planDrop keeps within limit, stopping
+// at maxFiles.
+func keepByPriority(entries []budgetEntry, limit budget, maxFiles int) []bool {
+	order := make([]int, len(entries))
+	for i := range entries {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		x, y := entries[order[a]], entries[order[b]]
+		if x.depth != y.depth {
+			return x.depth < y.depth
+		}
+		if x.cost.bytes != y.cost.bytes {
+			return x.cost.bytes < y.cost.bytes
+		}
+		return x.display < y.display
+	})
+
+	keep := make([]bool, len(entries))
+	var used budget
+	kept := 0
+	for _, i := range order {
+		if kept == maxFiles {
+			break
+		}
+		if next := used.add(entries[i].cost); next.fits(limit) {
+			used = next
+			keep[i] = true
+			kept++
+		}
+	}
+	return keep
+}
+
+// chooseTruncated reports which entries planTruncate keeps: by priority, as
+// planDrop does, but with each file at its smallest, cut down to its markers.
+// It keeps at least as many as planDrop would, up to maxFiles.
+func chooseTruncated(entries []budgetEntry, limit budget, maxFiles int) []bool {
+	smallest := make([]budgetEntry, len(entries))
+	for i, entry := range entries {
+		smallest[i] = entry
+		_, _, smallest[i].cost = entry.cut(budget{})
+	}
+	keep := keepByPriority(smallest, limit, maxFiles)
+	if whole := keepByPriority(entries, limit, maxFiles); countKept(whole) > countKept(keep) {
+		return whole
+	}
+	return keep
+}
+
+func countKept(keep []bool) int {
+	n := 0
+	for _, k := range keep {
+		if k {
+			n++
+		}
+	}
+	return n
+}
+
+// truncatedFileCount returns how many files truncation can keep once the
+// header and trees, which list every file, take their share of the budget:
+// the largest count whose files fit with the preamble when cut down to their
+// markers.
+func (c Combiner) truncatedFileCount(entries []budgetEntry, limit budget, opts Options, skipped int) (int, error) {
+	var failure error
+	fits := func(n int64) bool {
+		if failure != nil {
+			return false
+		}
+		keep := chooseTruncated(entries, limit, int(n))
+		var report budgetReport
+		var sections budget
+		files := make([]fileEntry, 0, n)
+		for i, entry := range entries {
+			if !keep[i] {
+				report.dropped = append(report.dropped, entry.display)
+				continue
+			}
+			smallest, cut := entry.truncate(budget{}, opts)
+			if cut != nil {
+				report.truncated = append(report.truncated, *cut)
+			}
+			smallest.index = len(files) + 1
+			files = append(files, smallest.fileEntry)
+			sections = sections.add(smallest.cost)
+		}
+		preamble, err := c.measurePreamble(opts, files, skipped, &report, sections.tokens)
+		if err != nil {
+			failure = err
+			return false
+		}
+		return preamble.add(sections).fits(limit)
+	}
+	all := int64(len(entries))
+	if fits(all) {
+		return len(entries), nil
+	}
+	n := largestFitting(all, fits)
+	return int(n), failure
+}
+
+// planTruncate first chooses the files to keep with chooseTruncated, so
+// truncating keeps at least the files dropping would. It then finds the
+// largest per-file allowance, in bytes, then lines, then tokens, at which the
+// kept files fit once truncated.
+func planTruncate(entries []budgetEntry, limit budget, maxFiles int, opts Options) ([]budgetEntry, budgetReport) {
+	keep := chooseTruncated(entries, limit, maxFiles)
+	var report budgetReport
+	chosen := make([]budgetEntry, 0, len(entries))
+	for i, entry := range entries {
+		if keep[i] {
+			chosen = append(chosen, entry)
+		} else {
+			report.dropped = append(report.dropped, entry.display)
+		}
+	}
+
+	total := func(allowance budget) budget {
+		var used budget
+		for _, entry := range chosen {
+			_, _, cost := entry.cut(allowance)
+			used = used.add(cost)
+		}
+		return used
+	}
+	allowance := unlimited
+	if !total(allowance).fits(limit) {
+		// No body is kept larger than the whole budget, which also bounds
+		// the lines the profiles describe.
+		var largest budget
+		for _, entry := range chosen {
+			largest.bytes = max(largest.bytes, min(entry.bodyCost.bytes, limit.bytes))
+			largest.lines = max(largest.lines, min(entry.bodyCost.lines, limit.lines))
+			largest.tokens = max(largest.tokens, min(entry.bodyCost.tokens, limit.tokens))
+		}
+		allowance.bytes = largestFitting(largest.bytes, func(n int64) bool {
+			return total(budget{bytes: n, lines: limit.lines, tokens: limit.tokens}).bytes <= limit.bytes
+		})
+		// The bodies of the structured formats take no lines of their own.
+		allowance.lines = limit.lines
+		if largest.lines > 0 {
+			allowance.lines = largestFitting(largest.lines, func(n int64) bool {
+				return total(budget{bytes: allowance.bytes, lines: n, tokens: limit.tokens}).lines <= limit.lines
+			})
+		}
+		allowance.tokens = limit.tokens
+		if limit.tokens != unlimited.tokens {
+			allowance.tokens = largestFitting(largest.tokens, func(n int64) bool {
+				return total(budget{bytes: allowance.bytes, lines: allowance.lines, tokens: n}).tokens <= limit.tokens
+			})
+		}
+	}
+
+	kept := make([]budgetEntry, len(chosen))
+	for i, entry := range chosen {
+		var cut *truncation
+		kept[i], cut = entry.truncate(allowance, opts)
+		if cut != nil {
+			report.truncated = append(report.truncated, *cut)
+		}
+	}
+	return kept, report
+}
+
+// truncate returns the entry cut down to the allowance, and the truncation,
+// or nil when the body stays whole. A body cut down to its marker is measured
+// here; the cost of one that keeps lines is estimated from them until
+// measureCuts streams it.
+func (e budgetEntry) truncate(allowance budget, opts Options) (budgetEntry, *truncation) {
+	head, tail, cost := e.cut(allowance)
+	if head+tail == e.totalLines {
+		return e, nil
+	}
+	cut := &truncation{display: e.display, keptLines: head + tail, totalLines: e.totalLines, tailStart: e.size}
+	if head > 0 {
+		cut.headEnd = e.profile.head[head-1].end
+	}
+	if tail > 0 {
+		cut.tailStart = e.profile.tail[len(e.profile.tail)-tail].start
+	}
+	e.fileEntry.truncated = cut
+	e.cost = cost
+	if head+tail == 0 {
+		e.bodyCost, e.tokens = measureText(opts, []byte(omittedMarker(e.totalLines, e.totalLines)))
+		// An encoding error surfaces when fitBudget measures the section
+		// again.
+		if exact, err := sectionCost(opts, e.fileEntry); err == nil {
+			e.cost = exact
+		}
+	}
+	return e, cut
+}
+
+// largestFitting returns the largest n in [0, upper] for which fits holds,
+// assuming fits holds for every n below one that it holds for. It returns 0
+// if nothing fits.
+func largestFitting(upper int64, fits func(int64) bool) int64 {
+	low, high := int64(0), upper
+	for low < high {
+		mid := low + (high-low+1)/2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+// cut chooses the lines to keep so the body fits the allowance, alternately
+// from the start and the end, leaving room for a marker in between. It returns
+// the number of head and tail lines and the section's cost; keeping every line
+// means the body stays whole.
+func (e budgetEntry) cut(allowance budget) (int, int, budget) {
+	total := e.totalLines
+	if e.bodyCost.fits(allowance) || total == 0 {
+		return total, 0, e.cost
+	}
+	room := allowance.sub(e.marker)
+	head, tail := 0, 0
+	var used budget
+	// When the marker alone overruns the allowance no line fits, and the
+	// file is not read for them.
+	if (budget{}).fits(room) {
+		profile := e.profile.load()
+		for head+tail < total {
+			line, ok := profile.next(head, tail)
+			if !ok {
+				break
+			}
+			next := used.add(line.cost)
+			if !next.fits(room) {
+				break
+			}
+			used = next
+			if head <= tail {
+				head++
+			} else {
+				tail++
+			}
+		}
+	}
+	body := used.add(e.marker)
+	// A short file can be smaller than its marker; cutting it would not help.
+	helps := (e.bodyCost.bytes > allowance.bytes && body.bytes < e.bodyCost.bytes) ||
+		(e.bodyCost.lines > allowance.lines && body.lines < e.bodyCost.lines) ||
+		(e.bodyCost.tokens > allowance.tokens && body.tokens < e.bodyCost.tokens)
+	if head+tail == total || !helps {
+		return total, 0, e.cost
+	}
+	return head, tail, e.markers.add(body)
+}
+
+func omittedMarker(omitted, total int) string {
+	return fmt.Sprintf("[... %d of %d lines omitted to fit the output budget ...]\n", omitted, total)
+}
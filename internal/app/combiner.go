@@ -2,25 +2,38 @@ package app
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"path"
 	"path/filepath"
 	"sort"
-	"strings"
 	"time"
 
+	"github.com/aatuh/weaver/internal/bytesize"
 	"github.com/aatuh/weaver/internal/filter"
+	"github.com/aatuh/weaver/internal/gitignore"
+	"github.com/aatuh/weaver/internal/tokenizer"
 	"github.com/aatuh/weaver/internal/tree"
 )
 
-// FileSystem provides file walking and reading.
+// FileSystem provides directory listing and file reading. ReadDir returns
+// entries sorted by name, as os.ReadDir does. Combine streams file contents
+// through Open; ReadFile serves small files and budgeted runs, which hold
+// contents in memory. Stat follows symbolic links. With Options.Jobs above
+// one, directories are listed and files read from several goroutines at once.
 type FileSystem interface {
-	WalkDir(root string, fn fs.WalkDirFunc) error
+	ReadDir(path string) ([]fs.DirEntry, error)
 	ReadFile(path string) ([]byte, error)
+	Open(path string) (fs.File, error)
+	Stat(path string) (fs.FileInfo, error)
 }
 
 // Options configure the combine operation.
@@ -28,19 +41,63 @@ type Options struct {
 	Roots              []string
 	RootLabels         []string
 	Filters            []filter.PathFilter
+	NestedRules        []*filter.NestedRules
 	IncludeTree        bool
 	IncludeTreeCompact bool
 	MaxDepth           int
 	SkipContents       bool
 	SkipBinary         bool
-	Output             io.Writer
-	ModeLabel          string
+	// MaxFileSize, when positive, is the largest file in bytes whose contents are
+	// written. Larger files get a placeholder showing their size, or are left out
+	// entirely when SkipOversize is set. Sizes come from the walk, so oversized
+	// files are never read.
+	MaxFileSize  int64
+	SkipOversize bool
+	// FileMetadata adds each file's size, line count, SHA-256, modification
+	// time, mode and language to its marker, or to its record in the
+	// structured formats.
+	FileMetadata bool
+	// MaxBytes and MaxLines, when positive, bound the whole output. BudgetPolicy
+	// decides how files are dropped or truncated to fit, and the header lists them.
+	MaxBytes     int64
+	MaxLines     int64
+	BudgetPolicy BudgetPolicy
+	// Tokens, when set, counts tokens for the header and tree. MaxTokens bounds
+	// the output like MaxBytes and needs Tokens.
+	Tokens    tokenizer.Counter
+	MaxTokens int64
+	// Format selects the layout of the output.
+	Format Format
+	Output io.Writer
+	// Profile names the config profile the options came from, if any.
+	Profile   string
+	ModeLabel string
+	// NoTimestamp leaves the generation time out of the header.
+	NoTimestamp bool
+	// Reproducible makes the output depend only on the files and options: the
+	// header names each root by its label rather than its absolute path, and a
+	// boundary, when one is needed, is derived from the content digest rather
+	// than drawn from Combiner.Random.
+	Reproducible bool
+
+	// Jobs bounds how many directories are walked and files read and
+	// prepared at once. Values below two do one at a time. The output does
+	// not depend on it.
+	Jobs int
+
+	// boundary, when set, sets the text format's file markers apart from
+	// lines in the files that look like them. Combine chooses it.
+	boundary string
 }
 
 // Combiner orchestrates collecting and writing combined files.
 type Combiner struct {
 	FS    FileSystem
 	Clock func() time.Time
+	// Random supplies the boundary used when a file contains a line that
+	// looks like a file marker, unless the output is reproducible. It
+	// defaults to crypto/rand.
+	Random io.Reader
 }
 
 // Combine generates a combined file from the root directory.
@@ -54,69 +111,215 @@ func (c Combiner) Combine(ctx context.Context, opts Options) error {
 	if len(opts.RootLabels) != len(opts.Roots) {
 		return fmt.Errorf("root labels are required")
 	}
+	if len(opts.NestedRules) != 0 && len(opts.NestedRules) != len(opts.Roots) {
+		return fmt.Errorf("nested rules must match roots")
+	}
 	if opts.Output == nil {
 		return fmt.Errorf("output writer is required")
 	}
 	if c.FS == nil {
 		return fmt.Errorf("filesystem adapter is required")
 	}
+	if opts.MaxTokens > 0 && opts.Tokens == nil {
+		return fmt.Errorf("token budget needs a token counter")
+	}
 	if c.Clock == nil {
 		c.Clock = time.Now
 	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	type fileEntry struct {
-		root    string
-		rel     string
-		display string
+	collected, err := c.collectFiles(ctx, opts)
+	if err != nil {
+		return err
 	}
 	entries := make([]fileEntry, 0)
+	skipped := 0
 	for i, root := range opts.Roots {
-		files, err := c.collectFiles(ctx, root, opts.Filters[i], opts.MaxDepth)
-		if err != nil {
-			return err
-		}
 		label := opts.RootLabels[i]
-		for _, rel := range files {
-			display := rel
+		for _, file := range collected[i] {
+			if file.oversized && opts.SkipOversize {
+				skipped++
+				continue
+			}
+			display := file.rel
 			if len(opts.Roots) > 1 {
-				display = path.Join(label, rel)
+				display = path.Join(label, file.rel)
 			}
-			entries = append(entries, fileEntry{root: root, rel: rel, display: display})
+			entries = append(entries, fileEntry{root: root, label: label, display: display, collectedFile: file})
 		}
 	}
 	sort.Slice(entries, func(i, j int) bool {
 		return entries[i].display < entries[j].display
 	})
+	for i := range entries {
+		entries[i].index = i + 1
+	}
 
-	writer := bufio.NewWriter(opts.Output)
+	budgeting := opts.MaxBytes > 0 || opts.MaxLines > 0 || opts.MaxTokens > 0 || opts.Tokens != nil
+	if !opts.SkipContents {
+		boundary, err := c.scanContents(ctx, entries, opts)
+		if err != nil {
+			return err
+		}
+		opts.boundary = boundary
+	}
+
+	var report budgetReport
+	if budgeting {
+		var err error
+		if entries, report, err = c.fitBudget(ctx, entries, opts, skipped); err != nil {
+			return err
+		}
+	}
 
-	if err := c.writeHeader(writer, opts, len(entries)); err != nil {
+	writer := bufio.NewWriter(opts.Output)
+	if err := c.writePreamble(writer, opts, entries, skipped, report); err != nil {
+		return err
+	}
+	// The structured formats list every file, with or without its contents.
+	if !opts.SkipContents || opts.Format.structured() {
+		if err := c.writeSections(ctx, writer, opts, entries); err != nil {
+			return err
+		}
+	}
+	if err := writeFooter(writer, opts.Format); err != nil {
 		return err
 	}
+	return writer.Flush()
+}
 
-	if opts.IncludeTree || opts.IncludeTreeCompact {
-		rootName := "roots"
-		if len(opts.Roots) == 1 {
-			rootName = opts.RootLabels[0]
+// scanContents reads every entry before the header is written, to hash it
+// for the content digest, to learn what its markers need and, in the text
+// format, to look for lines that could be mistaken for markers. It returns
+// the boundary the markers then need, or "" when no file has such a line.
+// Files are read through a fixed buffer and read again when written, and only
+// placeholders are held. Files are read on up to Options.Jobs goroutines.
+func (c Combiner) scanContents(ctx context.Context, entries []fileEntry, opts Options) (string, error) {
+	err := forEachEntry(ctx, jobCount(opts), len(entries), func(i int, buf []byte) error {
+		entry := &entries[i]
+		if !entry.oversized {
+			if err := c.scanFile(entry, buf); err != nil {
+				return err
+			}
 		}
-		paths := make([]string, len(entries))
-		for i, entry := range entries {
-			paths[i] = entry.display
+		entry.body, entry.placeholder = placeholderBody(opts, *entry)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	collision := false
+	for _, entry := range entries {
+		if opts.Format == FormatText && !entry.placeholder && entry.markerLine {
+			collision = true
+		}
+	}
+	if !collision {
+		return "", nil
+	}
+	token := make([]byte, 12)
+	if opts.Reproducible {
+		// A file cannot contain a token derived from its own hash.
+		sum := sha256.Sum256([]byte("boundary\n" + contentDigest(entries)))
+		copy(token, sum[:])
+		return hex.EncodeToString(token), nil
+	}
+	random := c.Random
+	if random == nil {
+		random = rand.Reader
+	}
+	if _, err := io.ReadFull(random, token); err != nil {
+		return "", fmt.Errorf("choose boundary: %w", err)
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// contentDigest fingerprints the entries' contents: the SHA-256 of a manifest
+// with a line "<sha256>  <path>" per file in output order, as sha256sum
+// prints it. A file too large to read is listed as "oversized:<size>"
+// instead of its hash.
+func contentDigest(entries []fileEntry) string {
+	manifest := sha256.New()
+	for _, entry := range entries {
+		sum := entry.sum
+		if entry.oversized {
+			sum = fmt.Sprintf("oversized:%d", entry.size)
 		}
-		treeNode := tree.Build(rootName, paths)
+		fmt.Fprintf(manifest, "%s  %s\n", sum, entry.display)
+	}
+	return "sha256:" + hex.EncodeToString(manifest.Sum(nil))
+}
+
+// fileEntry is a collected file with its display path and its 1-based
+// position in the output. The contents are streamed from the file when
+// written; body holds a placeholder, marked by placeholder, that is written
+// between the markers in their place.
+type fileEntry struct {
+	root        string
+	label       string
+	display     string
+	index       int
+	body        []byte
+	placeholder bool
+	// tokens counts the body's tokens, when Options.Tokens is set.
+	tokens int64
+	// bodyCost is what the body adds to the output, once measured for the
+	// budget.
+	bodyCost budget
+	// truncated is set when the budget cut the body.
+	truncated *truncation
+	collectedFile
+	// contentInfo is known once the contents were read.
+	contentInfo
+}
+
+// placeholderBody returns the body that stands in for the contents of a file
+// over the size limit, or of a binary file with SkipBinary set. The structured
+// formats leave the contents out instead, with an empty body.
+func placeholderBody(opts Options, entry fileEntry) ([]byte, bool) {
+	skipBinary := opts.SkipBinary && entry.binary
+	switch {
+	case opts.Format.structured() && (entry.oversized || skipBinary):
+		return []byte{}, true
+	case entry.oversized:
+		return []byte(fmt.Sprintf("[content omitted: %s exceeds the %s limit]\n", bytesize.Format(entry.size), bytesize.Format(opts.MaxFileSize))), true
+	case skipBinary:
+		return []byte("[binary content omitted]\n"), true
+	}
+	return nil, false
+}
+
+// writePreamble writes the header and the optional file trees. The
+// structured formats always include the tree.
+func (c Combiner) writePreamble(writer *bufio.Writer, opts Options, entries []fileEntry, skipped int, report budgetReport) error {
+	timestamp := ""
+	if !opts.NoTimestamp {
+		timestamp = c.Clock().UTC().Format(time.RFC3339)
+	}
+	// Without contents there is nothing to fingerprint.
+	digest := ""
+	if !opts.SkipContents {
+		digest = contentDigest(entries)
+	}
+	if opts.Format.structured() {
+		treeNode := buildTree(opts, entries)
+		return writeJSONPreamble(writer, opts.Format, newJSONHeader(opts, len(entries), skipped, report, digest, timestamp, treeNode))
+	}
+	if err := writeHeader(writer, opts, len(entries), skipped, report, digest, timestamp); err != nil {
+		return err
+	}
+
+	if opts.IncludeTree || opts.IncludeTreeCompact {
+		treeNode := buildTree(opts, entries)
 
 		if opts.IncludeTree {
 			payload, err := json.MarshalIndent(treeNode, "", "  ")
 			if err != nil {
 				return fmt.Errorf("build tree: %w", err)
 			}
-			if err := writeString(writer, "--- BEGIN FILE TREE (JSON) ---\n"); err != nil {
-				return err
-			}
-			if _, err := writer.Write(payload); err != nil {
-				return err
-			}
-			if err := writeString(writer, "\n--- END FILE TREE ---\n\n"); err != nil {
+			if err := writeTree(writer, opts.Format, payload, false); err != nil {
 				return err
 			}
 		}
@@ -126,142 +329,134 @@ func (c Combiner) Combine(ctx context.Context, opts Options) error {
 			if err != nil {
 				return fmt.Errorf("build compact tree: %w", err)
 			}
-			if err := writeString(writer, "--- BEGIN FILE TREE (JSON, COMPACT) ---\n"); err != nil {
-				return err
-			}
-			if _, err := writer.Write(payload); err != nil {
-				return err
-			}
-			if err := writeString(writer, "\n--- END FILE TREE (JSON, COMPACT) ---\n\n"); err != nil {
+			if err := writeTree(writer, opts.Format, payload, true); err != nil {
 				return err
 			}
 		}
 	}
+	return nil
+}
 
-	if opts.SkipContents {
-		return writer.Flush()
+// buildTree builds the tree of the entries, with their token counts when
+// counting.
+func buildTree(opts Options, entries []fileEntry) *tree.Node {
+	rootName := "roots"
+	if len(opts.Roots) == 1 {
+		rootName = opts.RootLabels[0]
 	}
-
-	for _, entry := range entries {
-		if err := writeString(writer, fmt.Sprintf("--- BEGIN FILE: %s ---\n", entry.display)); err != nil {
-			return err
-		}
-
-		fullPath := filepath.Join(entry.root, filepath.FromSlash(entry.rel))
-		data, err := c.FS.ReadFile(fullPath)
-		if err != nil {
-			return fmt.Errorf("read %s: %w", entry.display, err)
-		}
-		if opts.SkipBinary && isLikelyBinary(data) {
-			if err := writeString(writer, "[binary content omitted]\n"); err != nil {
-				return err
-			}
-		} else {
-			if _, err := writer.Write(data); err != nil {
-				return err
-			}
-			if len(data) == 0 || data[len(data)-1] != '\n' {
-				if err := writeString(writer, "\n"); err != nil {
-					return err
-				}
-			}
-		}
-		if err := writeString(writer, fmt.Sprintf("--- END FILE: %s ---\n\n", entry.display)); err != nil {
-			return err
+	paths := make([]string, len(entries))
+	var tokens []int64
+	if opts.Tokens != nil {
+		tokens = make([]int64, len(entries))
+	}
+	for i, entry := range entries {
+		paths[i] = entry.display
+		if tokens != nil {
+			tokens[i] = entry.tokens
 		}
 	}
-
-	return writer.Flush()
+	return tree.BuildWithTokens(rootName, paths, tokens)
 }
 
-func (c Combiner) collectFiles(ctx context.Context, root string, pathFilter filter.PathFilter, maxDepth int) ([]string, error) {
-	files := make([]string, 0)
-
-	err := c.FS.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+// writeSection writes the entry's section. A body that was not loaded is
+// streamed from the file through buf.
+func (c Combiner) writeSection(writer *bufio.Writer, opts Options, entry fileEntry, buf []byte) error {
+	streamed := entry.body == nil && !opts.SkipContents
+	if opts.Format.structured() {
+		section, err := jsonSection(opts, entry, streamed)
 		if err != nil {
-			return err
-		}
-		if ctx != nil {
-			if err := ctx.Err(); err != nil {
-				return err
-			}
+			return fmt.Errorf("encode %s: %w", entry.display, err)
 		}
-		if path == root {
-			return nil
+		if !streamed {
+			_, err = writer.Write(section)
+			return err
 		}
-		rel, err := filepath.Rel(root, path)
+		before, after, err := splitRecord(section)
 		if err != nil {
-			return err
+			return fmt.Errorf("encode %s: %w", entry.display, err)
 		}
-		rel = filepath.ToSlash(rel)
-		if rel == "." || strings.HasPrefix(rel, "../") || rel == ".." {
-			return nil
+		if _, err := writer.Write(before); err != nil {
+			return err
 		}
-
-		depth := 0
-		if rel != "" {
-			depth = strings.Count(rel, "/")
+		if err := c.streamBody(writer, opts, entry, buf, nil); err != nil {
+			return err
 		}
-		if maxDepth >= 0 {
-			if entry.IsDir() && depth >= maxDepth {
-				return fs.SkipDir
-			}
-			if !entry.IsDir() && depth > maxDepth {
-				return nil
-			}
+		_, err = writer.Write(after)
+		return err
+	}
+	begin, end := sectionMarkers(opts, entry)
+	if err := writeString(writer, begin); err != nil {
+		return err
+	}
+	if streamed {
+		if err := c.streamBody(writer, opts, entry, buf, nil); err != nil {
+			return err
 		}
+	} else if _, err := writer.Write(entry.body); err != nil {
+		return err
+	}
+	return writeString(writer, end)
+}
 
-		decision := pathFilter.Evaluate(rel, entry.IsDir())
-		if entry.IsDir() {
-			if !decision.Descend {
-				return fs.SkipDir
-			}
+// loadNestedRules reads the nested rule file in dir, if any, before its children are walked.
+func (c Combiner) loadNestedRules(nested *filter.NestedRules, dir, rel string) error {
+	if nested == nil || nested.FileName == "" {
+		return nil
+	}
+	source := path.Join(rel, nested.FileName)
+	data, err := c.FS.ReadFile(filepath.Join(dir, nested.FileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return nil
 		}
-		if decision.Include {
-			files = append(files, rel)
-		}
-		return nil
-	})
-
+		return fmt.Errorf("read %s: %w", source, err)
+	}
+	matcher, err := gitignore.ParseWithOptions(bytes.NewReader(data), gitignore.ParseOptions{Source: source, IgnoreCase: nested.IgnoreCase})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("parse %s: %w", source, err)
 	}
-	return files, nil
+	nested.Add(rel, matcher)
+	return nil
 }
 
-func (c Combiner) writeHeader(writer *bufio.Writer, opts Options, count int) error {
-	timestamp := c.Clock().UTC().Format(time.RFC3339)
-
-	if err := writeString(writer, "# Weaver Combined File\n"); err != nil {
-		return err
+// headerRoots returns the roots as the header names them: by label in
+// reproducible output, so checkouts at different paths match.
+func (opts Options) headerRoots() []string {
+	if opts.Reproducible {
+		return opts.RootLabels
 	}
-	if len(opts.Roots) == 1 {
-		if err := writeString(writer, fmt.Sprintf("# Root: %s\n", opts.Roots[0])); err != nil {
-			return err
-		}
+	return opts.Roots
+}
+
+func writeHeader(writer *bufio.Writer, opts Options, count, skipped int, report budgetReport, digest, timestamp string) error {
+	var fields []headerField
+	roots := opts.headerRoots()
+	if len(roots) == 1 {
+		fields = append(fields, headerField{key: "root", label: "Root", value: roots[0]})
 	} else {
-		if err := writeString(writer, "# Roots:\n"); err != nil {
-			return err
-		}
-		for _, root := range opts.Roots {
-			if err := writeString(writer, fmt.Sprintf("# - %s\n", root)); err != nil {
-				return err
-			}
-		}
+		fields = append(fields, headerField{key: "roots", label: "Roots", itemKey: "root", items: roots})
+	}
+	if opts.Profile != "" {
+		fields = append(fields, headerField{key: "profile", label: "Profile", value: opts.Profile})
 	}
 	if opts.ModeLabel != "" {
-		if err := writeString(writer, fmt.Sprintf("# Mode: %s\n", opts.ModeLabel)); err != nil {
-			return err
-		}
+		fields = append(fields, headerField{key: "mode", label: "Mode", value: opts.ModeLabel})
 	}
-	if err := writeString(writer, fmt.Sprintf("# Files: %d\n", count)); err != nil {
-		return err
+	if opts.boundary != "" {
+		fields = append(fields, headerField{key: "boundary", label: "Boundary", value: opts.boundary})
 	}
-	if err := writeString(writer, fmt.Sprintf("# Generated: %s\n\n", timestamp)); err != nil {
-		return err
+	fields = append(fields, headerField{key: "files", label: "Files", value: fmt.Sprint(count)})
+	if skipped > 0 {
+		fields = append(fields, headerField{key: "skipped_oversize", label: "Skipped over " + bytesize.Format(opts.MaxFileSize), value: fmt.Sprint(skipped)})
 	}
-	return nil
+	fields = append(fields, report.fields(opts)...)
+	if digest != "" {
+		fields = append(fields, headerField{key: "digest", label: "Digest", value: digest})
+	}
+	if timestamp != "" {
+		fields = append(fields, headerField{key: "generated", label: "Generated", value: timestamp})
+	}
+	return writeHeaderFields(writer, opts.Format, fields)
 }
 
 func writeString(writer *bufio.Writer, value string) error {
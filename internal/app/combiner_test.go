@@ -3,6 +3,12 @@ package app
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	iofs "io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,8 +17,38 @@ import (
 
 	"github.com/aatuh/weaver/internal/adapters/fs"
 	"github.com/aatuh/weaver/internal/filter"
+	"github.com/aatuh/weaver/internal/tokenizer"
 )
 
+// fixedClock is the clock of the test combiners, so headers are stable.
+func fixedClock() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+// rootOptions returns options that combine every file under root, labelled
+// "root", at any depth.
+func rootOptions(root string) Options {
+	return Options{
+		Roots:      []string{root},
+		RootLabels: []string{"root"},
+		Filters:    []filter.PathFilter{filter.GitIgnoreFilter{Mode: filter.ModeBlacklist}},
+		MaxDepth:   -1,
+	}
+}
+
+// writeFiles writes each file under root, named by its slash-separated path,
+// creating directories as needed.
+func writeFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+}
+
 func TestCombinerMultipleRootsPrefixesDisplayPaths(t *testing.T) {
 	rootA := t.TempDir()
 	rootB := t.TempDir()
@@ -206,3 +242,777 @@ func TestCombinerSkipBinaryWritesPlaceholder(t *testing.T) {
 		t.Fatalf("expected binary placeholder, got:\n%s", output)
 	}
 }
+
+// refusingFS fails any read of a file named in refuse.
+type refusingFS struct {
+	fs.OSFS
+	refuse map[string]bool
+}
+
+func (f refusingFS) ReadFile(path string) ([]byte, error) {
+	if f.refuse[filepath.Base(path)] {
+		return nil, fmt.Errorf("read of %s was not expected", path)
+	}
+	return f.OSFS.ReadFile(path)
+}
+
+func (f refusingFS) Open(path string) (iofs.File, error) {
+	if f.refuse[filepath.Base(path)] {
+		return nil, fmt.Errorf("read of %s was not expected", path)
+	}
+	return f.OSFS.Open(path)
+}
+
+func TestCombinerMaxFileSizeNeverReadsOversizedFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "small.txt"), []byte("small\n"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dump.bin"), bytes.Repeat([]byte("x"), 2048), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	combiner := Combiner{
+		FS:    refusingFS{refuse: map[string]bool{"dump.bin": true}},
+		Clock: fixedClock,
+	}
+	opts := rootOptions(root)
+	opts.MaxFileSize = 1024
+
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	output := buf.String()
+	if !strings.Contains(output, "--- BEGIN FILE: dump.bin ---\n[content omitted: 2.0 KiB exceeds the 1.0 KiB limit]\n") {
+		t.Fatalf("expected a size placeholder, got:\n%s", output)
+	}
+	if !strings.Contains(output, "small\n") || !strings.Contains(output, "# Files: 2\n") {
+		t.Fatalf("expected small.txt to be written, got:\n%s", output)
+	}
+
+	buf.Reset()
+	opts.SkipOversize = true
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	output = buf.String()
+	if strings.Contains(output, "dump.bin") {
+		t.Fatalf("expected dump.bin to be left out, got:\n%s", output)
+	}
+	if !strings.Contains(output, "# Files: 1\n# Skipped over 1.0 KiB: 1\n") {
+		t.Fatalf("expected the header to count the skipped file, got:\n%s", output)
+	}
+
+	explanation, err := combiner.Explain(opts, 0, "dump.bin", false)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if !explanation.Oversized || explanation.Size != 2048 || explanation.Included() {
+		t.Fatalf("expected explain to report the oversized file, got %+v", explanation)
+	}
+
+	// A link is read through, so it is measured by its target.
+	if err := os.Symlink("dump.bin", filepath.Join(root, "link.bin")); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+	buf.Reset()
+	opts.SkipOversize = false
+	combiner.FS = refusingFS{refuse: map[string]bool{"dump.bin": true, "link.bin": true}}
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if !strings.Contains(buf.String(), "--- BEGIN FILE: link.bin ---\n[content omitted: 2.0 KiB exceeds the 1.0 KiB limit]\n") {
+		t.Fatalf("expected the link to be measured by its target, got:\n%s", buf.String())
+	}
+}
+
+func TestCombinerBudgetDropsLowPriorityFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":          "small\n",
+		"big.txt":        strings.Repeat("line\n", 200),
+		"pkg/mid.txt":    strings.Repeat("line\n", 20),
+		"pkg/deep/x.txt": strings.Repeat("line\n", 20),
+	}
+	writeFiles(t, root, files)
+
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := rootOptions(root)
+	opts.IncludeTree = true
+	opts.MaxLines = 80
+
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	output := buf.String()
+	if lines := strings.Count(output, "\n"); lines > 80 {
+		t.Fatalf("expected at most 80 lines, got %d:\n%s", lines, output)
+	}
+	if !strings.Contains(output, "# Files: 2\n# Budget: 80 lines (drop)\n# Dropped to fit the budget: 2\n# - big.txt\n# - pkg/deep/x.txt\n") {
+		t.Fatalf("expected the header to list dropped files, got:\n%s", output)
+	}
+	if strings.Contains(output, "BEGIN FILE: big.txt") || strings.Contains(output, "\"x.txt\"") {
+		t.Fatalf("expected dropped files to be left out of sections and tree, got:\n%s", output)
+	}
+
+	buf.Reset()
+	opts.IncludeTree = false
+	opts.BudgetPolicy = BudgetTruncate
+	opts.MaxBytes = 1200
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	output = buf.String()
+	if lines, size := strings.Count(output, "\n"), len(output); lines > 80 || size > 1200 {
+		t.Fatalf("expected the output within 80 lines and 1200 bytes, got %d and %d", lines, size)
+	}
+	if !strings.Contains(output, "# Files: 4\n") || !strings.Contains(output, "# - big.txt (kept ") {
+		t.Fatalf("expected every file kept and big.txt truncated, got:\n%s", output)
+	}
+	if !strings.Contains(output, "--- BEGIN FILE: a.txt ---\nsmall\n--- END FILE: a.txt ---") {
+		t.Fatalf("expected small files to stay whole, got:\n%s", output)
+	}
+	if !strings.Contains(output, "lines omitted to fit the output budget ...]\nline\n") {
+		t.Fatalf("expected a truncation marker followed by the tail, got:\n%s", output)
+	}
+
+	buf.Reset()
+	opts.MaxBytes = 50
+	if err := combiner.Combine(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "too small for the header") {
+		t.Fatalf("expected a budget smaller than the header to fail, got %v", err)
+	}
+}
+
+func TestCombinerTruncateKeepsAtLeastTheFilesDropKeeps(t *testing.T) {
+	root := writeNumberedFiles(t, 60)
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	kept := func(opts Options) int {
+		t.Helper()
+		var buf bytes.Buffer
+		opts.Output = &buf
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("combine with %s: %v", opts.BudgetPolicy, err)
+		}
+		if size := int64(buf.Len()); size > opts.MaxBytes {
+			t.Fatalf("%s: expected at most %d bytes, got %d", opts.BudgetPolicy, opts.MaxBytes, size)
+		}
+		var files int
+		if _, err := fmt.Sscanf(buf.String()[strings.Index(buf.String(), "# Files: "):], "# Files: %d", &files); err != nil {
+			t.Fatalf("%s: read the file count: %v", opts.BudgetPolicy, err)
+		}
+		return files
+	}
+	// The header and tree list every file, so at small budgets they take
+	// most of the space.
+	for _, maxBytes := range []int64{3000, 5000, 8000, 12000, 50000} {
+		opts := rootOptions(root)
+		opts.IncludeTree = true
+		opts.SkipBinary = true
+		opts.MaxBytes = maxBytes
+		dropped := kept(opts)
+		opts.BudgetPolicy = BudgetTruncate
+		truncated := kept(opts)
+		if truncated < dropped {
+			t.Fatalf("%d bytes: truncating kept %d files, dropping kept %d", maxBytes, truncated, dropped)
+		}
+	}
+}
+
+func TestCombinerCountsTokensWithinMaxTokens(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":     "one two three\n",
+		"pkg/b.txt": strings.Repeat("alpha beta gamma delta\n", 100),
+	}
+	writeFiles(t, root, files)
+
+	counter := tokenizer.Heuristic{}
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := rootOptions(root)
+	opts.IncludeTreeCompact = true
+	opts.Tokens = counter
+
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	output := buf.String()
+	want := fmt.Sprintf("# Tokens: %d (heuristic)\n", counter.Count(buf.Bytes()))
+	if !strings.Contains(output, want) {
+		t.Fatalf("expected the header to report the output's tokens as %q, got:\n%s", want, output)
+	}
+	if !strings.Contains(output, `{"name":"a.txt","type":"file","tokens":5}`) || !strings.Contains(output, `{"name":"b.txt","type":"file","tokens":900}`) {
+		t.Fatalf("expected per-file tokens in the tree, got:\n%s", output)
+	}
+
+	buf.Reset()
+	opts.MaxTokens = 340
+	opts.BudgetPolicy = BudgetTruncate
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if got := counter.Count(buf.Bytes()); got > 340 {
+		t.Fatalf("expected at most 340 tokens, got %d:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "# Budget: 340 tokens (truncate)\n# Truncated to fit the budget: 1\n# - pkg/b.txt (kept ") {
+		t.Fatalf("expected pkg/b.txt to be truncated, got:\n%s", buf.String())
+	}
+
+	opts.Tokens = nil
+	if err := combiner.Combine(context.Background(), opts); err == nil {
+		t.Fatalf("expected a token budget without a counter to fail")
+	}
+}
+
+func TestCombinerTextFormatUsesBoundaryOnMarkerCollision(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":        "A\n",
+		"golden.txt":   "--- BEGIN FILE: a.txt ---\nfake\n--- END FILE: a.txt ---\n",
+		"--- END FILE": "odd name\n",
+	}
+	writeFiles(t, root, files)
+
+	var buf bytes.Buffer
+	combiner := Combiner{
+		FS:     fs.OSFS{},
+		Clock:  fixedClock,
+		Random: bytes.NewReader(bytes.Repeat([]byte{0xab}, 12)),
+	}
+	opts := rootOptions(root)
+	opts.Output = &buf
+
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+
+	boundary := strings.Repeat("ab", 12)
+	output := buf.String()
+	want := "# Boundary: " + boundary + "\n# Files: 3\n"
+	if !strings.Contains(output, want) {
+		t.Fatalf("expected the boundary in the header, got:\n%s", output)
+	}
+	section := "--- " + boundary + " BEGIN FILE: golden.txt ---\n" + files["golden.txt"] + "--- " + boundary + " END FILE: golden.txt ---\n"
+	if !strings.Contains(output, section) {
+		t.Fatalf("expected markers with the boundary, got:\n%s", output)
+	}
+	if got := strings.Count(output, "--- "+boundary+" BEGIN FILE: "); got != 3 {
+		t.Fatalf("expected 3 sections, got %d:\n%s", got, output)
+	}
+
+	// File names alone cannot collide, since markers are whole lines.
+	if err := os.Remove(filepath.Join(root, "golden.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	buf.Reset()
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if strings.Contains(buf.String(), "# Boundary:") || !strings.Contains(buf.String(), "--- BEGIN FILE: --- END FILE ---\n") {
+		t.Fatalf("expected plain markers without a collision, got:\n%s", buf.String())
+	}
+}
+
+func TestCombinerReproducibleOutputIsByteIdentical(t *testing.T) {
+	files := map[string]string{
+		"a.txt":          "hello\n",
+		"testdata/c.txt": "--- END FILE: a.txt ---\n",
+	}
+
+	var (
+		opts    Options
+		outputs []string
+	)
+	for run := 0; run < 2; run++ {
+		// Each run reads its own copy, as from two checkouts.
+		root := t.TempDir()
+		writeFiles(t, root, files)
+		opts = rootOptions(root)
+		opts.NoTimestamp = true
+		opts.Reproducible = true
+		var buf bytes.Buffer
+		opts.Output = &buf
+		// Neither the clock, the random source nor the root path may show in
+		// the output.
+		combiner := Combiner{
+			FS:    fs.OSFS{},
+			Clock: func() time.Time { return time.Date(2020+run, 1, 2, 3, 4, 5, 0, time.UTC) },
+		}
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("combine: %v", err)
+		}
+		outputs = append(outputs, buf.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Fatalf("expected identical outputs, got:\n%s\nand:\n%s", outputs[0], outputs[1])
+	}
+	output := outputs[0]
+	if strings.Contains(output, "# Generated:") || !strings.Contains(output, "# Boundary: ") || !strings.Contains(output, "# Root: root\n") {
+		t.Fatalf("expected the root label, a boundary and no timestamp, got:\n%s", output)
+	}
+	if want := "# Digest: " + manifestDigest(files, "a.txt", "testdata/c.txt") + "\n"; !strings.Contains(output, want) {
+		t.Fatalf("expected %q in the header, got:\n%s", want, output)
+	}
+
+	var buf bytes.Buffer
+	opts.Output = &buf
+	opts.Format = FormatJSON
+	combiner := Combiner{FS: fs.OSFS{}}
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	var document struct {
+		Header map[string]any `json:"header"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &document); err != nil {
+		t.Fatalf("output is not a JSON document: %v", err)
+	}
+	if _, ok := document.Header["generated"]; ok || document.Header["digest"] != manifestDigest(files, "a.txt", "testdata/c.txt") {
+		t.Fatalf("unexpected header: %v", document.Header)
+	}
+	if roots := fmt.Sprint(document.Header["roots"]); roots != "[map[label:root path:root]]" {
+		t.Fatalf("expected the root to be named by its label, got %s", roots)
+	}
+}
+
+func TestCombinerMarkdownFormatFencesFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"main.go":   "package main\n",
+		"README.md": "Example:\n\n```go\nfmt.Println(\"hi\")\n```",
+		"logo.png":  "\x89PNG\x00\x00",
+	}
+	writeFiles(t, root, files)
+
+	var buf bytes.Buffer
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := rootOptions(root)
+	opts.IncludeTreeCompact = true
+	opts.SkipBinary = true
+	opts.Format = FormatMarkdown
+	opts.Output = &buf
+
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+
+	want := "# Weaver Combined File\n\n" +
+		"- Root: " + root + "\n" +
+		"- Files: 3\n" +
+		"- Digest: " + manifestDigest(files, "README.md", "logo.png", "main.go") + "\n" +
+		"- Generated: 2020-01-02T03:04:05Z\n\n" +
+		"## File tree (compact)\n\n" +
+		"```json\n" +
+		`{"name":"root","type":"dir","children":[{"name":"README.md","type":"file"},{"name":"logo.png","type":"file"},{"name":"main.go","type":"file"}]}` +
+		"\n```\n\n" +
+		"## README.md\n\n" +
+		"````markdown\nExample:\n\n```go\nfmt.Println(\"hi\")\n```\n````\n\n" +
+		"## logo.png\n\n" +
+		"[binary content omitted]\n\n" +
+		"## main.go\n\n" +
+		"```go\npackage main\n```\n\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCombinerXMLFormatKeepsDocumentsWellFormed(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a&b.txt": "plain\n",
+		"main.go": "if a < b && c {\n}\n// ]]> ends CDATA\n",
+		"odd.txt": "bell\x07 \xff",
+		"dos.txt": "one\r\ntwo\r\n",
+		"win.go":  "if a < b {\r\n}\r\n",
+	}
+	writeFiles(t, root, files)
+
+	var buf bytes.Buffer
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := rootOptions(root)
+	opts.IncludeTreeCompact = true
+	opts.Format = FormatXML
+	opts.Output = &buf
+
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+
+	want := "<documents>\n<header>\n" +
+		"<root>" + root + "</root>\n" +
+		"<files>5</files>\n" +
+		"<digest>" + manifestDigest(files, "a&b.txt", "dos.txt", "main.go", "odd.txt", "win.go") + "</digest>\n" +
+		"<generated>2020-01-02T03:04:05Z</generated>\n" +
+		"</header>\n" +
+		"<file_tree format=\"json-compact\">\n" +
+		`{"name":"root","type":"dir","children":[{"name":"a\u0026b.txt","type":"file"},{"name":"dos.txt","type":"file"},{"name":"main.go","type":"file"},{"name":"odd.txt","type":"file"},{"name":"win.go","type":"file"}]}` +
+		"\n</file_tree>\n" +
+		"<document index=\"1\">\n<source>a&amp;b.txt</source>\n<document_content>\nplain\n</document_content>\n</document>\n" +
+		"<document index=\"2\">\n<source>dos.txt</source>\n<document_content>\none&#xD;\ntwo&#xD;\n</document_content>\n</document>\n" +
+		"<document index=\"3\">\n<source>main.go</source>\n<document_content><![CDATA[\n" +
+		"if a < b && c {\n}\n// ]]]]><![CDATA[> ends CDATA\n" +
+		"]]></document_content>\n</document>\n" +
+		"<document index=\"4\" lossy=\"true\">\n<source>odd.txt</source>\n<document_content>\nbell\ufffd \ufffd\n</document_content>\n</document>\n" +
+		"<document index=\"5\">\n<source>win.go</source>\n<document_content><![CDATA[\n" +
+		"if a < b {]]>&#xD;<![CDATA[\n}]]>&#xD;<![CDATA[\n" +
+		"]]></document_content>\n</document>\n" +
+		"</documents>\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(buf.String()))
+	var contents []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("output is not well-formed XML: %v", err)
+		}
+		if data, ok := token.(xml.CharData); ok {
+			contents = append(contents, string(data))
+		}
+	}
+	joined := strings.Join(contents, "")
+	for _, content := range []string{"\n// ]]> ends CDATA\n", "\none\r\ntwo\r\n", "\nif a < b {\r\n}\r\n"} {
+		if !strings.Contains(joined, content) {
+			t.Fatalf("expected %q to round-trip, got %q", content, joined)
+		}
+	}
+}
+
+func TestCombinerJSONFormatsDescribeEveryFile(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":     "hello",
+		"image.bin": "\x00\x01\x02",
+	}
+	writeFiles(t, root, files)
+
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := rootOptions(root)
+	opts.Format = FormatJSON
+
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	var document struct {
+		Header jsonHeader `json:"header"`
+		Files  []jsonFile `json:"files"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &document); err != nil {
+		t.Fatalf("output is not a JSON document: %v\n%s", err, buf.String())
+	}
+	if document.Header.Files != 2 || document.Header.Tree == nil || len(document.Header.Tree.Children) != 2 {
+		t.Fatalf("unexpected header: %+v", document.Header)
+	}
+	if len(document.Files) != 2 {
+		t.Fatalf("expected two files, got %+v", document.Files)
+	}
+	text, binary := document.Files[0], document.Files[1]
+	if text.Path != "a.txt" || text.Root != "root" || text.Size != 5 || text.Encoding != "utf-8" || text.Content == nil || *text.Content != "hello" {
+		t.Fatalf("unexpected text record: %+v", text)
+	}
+	if text.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Fatalf("unexpected hash %q", text.SHA256)
+	}
+	if binary.Binary == nil || !*binary.Binary || binary.Encoding != "base64" || binary.Content == nil || *binary.Content != "AAEC" {
+		t.Fatalf("unexpected binary record: %+v", binary)
+	}
+
+	buf.Reset()
+	opts.Format = FormatJSONL
+	opts.SkipBinary = true
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and two file records, got:\n%s", buf.String())
+	}
+	var header jsonHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Type != "header" {
+		t.Fatalf("unexpected header record %q: %v", lines[0], err)
+	}
+	var record jsonFile
+	if err := json.Unmarshal([]byte(lines[2]), &record); err != nil {
+		t.Fatalf("decode record: %v", err)
+	}
+	if record.Type != "file" || record.Path != "image.bin" || record.Content != nil || record.Omitted != "binary" || record.SHA256 == "" {
+		t.Fatalf("expected the binary contents to be omitted, got %+v", record)
+	}
+
+	big := strings.Repeat("\"quoted\"\tline\n", 200)
+	if err := os.WriteFile(filepath.Join(root, "big.txt"), []byte(big), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	buf.Reset()
+	opts.MaxBytes = 2000
+	opts.BudgetPolicy = BudgetTruncate
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if buf.Len() > 2000 {
+		t.Fatalf("expected at most 2000 bytes, got %d:\n%s", buf.Len(), buf.String())
+	}
+	if !strings.Contains(buf.String(), `"path":"big.txt","root":"root","size":2800,`) || !strings.Contains(buf.String(), `"truncated":{"kept_lines":`) {
+		t.Fatalf("expected big.txt to be truncated, got:\n%s", buf.String())
+	}
+}
+
+func TestCombinerFileMetadataDescribesEachFile(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "main.go")
+	if err := os.WriteFile(file, []byte("package main"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	modTime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	sum := hashHex([]byte("package main"))
+	metadata := "size=12 lines=1 sha256=" + sum + " mtime=2021-06-07T08:09:10Z mode=0600 language=go"
+	wants := map[Format]string{
+		FormatText:     "--- BEGIN FILE: main.go | " + metadata + " ---\npackage main\n--- END FILE: main.go ---\n",
+		FormatMarkdown: "## main.go\n\n" + metadata + "\n\n```go\npackage main\n```\n",
+		FormatXML:      `<document index="1" ` + strings.ReplaceAll(strings.ReplaceAll(metadata, " ", `" `), "=", `="`) + `">`,
+		FormatJSONL:    `"lines":1,"mtime":"2021-06-07T08:09:10Z","mode":"0600","language":"go"}`,
+	}
+	for format, want := range wants {
+		var buf bytes.Buffer
+		opts := rootOptions(root)
+		opts.FileMetadata = true
+		opts.Format = format
+		opts.Output = &buf
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("%s: combine: %v", format, err)
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("%s: expected %q in output:\n%s", format, want, buf.String())
+		}
+		// The hash lets the added final newline be dropped again.
+		parsed, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: parse: %v", format, err)
+		}
+		if len(parsed.Files) != 1 || string(parsed.Files[0].Content) != "package main" || parsed.Files[0].SHA256 != sum {
+			t.Fatalf("%s: unexpected files %+v", format, parsed.Files)
+		}
+	}
+}
+
+func TestParseReadsEveryFormat(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":       "hello\n",
+		"sub/b.go":    "package b\n\n// <&> ]]> ```\n",
+		"markers.txt": "--- END FILE: a.txt ---\n## heading\n",
+		"image.bin":   "\x00\x01\x02",
+	}
+	writeFiles(t, root, files)
+
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	for _, format := range []Format{FormatText, FormatMarkdown, FormatXML, FormatJSON, FormatJSONL} {
+		var buf bytes.Buffer
+		opts := rootOptions(root)
+		opts.IncludeTree = true
+		opts.SkipBinary = true
+		opts.Format = format
+		opts.Output = &buf
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("%s: combine: %v", format, err)
+		}
+		parsed, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: parse: %v\n%s", format, err, buf.String())
+		}
+		if parsed.Format != format {
+			t.Fatalf("detected %s, want %s", parsed.Format, format)
+		}
+		if len(parsed.Files) != len(files) {
+			t.Fatalf("%s: expected %d files, got %+v", format, len(files), parsed.Files)
+		}
+		for _, file := range parsed.Files {
+			if file.Path == "image.bin" {
+				if file.Omitted != "binary" {
+					t.Fatalf("%s: expected the binary file to be omitted, got %+v", format, file)
+				}
+				continue
+			}
+			if file.Omitted != "" || string(file.Content) != files[file.Path] {
+				t.Fatalf("%s: %s read back as %q (omitted %q)", format, file.Path, file.Content, file.Omitted)
+			}
+		}
+	}
+
+	if _, err := Parse([]byte("plain text\n")); err == nil {
+		t.Fatalf("expected an error for input that is not a weaver output")
+	}
+}
+
+func TestParseTrustsHashesAndTheBudgetHeader(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":    "small\n",
+		"big.txt":  strings.Repeat("line\n", 600),
+		"fake.txt": "[binary content omitted]\n",
+		"notes.md": "intro\n[... 3 of 10 lines omitted to fit the output budget ...]\nend\n",
+	}
+	writeFiles(t, root, files)
+
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	// parse combines with opts and reads the files back, by path.
+	parse := func(opts Options) map[string]ParsedFile {
+		t.Helper()
+		var buf bytes.Buffer
+		opts.Output = &buf
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("%s: combine: %v", opts.Format, err)
+		}
+		parsed, err := Parse(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: parse: %v\n%s", opts.Format, err, buf.String())
+		}
+		byPath := map[string]ParsedFile{}
+		for _, file := range parsed.Files {
+			byPath[file.Path] = file
+		}
+		return byPath
+	}
+	for _, format := range []Format{FormatText, FormatMarkdown, FormatXML, FormatJSON, FormatJSONL} {
+		// Contents that look like placeholders are read back whole when
+		// their hash matches.
+		opts := rootOptions(root)
+		opts.Format = format
+		opts.FileMetadata = true
+		for name, file := range parse(opts) {
+			if file.Omitted != "" || string(file.Content) != files[name] {
+				t.Fatalf("%s: %s read back as %q (omitted %q)", format, name, file.Content, file.Omitted)
+			}
+		}
+
+		// Without hashes, the header tells which files the budget cut.
+		opts = rootOptions(root)
+		opts.Format = format
+		opts.MaxBytes = 2000
+		parsed := parse(opts)
+		if parsed["big.txt"].Omitted != "dropped" || parsed["notes.md"].Omitted != "" {
+			t.Fatalf("%s: expected only big.txt to be dropped, got %q and %q", format, parsed["big.txt"].Omitted, parsed["notes.md"].Omitted)
+		}
+		opts.BudgetPolicy = BudgetTruncate
+		opts.MaxBytes = 2600
+		parsed = parse(opts)
+		if parsed["big.txt"].Omitted != "truncated" || parsed["notes.md"].Omitted != "" || string(parsed["notes.md"].Content) != files["notes.md"] {
+			t.Fatalf("%s: expected only big.txt to be truncated, got %q and %q", format, parsed["big.txt"].Omitted, parsed["notes.md"].Omitted)
+		}
+	}
+}
+
+func TestCombinerLoadsNestedGitignoreFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "*.log\n",
+		"a.txt":               "A",
+		"debug.log":           "log",
+		"pkg/.gitignore":      "out/\n!keep.log\n",
+		"pkg/keep.log":        "keep",
+		"pkg/out/gen.txt":     "generated",
+		"other/out/data.txt":  "data",
+		"other/nested/x.log":  "log",
+		"pkg/sub/.gitignore":  "*.txt\n",
+		"pkg/sub/skipped.txt": "skipped",
+	}
+	writeFiles(t, root, files)
+
+	nested := filter.NewNestedRules(".gitignore")
+	pathFilter := filter.NewRuleSetFilter([]filter.RuleSet{{Mode: filter.ModeBlacklist, Nested: nested}}, filter.ModeBlacklist)
+
+	var buf bytes.Buffer
+	combiner := Combiner{FS: fs.OSFS{}, Clock: fixedClock}
+	opts := Options{
+		Roots:       []string{root},
+		RootLabels:  []string{"root"},
+		Filters:     []filter.PathFilter{pathFilter},
+		NestedRules: []*filter.NestedRules{nested},
+		MaxDepth:    -1,
+		Output:      &buf,
+	}
+
+	if err := combiner.Combine(context.Background(), opts); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{"a.txt", "pkg/keep.log", "other/out/data.txt", "pkg/sub/.gitignore"} {
+		if !strings.Contains(output, "--- BEGIN FILE: "+want+" ---") {
+			t.Fatalf("expected %s in output, got:\n%s", want, output)
+		}
+	}
+	for _, unwanted := range []string{"debug.log", "pkg/out/gen.txt", "other/nested/x.log", "pkg/sub/skipped.txt"} {
+		if strings.Contains(output, "--- BEGIN FILE: "+unwanted+" ---") {
+			t.Fatalf("did not expect %s in output, got:\n%s", unwanted, output)
+		}
+	}
+}
+
+func TestCombinerExplainReportsDecidingRules(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":      "*.log\n",
+		"pkg/.gitignore":  "out/\n!keep.log\n",
+		"pkg/keep.log":    "keep",
+		"pkg/out/gen.txt": "generated",
+	}
+	writeFiles(t, root, files)
+
+	nested := filter.NewNestedRules(".gitignore")
+	pathFilter := filter.NewRuleSetFilter([]filter.RuleSet{{Mode: filter.ModeBlacklist, Nested: nested}}, filter.ModeBlacklist)
+	opts := Options{
+		Roots:       []string{root},
+		RootLabels:  []string{"root"},
+		Filters:     []filter.PathFilter{pathFilter},
+		NestedRules: []*filter.NestedRules{nested},
+		MaxDepth:    -1,
+	}
+	combiner := Combiner{FS: fs.OSFS{}}
+
+	kept, err := combiner.Explain(opts, 0, "pkg/keep.log", false)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if !kept.Included() {
+		t.Fatalf("expected pkg/keep.log to be included")
+	}
+	if len(kept.Matches) != 2 || kept.Matches[1].Rule.String() != "pkg/.gitignore:2:!keep.log" {
+		t.Fatalf("expected the negation in pkg/.gitignore to be the last match, got %+v", kept.Matches)
+	}
+
+	generated, err := combiner.Explain(opts, 0, "pkg/out/gen.txt", false)
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if generated.Included() || generated.SkippedParent != "pkg/out" {
+		t.Fatalf("expected pkg/out to be skipped, got %+v", generated)
+	}
+}
+
+// manifestDigest computes the content digest the way sha256sum users would:
+// as the hash of the sha256sum listing of the named files.
+func manifestDigest(files map[string]string, names ...string) string {
+	var manifest strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&manifest, "%x  %s\n", sha256.Sum256([]byte(files[name])), name)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest.String())))
+}
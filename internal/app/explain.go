@@ -0,0 +1,120 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/filter"
+)
+
+// Explanation describes how Combine treats a single path.
+type Explanation struct {
+	filter.Explanation
+
+	// Path is the root-relative, slash-separated path that was explained.
+	Path  string
+	IsDir bool
+	// SkippedParent is the first parent directory the walk does not descend into, if any,
+	// and Parent explains why.
+	SkippedParent string
+	Parent        filter.Explanation
+	// BeyondMaxDepth reports that the path lies deeper than Options.MaxDepth allows.
+	BeyondMaxDepth bool
+	// Oversized reports that the file is larger than Options.MaxFileSize; Size is
+	// its size, and SkipOversize whether it is left out rather than replaced.
+	Oversized    bool
+	Size         int64
+	SkipOversize bool
+}
+
+// Included reports whether the path is written to the output (or, for a directory, walked).
+func (e Explanation) Included() bool {
+	if e.SkippedParent != "" || e.BeyondMaxDepth || (e.Oversized && e.SkipOversize) {
+		return false
+	}
+	if e.IsDir {
+		return e.Decision.Descend
+	}
+	return e.Decision.Include
+}
+
+// Explain evaluates one root-relative path the way Combine would. Nested rule files
+// in the path's parent directories are loaded just as the walk would load them.
+func (c Combiner) Explain(opts Options, rootIndex int, rel string, isDir bool) (Explanation, error) {
+	if rootIndex < 0 || rootIndex >= len(opts.Roots) || rootIndex >= len(opts.Filters) {
+		return Explanation{}, fmt.Errorf("root index %d is out of range", rootIndex)
+	}
+	if c.FS == nil {
+		return Explanation{}, fmt.Errorf("filesystem adapter is required")
+	}
+	root := opts.Roots[rootIndex]
+	pathFilter := opts.Filters[rootIndex]
+	var nested *filter.NestedRules
+	if len(opts.NestedRules) > rootIndex {
+		nested = opts.NestedRules[rootIndex]
+	}
+
+	result := Explanation{Path: rel, IsDir: isDir}
+	if err := c.loadNestedRules(nested, root, ""); err != nil {
+		return Explanation{}, err
+	}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] != '/' {
+			continue
+		}
+		parent := rel[:i]
+		if opts.MaxDepth >= 0 && strings.Count(parent, "/") >= opts.MaxDepth {
+			result.BeyondMaxDepth = true
+			break
+		}
+		if decision := pathFilter.Evaluate(parent, true); !decision.Descend {
+			result.SkippedParent = parent
+			result.Parent = explainPath(pathFilter, parent, true)
+			break
+		}
+		if err := c.loadNestedRules(nested, filepath.Join(root, filepath.FromSlash(parent)), parent); err != nil {
+			return Explanation{}, err
+		}
+	}
+
+	if opts.MaxDepth >= 0 {
+		depth := strings.Count(rel, "/")
+		if (isDir && depth >= opts.MaxDepth) || (!isDir && depth > opts.MaxDepth) {
+			result.BeyondMaxDepth = true
+		}
+	}
+	result.Explanation = explainPath(pathFilter, rel, isDir)
+	if !isDir && opts.MaxFileSize > 0 {
+		size, err := c.fileSize(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return Explanation{}, fmt.Errorf("stat %s: %w", rel, err)
+		}
+		result.Size = size
+		result.Oversized = size > opts.MaxFileSize
+		result.SkipOversize = opts.SkipOversize
+	}
+	return result, nil
+}
+
+// fileSize reports the size the walk would see for fullPath, or 0 if it does
+// not exist. Like the walk, it measures a symbolic link by its target.
+func (c Combiner) fileSize(fullPath string) (int64, error) {
+	info, err := c.FS.Stat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func explainPath(pathFilter filter.PathFilter, rel string, isDir bool) filter.Explanation {
+	if explainer, ok := pathFilter.(filter.Explainer); ok {
+		return explainer.Explain(rel, isDir)
+	}
+	return filter.Explanation{Decision: pathFilter.Evaluate(rel, isDir)}
+}
@@ -0,0 +1,389 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Format selects how Combine lays out the header, trees and files.
+type Format int
+
+const (
+	// FormatText writes the header as '#' lines and wraps each file in
+	// BEGIN and END marker lines.
+	FormatText Format = iota
+	// FormatMarkdown writes the header as a list and each file as a heading
+	// followed by a fenced code block tagged with the file's language.
+	FormatMarkdown
+	// FormatXML wraps the output in a <documents> element, with the header
+	// and trees in their own elements and each file in a <document>.
+	FormatXML
+	// FormatJSON writes a single JSON document with the header, the tree and
+	// an array of file records.
+	FormatJSON
+	// FormatJSONL writes a header record and then one record per file, one
+	// JSON object per line.
+	FormatJSONL
+)
+
+var formatNames = []string{
+	FormatText:     "text",
+	FormatMarkdown: "markdown",
+	FormatXML:      "xml",
+	FormatJSON:     "json",
+	FormatJSONL:    "jsonl",
+}
+
+func (f Format) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return "unknown"
+	}
+	return formatNames[f]
+}
+
+// structured reports whether the format encodes files as JSON records, with
+// their contents as strings rather than between markers.
+func (f Format) structured() bool {
+	return f == FormatJSON || f == FormatJSONL
+}
+
+// FormatNames returns the format names accepted by ParseFormat.
+func FormatNames() []string {
+	return append([]string(nil), formatNames...)
+}
+
+// ParseFormat reads a format name as printed by String.
+func ParseFormat(value string) (Format, error) {
+	for i, name := range formatNames {
+		if value == name {
+			return Format(i), nil
+		}
+	}
+	return 0, fmt.Errorf("format must be one of %s, got %q", strings.Join(formatNames, ", "), value)
+}
+
+// headerField is one line of the header, with an optional list below it.
+// key and itemKey name the XML elements for the field and its items.
+type headerField struct {
+	key     string
+	label   string
+	value   string
+	itemKey string
+	items   []string
+}
+
+func writeHeaderFields(writer *bufio.Writer, format Format, fields []headerField) error {
+	if format == FormatXML {
+		return writeXMLHeader(writer, fields)
+	}
+	title, line, item := "# Weaver Combined File\n", "# %s:%s\n", "# - %s\n"
+	if format == FormatMarkdown {
+		title, line, item = "# Weaver Combined File\n\n", "- %s:%s\n", "  - %s\n"
+	}
+	if err := writeString(writer, title); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		value := field.value
+		if value != "" {
+			value = " " + value
+		}
+		if err := writeString(writer, fmt.Sprintf(line, field.label, value)); err != nil {
+			return err
+		}
+		for _, text := range field.items {
+			if err := writeString(writer, fmt.Sprintf(item, text)); err != nil {
+				return err
+			}
+		}
+	}
+	return writeString(writer, "\n")
+}
+
+// writeXMLHeader opens the <documents> element and writes the fields in a
+// <header> element. A field with items lists them instead of its value.
+func writeXMLHeader(writer *bufio.Writer, fields []headerField) error {
+	if err := writeString(writer, "<documents>\n<header>\n"); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		var line string
+		if field.items == nil {
+			line = fmt.Sprintf("<%s>%s</%s>\n", field.key, escapeXML(field.value), field.key)
+		} else {
+			var items strings.Builder
+			for _, text := range field.items {
+				fmt.Fprintf(&items, "<%s>%s</%s>", field.itemKey, escapeXML(text), field.itemKey)
+			}
+			line = fmt.Sprintf("<%s>%s</%s>\n", field.key, items.String(), field.key)
+		}
+		if err := writeString(writer, line); err != nil {
+			return err
+		}
+	}
+	return writeString(writer, "</header>\n")
+}
+
+// writeFooter closes what the header opened.
+func writeFooter(writer *bufio.Writer, format Format) error {
+	switch format {
+	case FormatXML:
+		return writeString(writer, "</documents>\n")
+	case FormatJSON:
+		return writeString(writer, "\n  ]\n}\n")
+	}
+	return nil
+}
+
+// writeTree writes a JSON tree payload. encoding/json escapes '<', '>' and
+// '&', so the payload needs no escaping in XML.
+func writeTree(writer *bufio.Writer, format Format, payload []byte, compact bool) error {
+	var begin, end string
+	switch {
+	case format == FormatXML:
+		kind := "json"
+		if compact {
+			kind = "json-compact"
+		}
+		begin, end = fmt.Sprintf("<file_tree format=%q>\n", kind), "\n</file_tree>\n"
+	case format == FormatMarkdown:
+		title := "File tree"
+		if compact {
+			title = "File tree (compact)"
+		}
+		fence := codeFence(payload)
+		begin = fmt.Sprintf("## %s\n\n%sjson\n", title, fence)
+		end = fmt.Sprintf("\n%s\n\n", fence)
+	case compact:
+		begin, end = "--- BEGIN FILE TREE (JSON, COMPACT) ---\n", "\n--- END FILE TREE (JSON, COMPACT) ---\n\n"
+	default:
+		begin, end = "--- BEGIN FILE TREE (JSON) ---\n", "\n--- END FILE TREE ---\n\n"
+	}
+	if err := writeString(writer, begin); err != nil {
+		return err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return err
+	}
+	return writeString(writer, end)
+}
+
+// sectionMarkers returns the text written before and after the entry's body.
+func sectionMarkers(opts Options, entry fileEntry) (string, string) {
+	format := opts.Format
+	var metadata []metadataField
+	if opts.FileMetadata {
+		metadata = fileMetadata(entry)
+	}
+	if format == FormatXML {
+		var attrs strings.Builder
+		for _, field := range metadata {
+			fmt.Fprintf(&attrs, " %s=\"%s\"", field.key, escapeXML(field.value))
+		}
+		lossy := ""
+		if entry.xmlLossy() && !entry.placeholder {
+			lossy = ` lossy="true"`
+		}
+		begin := fmt.Sprintf("<document index=\"%d\"%s%s>\n<source>%s</source>\n<document_content>", entry.index, lossy, attrs.String(), escapeXML(entry.display))
+		end := "</document_content>\n</document>\n"
+		if entry.xmlSpecial && !entry.placeholder {
+			begin += "<![CDATA["
+			end = "]]>" + end
+		}
+		return begin + "\n", end
+	}
+	if format == FormatMarkdown {
+		heading := fmt.Sprintf("## %s\n\n", entry.display)
+		if metadata != nil {
+			heading += metadataText(metadata) + "\n\n"
+		}
+		if entry.placeholder {
+			return heading, "\n"
+		}
+		fence := fenceFor(entry.backticks)
+		return heading + fence + languageFor(entry.display) + "\n", fence + "\n\n"
+	}
+	described := entry.display
+	if metadata != nil {
+		described += " | " + metadataText(metadata)
+	}
+	if opts.boundary != "" {
+		return fmt.Sprintf("--- %s BEGIN FILE: %s ---\n", opts.boundary, described), fmt.Sprintf("--- %s END FILE: %s ---\n\n", opts.boundary, entry.display)
+	}
+	return fmt.Sprintf("--- BEGIN FILE: %s ---\n", described), fmt.Sprintf("--- END FILE: %s ---\n\n", entry.display)
+}
+
+// metadataField is one item of a file's metadata.
+type metadataField struct {
+	key   string
+	value string
+}
+
+// fileMetadata lists the entry's metadata in output order. What is not known
+// is left out: the hash and line count of a file that was not read, the line
+// count of a binary file and a language weaver does not recognize.
+func fileMetadata(entry fileEntry) []metadataField {
+	fields := []metadataField{{key: "size", value: fmt.Sprint(entry.size)}}
+	if entry.sum != "" && !entry.binary {
+		fields = append(fields, metadataField{key: "lines", value: fmt.Sprint(entry.lines)})
+	}
+	if entry.sum != "" {
+		fields = append(fields, metadataField{key: "sha256", value: entry.sum})
+	}
+	if !entry.modTime.IsZero() {
+		fields = append(fields, metadataField{key: "mtime", value: entry.modTime.UTC().Format(time.RFC3339)})
+	}
+	fields = append(fields, metadataField{key: "mode", value: fmt.Sprintf("%04o", entry.mode.Perm())})
+	if language := languageFor(entry.display); language != "" {
+		fields = append(fields, metadataField{key: "language", value: language})
+	}
+	return fields
+}
+
+// metadataText writes metadata as space-separated key=value pairs.
+func metadataText(fields []metadataField) string {
+	pairs := make([]string, len(fields))
+	for i, field := range fields {
+		pairs[i] = field.key + "=" + field.value
+	}
+	return strings.Join(pairs, " ")
+}
+
+func escapeXML(text string) string {
+	var buf strings.Builder
+	_ = xml.EscapeText(&buf, []byte(text))
+	return buf.String()
+}
+
+// xmlContent makes file contents safe to place in a <document_content>
+// element, inside a CDATA section when cdata is set: sectionMarkers wraps any
+// body containing '<', '&' or "]]>" in one. Characters XML does not allow,
+// including invalid UTF-8, become U+FFFD, and sectionMarkers marks the
+// document lossy. A carriage return is written as a character reference, so
+// parsers do not turn CRLF line ends into LF, and every "]]>" is split across
+// two CDATA sections.
+func xmlContent(data []byte, cdata bool) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == utf8.RuneError && size <= 1, !xmlChar(r):
+			out = utf8.AppendRune(out, utf8.RuneError)
+		case r == '\r' && cdata:
+			out = append(out, "]]>&#xD;<![CDATA["...)
+		case r == '\r':
+			out = append(out, "&#xD;"...)
+		case r == ']' && bytes.HasPrefix(data, []byte("]]>")):
+			out = append(out, "]]]]><![CDATA[>"...)
+			size = 3
+		default:
+			out = append(out, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return out
+}
+
+// xmlLossy reports whether xmlContent replaces any of the contents.
+func (info contentInfo) xmlLossy() bool {
+	return info.invalidUTF8 || info.xmlInvalid
+}
+
+// xmlChar reports whether r may appear in an XML 1.0 document.
+func xmlChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		(r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// codeFence returns a backtick fence longer than any run of backticks in
+// body, so nothing inside can close the block early.
+func codeFence(body []byte) string {
+	return fenceFor(scanContent(body).backticks)
+}
+
+// fenceFor returns a backtick fence longer than a run of backticks.
+func fenceFor(backticks int) string {
+	return strings.Repeat("`", max(3, backticks+1))
+}
+
+// languages maps file extensions to the info strings of fenced code blocks.
+var languages = map[string]string{
+	".bash":       "bash",
+	".c":          "c",
+	".cc":         "cpp",
+	".clj":        "clojure",
+	".cpp":        "cpp",
+	".cs":         "csharp",
+	".css":        "css",
+	".dart":       "dart",
+	".diff":       "diff",
+	".ex":         "elixir",
+	".exs":        "elixir",
+	".go":         "go",
+	".gradle":     "groovy",
+	".graphql":    "graphql",
+	".h":          "c",
+	".hpp":        "cpp",
+	".hs":         "haskell",
+	".html":       "html",
+	".ini":        "ini",
+	".java":       "java",
+	".js":         "javascript",
+	".json":       "json",
+	".jsx":        "jsx",
+	".kt":         "kotlin",
+	".kts":        "kotlin",
+	".lua":        "lua",
+	".m":          "objectivec",
+	".md":         "markdown",
+	".mjs":        "javascript",
+	".php":        "php",
+	".pl":         "perl",
+	".proto":      "protobuf",
+	".ps1":        "powershell",
+	".py":         "python",
+	".r":          "r",
+	".rb":         "ruby",
+	".rs":         "rust",
+	".scala":      "scala",
+	".scss":       "scss",
+	".sh":         "bash",
+	".sql":        "sql",
+	".svelte":     "svelte",
+	".swift":      "swift",
+	".tf":         "hcl",
+	".toml":       "toml",
+	".ts":         "typescript",
+	".tsx":        "tsx",
+	".vue":        "vue",
+	".xml":        "xml",
+	".yaml":       "yaml",
+	".yml":        "yaml",
+	".zig":        "zig",
+	".zsh":        "zsh",
+	".dockerfile": "dockerfile",
+}
+
+// fileLanguages maps file names that have no telling extension.
+var fileLanguages = map[string]string{
+	"CMakeLists.txt": "cmake",
+	"Dockerfile":     "dockerfile",
+	"GNUmakefile":    "makefile",
+	"Makefile":       "makefile",
+}
+
+// languageFor infers a code block language from the file name, or returns ""
+// when it is unknown.
+func languageFor(display string) string {
+	name := path.Base(display)
+	if lang, ok := fileLanguages[name]; ok {
+		return lang
+	}
+	return languages[strings.ToLower(path.Ext(name))]
+}
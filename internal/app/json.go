@@ -0,0 +1,222 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/aatuh/weaver/internal/tree"
+)
+
+// jsonHeader describes the output in the json and jsonl formats. In jsonl it
+// is the first record, with Type "header".
+type jsonHeader struct {
+	Type            string      `json:"type,omitempty"`
+	Roots           []jsonRoot  `json:"roots"`
+	Profile         string      `json:"profile,omitempty"`
+	Mode            string      `json:"mode,omitempty"`
+	Files           int         `json:"files"`
+	SkippedOversize int         `json:"skipped_oversize,omitempty"`
+	Digest          string      `json:"digest,omitempty"`
+	Tokens          *int64      `json:"tokens,omitempty"`
+	Tokenizer       string      `json:"tokenizer,omitempty"`
+	Budget          *jsonBudget `json:"budget,omitempty"`
+	Generated       string      `json:"generated,omitempty"`
+	Tree            *tree.Node  `json:"tree,omitempty"`
+}
+
+type jsonRoot struct {
+	Path  string `json:"path"`
+	Label string `json:"label"`
+}
+
+type jsonBudget struct {
+	MaxBytes  int64           `json:"max_bytes,omitempty"`
+	MaxLines  int64           `json:"max_lines,omitempty"`
+	MaxTokens int64           `json:"max_tokens,omitempty"`
+	Policy    string          `json:"policy"`
+	Dropped   []string        `json:"dropped,omitempty"`
+	Truncated []jsonTruncated `json:"truncated,omitempty"`
+}
+
+type jsonTruncated struct {
+	Path string `json:"path"`
+	jsonLines
+}
+
+type jsonLines struct {
+	KeptLines  int `json:"kept_lines"`
+	TotalLines int `json:"total_lines"`
+}
+
+// jsonFile is one file in the json and jsonl formats. In jsonl it is a record
+// of its own, with Type "file". SHA256 and Binary are set when the contents
+// were read. Content is left out when the contents were skipped, and Omitted
+// says why when a placeholder would stand in for it in the other formats.
+type jsonFile struct {
+	Type      string     `json:"type,omitempty"`
+	Path      string     `json:"path"`
+	Root      string     `json:"root"`
+	Size      int64      `json:"size"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Binary    *bool      `json:"binary,omitempty"`
+	Encoding  string     `json:"encoding,omitempty"`
+	Content   *string    `json:"content,omitempty"`
+	Omitted   string     `json:"omitted,omitempty"`
+	Tokens    int64      `json:"tokens,omitempty"`
+	Truncated *jsonLines `json:"truncated,omitempty"`
+	// Lines, ModTime, Mode and Language are set with file metadata.
+	Lines    *int   `json:"lines,omitempty"`
+	ModTime  string `json:"mtime,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+func newJSONHeader(opts Options, count, skipped int, report budgetReport, digest, timestamp string, treeNode *tree.Node) jsonHeader {
+	header := jsonHeader{
+		Profile:         opts.Profile,
+		Mode:            opts.ModeLabel,
+		Files:           count,
+		SkippedOversize: skipped,
+		Digest:          digest,
+		Generated:       timestamp,
+		Tree:            treeNode,
+	}
+	for i, root := range opts.headerRoots() {
+		header.Roots = append(header.Roots, jsonRoot{Path: root, Label: opts.RootLabels[i]})
+	}
+	if opts.Tokens != nil {
+		tokens := report.tokens
+		header.Tokens = &tokens
+		header.Tokenizer = opts.Tokens.Name()
+	}
+	if opts.MaxBytes > 0 || opts.MaxLines > 0 || opts.MaxTokens > 0 {
+		header.Budget = &jsonBudget{
+			MaxBytes:  opts.MaxBytes,
+			MaxLines:  opts.MaxLines,
+			MaxTokens: opts.MaxTokens,
+			Policy:    opts.BudgetPolicy.String(),
+			Dropped:   report.dropped,
+		}
+		for _, t := range report.truncated {
+			header.Budget.Truncated = append(header.Budget.Truncated, jsonTruncated{Path: t.display, jsonLines: jsonLines{KeptLines: t.keptLines, TotalLines: t.totalLines}})
+		}
+	}
+	return header
+}
+
+// writeJSONPreamble writes the header, with the tree, and opens the files
+// array of the json format; in jsonl it writes the header record.
+func writeJSONPreamble(writer *bufio.Writer, format Format, header jsonHeader) error {
+	if format == FormatJSONL {
+		header.Type = "header"
+		payload, err := marshalJSON(header, "")
+		if err != nil {
+			return err
+		}
+		return writeString(writer, string(payload)+"\n")
+	}
+	payload, err := marshalJSON(header, "  ")
+	if err != nil {
+		return err
+	}
+	return writeString(writer, "{\n  \"header\": "+string(payload)+",\n  \"files\": [")
+}
+
+// jsonSection encodes the entry's file record, with the separator that
+// precedes it in the files array of the json format. When the contents are
+// streamed, the record holds contentSentinel in their place.
+func jsonSection(opts Options, entry fileEntry, streamed bool) ([]byte, error) {
+	format := opts.Format
+	file := jsonFile{
+		Path:   entry.display,
+		Root:   entry.label,
+		Size:   entry.size,
+		SHA256: entry.sum,
+		Tokens: entry.tokens,
+	}
+	if entry.sum != "" {
+		binary := entry.binary
+		file.Binary = &binary
+	}
+	switch {
+	case entry.oversized:
+		file.Omitted = "oversized"
+	case entry.placeholder:
+		file.Omitted = "binary"
+	case streamed:
+		// The caller streams the contents in place of the sentinel.
+		content := contentSentinel
+		file.Encoding = "utf-8"
+		if base64Content(entry) {
+			file.Encoding = "base64"
+		}
+		file.Content = &content
+	case entry.body != nil:
+		content := string(entry.body)
+		file.Encoding = "utf-8"
+		if base64Content(entry) {
+			content = base64.StdEncoding.EncodeToString(entry.body)
+			file.Encoding = "base64"
+		}
+		file.Content = &content
+	}
+	if entry.truncated != nil {
+		file.Truncated = &jsonLines{KeptLines: entry.truncated.keptLines, TotalLines: entry.truncated.totalLines}
+	}
+	if opts.FileMetadata {
+		for _, field := range fileMetadata(entry) {
+			switch field.key {
+			case "lines":
+				lines := entry.lines
+				file.Lines = &lines
+			case "mtime":
+				file.ModTime = field.value
+			case "mode":
+				file.Mode = field.value
+			case "language":
+				file.Language = field.value
+			}
+		}
+	}
+
+	if format == FormatJSONL {
+		file.Type = "file"
+		payload, err := marshalJSON(file, "")
+		if err != nil {
+			return nil, err
+		}
+		return append(payload, '\n'), nil
+	}
+	payload, err := marshalJSON(file, "    ")
+	if err != nil {
+		return nil, err
+	}
+	separator := ",\n    "
+	if entry.index == 1 {
+		separator = "\n    "
+	}
+	return append([]byte(separator), payload...), nil
+}
+
+// base64Content reports whether the entry's contents are written in base64:
+// binary files, and text that is not valid UTF-8 and so cannot be a JSON string.
+func base64Content(entry fileEntry) bool {
+	return entry.binary || entry.invalidUTF8
+}
+
+// marshalJSON encodes v without escaping '<', '>' and '&', indented with
+// prefix when prefix is not empty and on a single line otherwise.
+func marshalJSON(v any, prefix string) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if prefix != "" {
+		encoder.SetIndent(prefix, "  ")
+	}
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"bytes"
+
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+// bodyMeter counts the bytes, lines and tokens of what is written to it, so
+// a body can be measured as it streams past.
+type bodyMeter struct {
+	cost   budget
+	tokens *tokenizer.Stream
+}
+
+func newBodyMeter(counter tokenizer.Counter) *bodyMeter {
+	meter := &bodyMeter{}
+	if counter != nil {
+		meter.tokens = tokenizer.NewStream(counter)
+	}
+	return meter
+}
+
+func (m *bodyMeter) Write(p []byte) (int, error) {
+	m.cost.bytes += int64(len(p))
+	m.cost.lines += int64(bytes.Count(p, []byte{'\n'}))
+	if m.tokens != nil {
+		_, _ = m.tokens.Write(p)
+	}
+	return len(p), nil
+}
+
+// total returns the cost of everything written.
+func (m *bodyMeter) total() budget {
+	cost := m.cost
+	if m.tokens != nil {
+		cost.tokens = int64(m.tokens.Count())
+	}
+	return cost
+}
+
+// measureEntry sets what the entry's body adds to the output and its token
+// count. With Options.SkipContents nothing of the body is written, and the
+// file is read only to count its tokens.
+func (c Combiner) measureEntry(entry *fileEntry, opts Options, buf []byte) error {
+	if !opts.SkipContents {
+		return c.measureBody(entry, opts, buf)
+	}
+	if opts.Tokens == nil {
+		return nil
+	}
+	if !entry.oversized {
+		if err := c.scanFile(entry, buf); err != nil {
+			return err
+		}
+	}
+	entry.body, entry.placeholder = placeholderBody(opts, *entry)
+	if err := c.measureBody(entry, opts, buf); err != nil {
+		return err
+	}
+	entry.body, entry.bodyCost = nil, budget{}
+	return nil
+}
+
+// measureBody sets the entry's bodyCost and token count. The contents are
+// streamed as writeSection writes them, cut as the budget decided, so they
+// are never held in memory; a placeholder is measured as it is.
+func (c Combiner) measureBody(entry *fileEntry, opts Options, buf []byte) error {
+	if entry.body != nil {
+		entry.bodyCost, entry.tokens = measureText(opts, entry.body)
+		return nil
+	}
+	written := newBodyMeter(opts.Tokens)
+	if !opts.Format.structured() {
+		if err := c.streamBody(written, opts, *entry, buf, nil); err != nil {
+			return err
+		}
+		entry.bodyCost = written.total()
+		entry.tokens = entry.bodyCost.tokens
+		return nil
+	}
+	// A record's tokens are those of the contents, not of the string or the
+	// base64 that encodes them.
+	contents := newBodyMeter(opts.Tokens)
+	if err := c.streamBody(written, opts, *entry, buf, contents); err != nil {
+		return err
+	}
+	entry.bodyCost = written.total()
+	entry.tokens = contents.total().tokens
+	return nil
+}
+
+// measureText returns what a body held in memory adds to the output, and its
+// tokens.
+func measureText(opts Options, body []byte) (budget, int64) {
+	var tokens int64
+	if opts.Tokens != nil {
+		tokens = int64(opts.Tokens.Count(body))
+	}
+	if opts.Format.structured() {
+		cost := budget{bytes: escapedLen(body)}
+		if opts.Tokens != nil {
+			cost.tokens = escapedTokens(opts.Tokens, body)
+		}
+		return cost, tokens
+	}
+	return budget{bytes: int64(len(body)), lines: int64(bytes.Count(body, []byte{'\n'})), tokens: tokens}, tokens
+}
+
+// lineProfile describes the lines a cut may keep: the cost of each of a
+// body's first and last lines, as many from either end as fit in the whole
+// budget, since a cut never keeps more. It is read from the file the first
+// time a cut needs it, so only the bodies planning comes to cut are profiled.
+type lineProfile struct {
+	head []profiledLine
+	// tail is in file order.
+	tail []profiledLine
+	read func(*lineProfile) error
+	done bool
+	// err is the error reading the profile met, which fitBudget reports.
+	err error
+}
+
+// profiledLine is a line's offsets in the file and what it adds to the body.
+type profiledLine struct {
+	start int64
+	end   int64
+	cost  budget
+}
+
+// load reads the profile unless it was read already.
+func (p *lineProfile) load() *lineProfile {
+	if !p.done {
+		p.done = true
+		p.err = p.read(p)
+	}
+	return p
+}
+
+// next returns the line a cut that kept head and tail lines takes next: from
+// the start while it kept no more there than at the end, and otherwise from
+// the end. It reports false past the lines profiled.
+func (p *lineProfile) next(head, tail int) (profiledLine, bool) {
+	if head <= tail {
+		if head < len(p.head) {
+			return p.head[head], true
+		}
+		return profiledLine{}, false
+	}
+	if tail < len(p.tail) {
+		return p.tail[len(p.tail)-1-tail], true
+	}
+	return profiledLine{}, false
+}
+
+// newLineProfile returns the profile of the entry's lines within limit,
+// unread. counter, when set, counts the tokens of each line.
+func (c Combiner) newLineProfile(entry fileEntry, opts Options, limit budget, counter tokenizer.Counter) *lineProfile {
+	return &lineProfile{read: func(p *lineProfile) error {
+		profiler := &lineProfiler{opts: opts, entry: entry, limit: limit, counter: counter}
+		if err := c.copyUnchanged(profiler, entry, make([]byte, copyBufferSize)); err != nil {
+			return err
+		}
+		profiler.finish()
+		p.head, p.tail = profiler.head, profiler.tail
+		return nil
+	}}
+}
+
+// lineProfiler gathers a lineProfile from contents written to it in chunks,
+// holding only the current line and the lines profiled.
+type lineProfiler struct {
+	opts    Options
+	entry   fileEntry
+	limit   budget
+	counter tokenizer.Counter
+
+	head     []profiledLine
+	tail     []profiledLine
+	headCost budget
+	tailCost budget
+	headFull bool
+	line     []byte
+	offset   int64
+}
+
+func (p *lineProfiler) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			break
+		}
+		p.line = append(p.line, b[:i+1]...)
+		p.add(p.line, len(p.line))
+		p.line = p.line[:0]
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+// finish profiles a last line without a newline, which the formats other
+// than the structured ones end with one.
+func (p *lineProfiler) finish() {
+	if len(p.line) == 0 {
+		return
+	}
+	size := len(p.line)
+	if !p.opts.Format.structured() {
+		p.line = append(p.line, '\n')
+	}
+	p.add(p.line, size)
+}
+
+// add profiles a line that takes size bytes of the file. Lines are kept from
+// the start while they fit in the limit together, and from the end by
+// dropping the earliest until the rest do.
+func (p *lineProfiler) add(line []byte, size int) {
+	profiled := profiledLine{start: p.offset, end: p.offset + int64(size), cost: p.lineCost(line)}
+	p.offset = profiled.end
+	if !p.headFull {
+		if next := p.headCost.add(profiled.cost); next.fits(p.limit) {
+			p.head = append(p.head, profiled)
+			p.headCost = next
+		} else {
+			p.headFull = true
+		}
+	}
+	p.tail = append(p.tail, profiled)
+	p.tailCost = p.tailCost.add(profiled.cost)
+	for len(p.tail) > 0 && !p.tailCost.fits(p.limit) {
+		p.tailCost = p.tailCost.sub(p.tail[0].cost)
+		p.tail = p.tail[1:]
+	}
+}
+
+// lineCost is what a line of the contents adds to the body: its encoded
+// bytes and, outside a JSON string, a line.
+func (p *lineProfiler) lineCost(line []byte) budget {
+	if p.opts.Format.structured() {
+		cost := budget{bytes: escapedLen(line)}
+		if p.counter != nil {
+			cost.tokens = escapedTokens(p.counter, line)
+		}
+		return cost
+	}
+	if p.opts.Format == FormatXML {
+		line = xmlContent(line, p.entry.xmlSpecial)
+	}
+	cost := budget{bytes: int64(len(line)), lines: 1}
+	if p.counter != nil {
+		cost.tokens = int64(p.counter.Count(line))
+	}
+	return cost
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// prefetchLimit is the largest file whose section is prepared ahead of the
+// writer when files are read in parallel. Larger files are streamed when
+// their turn comes, so memory stays bounded by the number of jobs.
+const prefetchLimit = 1 << 20
+
+// jobCount returns how many files are read at once.
+func jobCount(opts Options) int {
+	return max(opts.Jobs, 1)
+}
+
+// forEachEntry calls fn for the indexes 0 to n-1 on up to jobs goroutines,
+// each with its own copy buffer, claiming indexes in order. fn must touch
+// only what belongs to its index. After a failure no further index is
+// claimed, and the error returned is the one a sequential run would have met:
+// that of the lowest failed index, since every lower index was claimed before
+// it and runs to completion.
+func forEachEntry(ctx context.Context, jobs, n int, fn func(i int, buf []byte) error) error {
+	errs := make([]error, n)
+	var next atomic.Int64
+	var failed atomic.Bool
+	work := func() {
+		buf := make([]byte, copyBufferSize)
+		for !failed.Load() {
+			i := int(next.Add(1) - 1)
+			if i >= n {
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				failed.Store(true)
+				return
+			}
+			if err := fn(i, buf); err != nil {
+				errs[i] = err
+				failed.Store(true)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 1; w < min(jobs, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preparedSection is a section rendered ahead of the writer. inline marks an
+// entry the writer renders itself: a loaded body, or a file too large to
+// prefetch.
+type preparedSection struct {
+	data   []byte
+	inline bool
+	err    error
+}
+
+// writeSections writes every entry's section in order. With more than one
+// job, workers read the files of the sections ahead of the writer, at most
+// two per job, while the writer copies finished ones to the output.
+func (c Combiner) writeSections(ctx context.Context, writer *bufio.Writer, opts Options, entries []fileEntry) error {
+	jobs := jobCount(opts)
+	buf := make([]byte, copyBufferSize)
+	if jobs == 1 {
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := c.writeSection(writer, opts, entry, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make([]chan preparedSection, len(entries))
+	for i := range results {
+		results[i] = make(chan preparedSection, 1)
+	}
+	slots := make(chan struct{}, 2*jobs)
+	work := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		for i := range entries {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case work <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, copyBufferSize)
+			for i := range work {
+				results[i] <- c.prepareSection(opts, entries[i], buf)
+			}
+		}()
+	}
+
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var section preparedSection
+		select {
+		case section = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-slots
+		switch {
+		case section.err != nil:
+			return section.err
+		case section.inline:
+			if err := c.writeSection(writer, opts, entry, buf); err != nil {
+				return err
+			}
+		default:
+			if _, err := writer.Write(section.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepareSection renders the section of a streamed entry small enough to be
+// held in memory.
+func (c Combiner) prepareSection(opts Options, entry fileEntry, buf []byte) preparedSection {
+	streamed := entry.body == nil && !opts.SkipContents
+	if !streamed || entry.oversized || entry.size > prefetchLimit {
+		return preparedSection{inline: true}
+	}
+	var rendered bytes.Buffer
+	sectionWriter := bufio.NewWriter(&rendered)
+	if err := c.writeSection(sectionWriter, opts, entry, buf); err != nil {
+		return preparedSection{err: err}
+	}
+	if err := sectionWriter.Flush(); err != nil {
+		return preparedSection{err: err}
+	}
+	return preparedSection{data: rendered.Bytes()}
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aatuh/weaver/internal/adapters/fs"
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+// slowFS delays every read, the earlier files in the walk the longer, so that
+// parallel reads finish out of order.
+type slowFS struct {
+	fs.OSFS
+	delay time.Duration
+}
+
+func (f slowFS) wait(path string) {
+	n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if err == nil {
+		time.Sleep(f.delay * time.Duration(100-n%100) / 100)
+	}
+}
+
+func (f slowFS) ReadFile(path string) ([]byte, error) {
+	f.wait(path)
+	return f.OSFS.ReadFile(path)
+}
+
+func (f slowFS) Open(path string) (iofs.File, error) {
+	f.wait(path)
+	return f.OSFS.Open(path)
+}
+
+// writeNumberedFiles writes count files named by their number, with contents
+// that exercise every format: markers, fences, XML specials, binary data and
+// a file larger than the prefetch limit.
+func writeNumberedFiles(t testing.TB, count int) string {
+	t.Helper()
+	files := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		var content string
+		switch i % 5 {
+		case 0:
+			content = fmt.Sprintf("file %d\n", i)
+		case 1:
+			content = strings.Repeat(fmt.Sprintf("line %d <&> ]]> ```\n", i), i)
+		case 2:
+			content = fmt.Sprintf("--- END FILE: %d ---", i)
+		case 3:
+			content = fmt.Sprintf("\x00\x01binary %d", i)
+		case 4:
+			content = strings.Repeat("é", i)
+		}
+		if i == count/2 {
+			content = strings.Repeat(strings.Repeat("x", 1023)+"\n", prefetchLimit/1024+1)
+		}
+		files[fmt.Sprintf("d%d/%03d.txt", i%3, i)] = content
+	}
+	root := t.TempDir()
+	writeFiles(t, root, files)
+	return root
+}
+
+func TestCombinerJobsKeepOutputOrder(t *testing.T) {
+	root := writeNumberedFiles(t, 60)
+	combine := func(opts Options, jobs int) string {
+		t.Helper()
+		var buf bytes.Buffer
+		opts.Output = &buf
+		opts.Jobs = jobs
+		combiner := Combiner{
+			FS:     fs.OSFS{},
+			Clock:  fixedClock,
+			Random: bytes.NewReader(make([]byte, 12)),
+		}
+		if jobs > 1 {
+			combiner.FS = slowFS{delay: 200 * time.Microsecond}
+		}
+		if err := combiner.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("combine with %d jobs: %v", jobs, err)
+		}
+		return buf.String()
+	}
+
+	for _, format := range []Format{FormatText, FormatMarkdown, FormatXML, FormatJSON, FormatJSONL} {
+		variants := map[string]func(*Options){
+			"streamed": func(*Options) {},
+			"budgeted": func(opts *Options) {
+				opts.MaxBytes = 1 << 30
+				opts.Tokens = tokenizer.Heuristic{}
+			},
+			"truncated": func(opts *Options) {
+				opts.MaxLines = 800
+				opts.BudgetPolicy = BudgetTruncate
+				opts.SkipBinary = true
+			},
+		}
+		for name, configure := range variants {
+			opts := rootOptions(root)
+			opts.Format = format
+			configure(&opts)
+			want := combine(opts, 1)
+			for _, jobs := range []int{3, 64} {
+				if got := combine(opts, jobs); got != want {
+					t.Fatalf("%s %s: output with %d jobs differs from a sequential run", format, name, jobs)
+				}
+			}
+		}
+	}
+}
+
+func TestForEachEntryReportsTheFirstErrorInOrder(t *testing.T) {
+	for _, jobs := range []int{1, 4, 32} {
+		var calls atomic.Int64
+		err := forEachEntry(context.Background(), jobs, 100, func(i int, buf []byte) error {
+			calls.Add(1)
+			if len(buf) != copyBufferSize {
+				return fmt.Errorf("buffer of %d bytes", len(buf))
+			}
+			// The later failure happens first.
+			switch i {
+			case 10:
+				time.Sleep(5 * time.Millisecond)
+				return fmt.Errorf("entry %d", i)
+			case 12:
+				return fmt.Errorf("entry %d", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "entry 10" {
+			t.Fatalf("%d jobs: expected the error of entry 10, got %v", jobs, err)
+		}
+		if n := calls.Load(); n < 11 || n >= 100 {
+			t.Fatalf("%d jobs: expected the work to stop after the failure, got %d calls", jobs, n)
+		}
+	}
+}
+
+// cancelingFS cancels the run when the named file is read.
+type cancelingFS struct {
+	fs.OSFS
+	name   string
+	cancel context.CancelFunc
+	reads  *atomic.Int64
+}
+
+func (f cancelingFS) Open(path string) (iofs.File, error) {
+	f.reads.Add(1)
+	if filepath.Base(path) == f.name {
+		f.cancel()
+	}
+	return f.OSFS.Open(path)
+}
+
+func TestCombinerJobsStopWhenCanceled(t *testing.T) {
+	root := writeNumberedFiles(t, 200)
+	for _, jobs := range []int{1, 8} {
+		ctx, cancel := context.WithCancel(context.Background())
+		reads := new(atomic.Int64)
+		var buf bytes.Buffer
+		combiner := Combiner{FS: cancelingFS{name: "000.txt", cancel: cancel, reads: reads}}
+		opts := rootOptions(root)
+		opts.Output = &buf
+		opts.Jobs = jobs
+		err := combiner.Combine(ctx, opts)
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%d jobs: expected the run to be canceled, got %v", jobs, err)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d jobs: expected nothing to be written, got %d bytes", jobs, buf.Len())
+		}
+		if n := reads.Load(); n > int64(1+2*jobs) {
+			t.Fatalf("%d jobs: expected reading to stop soon after the cancel, got %d reads", jobs, n)
+		}
+	}
+}
+
+// BenchmarkCombineJobs combines files from a filesystem where every read
+// waits, as on a network filesystem.
+func BenchmarkCombineJobs(b *testing.B) {
+	root := writeNumberedFiles(b, 200)
+	for _, jobs := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			combiner := Combiner{FS: slowFS{delay: 200 * time.Microsecond}}
+			opts := rootOptions(root)
+			opts.Jobs = jobs
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				opts.Output = &buf
+				if err := combiner.Combine(context.Background(), opts); err != nil {
+					b.Fatalf("combine: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ParsedFile is a file read back from a combined output.
+type ParsedFile struct {
+	// Path is the display path, prefixed by the root label in multi-root runs.
+	Path    string
+	Content []byte
+	// SHA256 is the hash of the file's contents when the output was made,
+	// if the output carries file metadata or is in a structured format.
+	SHA256 string
+	// Omitted says why Content is not the file's contents: "binary",
+	// "oversized", "truncated", "dropped", "lossy" or "skipped". It is empty
+	// for complete files.
+	Omitted string
+}
+
+// Intact reports whether Content hashes to SHA256, or true when the output
+// carries no hash for the file.
+func (f ParsedFile) Intact() bool {
+	return f.SHA256 == "" || hashHex(f.Content) == f.SHA256
+}
+
+// Parsed is a combined output read back into its files.
+type Parsed struct {
+	Format Format
+	Files  []ParsedFile
+}
+
+// Parse reads a combined output in any format, detected from its first line.
+// The text formats add a final newline to files that lack one, which Parse
+// removes again only when file metadata shows the hash of the original; the
+// JSON formats keep contents exactly.
+func Parse(data []byte) (Parsed, error) {
+	var (
+		files []ParsedFile
+		err   error
+	)
+	format := DetectFormat(data)
+	switch format {
+	case FormatText:
+		files, err = parseText(data)
+	case FormatMarkdown:
+		files, err = parseMarkdown(data)
+	case FormatXML:
+		files, err = parseXML(data)
+	case FormatJSON:
+		files, err = parseJSON(data)
+	case FormatJSONL:
+		files, err = parseJSONL(data)
+	default:
+		return Parsed{}, fmt.Errorf("not a weaver output")
+	}
+	if err != nil {
+		return Parsed{}, fmt.Errorf("parse %s output: %w", format, err)
+	}
+	return Parsed{Format: format, Files: files}, nil
+}
+
+// DetectFormat identifies the format of a combined output, or returns -1.
+func DetectFormat(data []byte) Format {
+	switch {
+	case bytes.HasPrefix(data, []byte("# Weaver Combined File\n\n")):
+		return FormatMarkdown
+	case bytes.HasPrefix(data, []byte("# Weaver Combined File\n")):
+		return FormatText
+	case bytes.HasPrefix(data, []byte("<documents>\n")):
+		return FormatXML
+	case bytes.HasPrefix(data, []byte(`{"type":"header",`)):
+		return FormatJSONL
+	case bytes.HasPrefix(data, []byte("{\n  \"header\": ")):
+		return FormatJSON
+	}
+	return -1
+}
+
+var (
+	metadataSuffix = regexp.MustCompile(` \| (size=\d+(?: [a-z0-9]+=\S*)*)$`)
+	metadataLine   = regexp.MustCompile(`^size=\d+(?: [a-z0-9]+=\S*)*\n$`)
+	oversizedBody  = regexp.MustCompile(`^\[content omitted: .+ exceeds the .+ limit\]\n$`)
+	truncatedItem  = regexp.MustCompile(`^(.*) \(kept \d+ of \d+ lines\)$`)
+)
+
+// placeholderReason tells a placeholder body from file contents in the
+// marker-based formats.
+func placeholderReason(body []byte) string {
+	switch {
+	case string(body) == "[binary content omitted]\n":
+		return "binary"
+	case oversizedBody.Match(body):
+		return "oversized"
+	}
+	return ""
+}
+
+// budgetLists names the files a budget dropped or truncated, as the header
+// lists them.
+type budgetLists struct {
+	dropped   []string
+	truncated []string
+}
+
+// headerBudgetLists reads the dropped and truncated files from the header of
+// the marker-based formats, whose fields start at line start. field and item
+// are the prefixes of a field line and of a list item.
+func headerBudgetLists(all []string, start int, field, item string) budgetLists {
+	var (
+		lists budgetLists
+		list  *[]string
+	)
+	for _, line := range all[min(start, len(all)):] {
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return lists
+		case strings.HasPrefix(line, item) && list != nil:
+			*list = append(*list, strings.TrimPrefix(line, item))
+		case strings.HasPrefix(line, field+"Dropped to fit the budget:"):
+			list = &lists.dropped
+		case strings.HasPrefix(line, field+"Truncated to fit the budget:"):
+			list = &lists.truncated
+		default:
+			list = nil
+		}
+	}
+	return lists
+}
+
+// apply marks the truncated files and adds the dropped ones, which have no
+// contents in the output.
+func (b budgetLists) apply(files []ParsedFile) []ParsedFile {
+	truncated := make(map[string]bool, len(b.truncated))
+	for _, item := range b.truncated {
+		if match := truncatedItem.FindStringSubmatch(item); match != nil {
+			item = match[1]
+		}
+		truncated[item] = true
+	}
+	for i := range files {
+		if truncated[files[i].Path] {
+			files[i].Omitted = "truncated"
+		}
+	}
+	for _, display := range b.dropped {
+		files = append(files, ParsedFile{Path: display, Omitted: "dropped"})
+	}
+	return files
+}
+
+// lines splits data after each newline.
+func lines(data []byte) []string {
+	return strings.SplitAfter(string(data), "\n")
+}
+
+func parseText(data []byte) ([]ParsedFile, error) {
+	all := lines(data)
+	begin, end := "--- BEGIN FILE: ", "--- END FILE: "
+	i := 0
+	for ; i < len(all) && strings.HasPrefix(all[i], "#"); i++ {
+		if boundary, ok := strings.CutPrefix(all[i], "# Boundary: "); ok {
+			boundary = strings.TrimSuffix(boundary, "\n")
+			begin, end = "--- "+boundary+" BEGIN FILE: ", "--- "+boundary+" END FILE: "
+		}
+	}
+
+	var files []ParsedFile
+	for ; i < len(all); i++ {
+		line := all[i]
+		if strings.HasPrefix(line, "--- BEGIN FILE TREE") {
+			for i < len(all) && !strings.HasPrefix(all[i], "--- END FILE TREE") {
+				i++
+			}
+			continue
+		}
+		display, ok := markerPath(line, begin)
+		if !ok {
+			continue
+		}
+		metadata := ""
+		if match := metadataSuffix.FindStringSubmatchIndex(display); match != nil {
+			display, metadata = display[:match[0]], display[match[2]:match[3]]
+		}
+		closing := end + display + " ---\n"
+		var body strings.Builder
+		for i++; i < len(all) && all[i] != closing; i++ {
+			body.WriteString(all[i])
+		}
+		if i == len(all) {
+			return nil, fmt.Errorf("%s has no end marker", display)
+		}
+		files = append(files, newParsedFile(display, []byte(body.String()), metadataSum(metadata)))
+	}
+	return headerBudgetLists(all, 1, "# ", "# - ").apply(files), nil
+}
+
+// metadataSum returns the sha256 value in key=value file metadata.
+func metadataSum(metadata string) string {
+	for _, pair := range strings.Fields(metadata) {
+		if sum, ok := strings.CutPrefix(pair, "sha256="); ok {
+			return sum
+		}
+	}
+	return ""
+}
+
+// markerPath returns the path in a marker line with the given prefix.
+func markerPath(line, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(line, prefix)
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rest, " ---\n")
+}
+
+// newParsedFile reads a file from a marker-based format. The newline the
+// format added to a file without one is dropped when the hash shows it. A body
+// that matches the hash is the file's contents even when it reads like a
+// placeholder.
+func newParsedFile(display string, body []byte, sum string) ParsedFile {
+	file := ParsedFile{Path: display, Content: body, SHA256: sum}
+	if sum != "" {
+		if hashHex(body) == sum {
+			return file
+		}
+		if trimmed, ok := bytes.CutSuffix(body, []byte{'\n'}); ok && hashHex(trimmed) == sum {
+			file.Content = trimmed
+			return file
+		}
+	}
+	file.Omitted = placeholderReason(body)
+	return file
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var fenceLine = regexp.MustCompile("^(`{3,})[^`\n]*\n$")
+
+func parseMarkdown(data []byte) ([]ParsedFile, error) {
+	all := lines(data)
+	var files []ParsedFile
+	for i := 0; i < len(all); i++ {
+		display, ok := strings.CutPrefix(all[i], "## ")
+		if !ok {
+			continue
+		}
+		display = strings.TrimSuffix(display, "\n")
+		// A heading is followed by a blank line, the file metadata and another
+		// blank line when present, then a fenced block or a placeholder line.
+		if i+2 >= len(all) || all[i+1] != "\n" {
+			return nil, fmt.Errorf("%s has no contents", display)
+		}
+		i += 2
+		sum := ""
+		if metadataLine.MatchString(all[i]) && i+2 < len(all) && all[i+1] == "\n" {
+			sum = metadataSum(all[i])
+			i += 2
+		}
+		fence := fenceLine.FindStringSubmatch(all[i])
+		if fence == nil {
+			files = append(files, newParsedFile(display, []byte(all[i]), sum))
+			continue
+		}
+		if len(files) == 0 && (display == "File tree" || display == "File tree (compact)") && all[i] == fence[1]+"json\n" {
+			for i++; i < len(all) && all[i] != fence[1]+"\n"; i++ {
+			}
+			continue
+		}
+		var body strings.Builder
+		for i++; i < len(all) && all[i] != fence[1]+"\n"; i++ {
+			body.WriteString(all[i])
+		}
+		if i == len(all) {
+			return nil, fmt.Errorf("%s has no closing fence", display)
+		}
+		files = append(files, newParsedFile(display, []byte(body.String()), sum))
+	}
+	return headerBudgetLists(all, 2, "- ", "  - ").apply(files), nil
+}
+
+func parseXML(data []byte) ([]ParsedFile, error) {
+	var documents struct {
+		Header struct {
+			Dropped   []string `xml:"dropped>file"`
+			Truncated []string `xml:"truncated>file"`
+		} `xml:"header"`
+		Documents []struct {
+			SHA256  string `xml:"sha256,attr"`
+			Lossy   bool   `xml:"lossy,attr"`
+			Source  string `xml:"source"`
+			Content string `xml:"document_content"`
+		} `xml:"document"`
+	}
+	if err := xml.Unmarshal(data, &documents); err != nil {
+		return nil, err
+	}
+	files := make([]ParsedFile, 0, len(documents.Documents))
+	for _, document := range documents.Documents {
+		// The content starts on the line after the opening tag.
+		body := strings.TrimPrefix(document.Content, "\n")
+		file := newParsedFile(document.Source, []byte(body), document.SHA256)
+		if document.Lossy && file.Omitted == "" {
+			// Characters XML cannot hold were replaced in the contents.
+			file.Omitted = "lossy"
+		}
+		files = append(files, file)
+	}
+	return budgetLists{dropped: documents.Header.Dropped, truncated: documents.Header.Truncated}.apply(files), nil
+}
+
+func parseJSON(data []byte) ([]ParsedFile, error) {
+	var document struct {
+		Header jsonHeader `json:"header"`
+		Files  []jsonFile `json:"files"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	files := make([]ParsedFile, 0, len(document.Files))
+	for _, record := range document.Files {
+		file, err := parsedRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return jsonBudgetLists(document.Header).apply(files), nil
+}
+
+// jsonBudgetLists returns the files a JSON header lists as dropped. Truncated
+// files are marked in their own records.
+func jsonBudgetLists(header jsonHeader) budgetLists {
+	if header.Budget == nil {
+		return budgetLists{}
+	}
+	return budgetLists{dropped: header.Budget.Dropped}
+}
+
+func parseJSONL(data []byte) ([]ParsedFile, error) {
+	var (
+		files []ParsedFile
+		lists budgetLists
+	)
+	for n, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var record jsonFile
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if record.Type == "header" {
+			var header jsonHeader
+			if err := json.Unmarshal(line, &header); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			lists = jsonBudgetLists(header)
+		}
+		if record.Type != "file" {
+			continue
+		}
+		file, err := parsedRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return lists.apply(files), nil
+}
+
+func parsedRecord(record jsonFile) (ParsedFile, error) {
+	file := ParsedFile{Path: record.Path, SHA256: record.SHA256, Omitted: record.Omitted}
+	switch {
+	case record.Content == nil:
+		if file.Omitted == "" {
+			file.Omitted = "skipped"
+		}
+	case record.Encoding == "base64":
+		content, err := base64.StdEncoding.DecodeString(*record.Content)
+		if err != nil {
+			return ParsedFile{}, fmt.Errorf("%s: %w", record.Path, err)
+		}
+		file.Content = content
+	default:
+		file.Content = []byte(*record.Content)
+	}
+	if record.Truncated != nil {
+		file.Omitted = "truncated"
+	}
+	return file, nil
+}
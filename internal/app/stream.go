@@ -0,0 +1,402 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// copyBufferSize is the size of the buffer each file is read through.
+const copyBufferSize = 32 * 1024
+
+// binarySampleSize is how much of the start of a file is sniffed to decide
+// whether it is binary.
+const binarySampleSize = 8000
+
+// contentInfo describes a file's contents. It is gathered in one pass over
+// them, so that files can be written without holding them in memory.
+type contentInfo struct {
+	sum    string
+	lines  int
+	binary bool
+	// invalidUTF8 is set when the contents are not valid UTF-8.
+	invalidUTF8 bool
+	// markerLine is set when a line starts like a text format file marker.
+	markerLine bool
+	// backticks is the longest run of backticks.
+	backticks int
+	// xmlSpecial is set when the contents hold '<', '&' or "]]>", which
+	// need a CDATA section in the XML format.
+	xmlSpecial bool
+	// xmlInvalid is set when the contents hold characters XML 1.0 does not
+	// allow besides invalid UTF-8: control characters other than tab, line
+	// feed and carriage return, U+FFFE or U+FFFF.
+	xmlInvalid bool
+	// newlineEnd is set when the contents end with a newline.
+	newlineEnd bool
+}
+
+// contentScanner gathers the contentInfo of contents written to it in chunks
+// of any size, keeping only a bounded amount of them.
+type contentScanner struct {
+	hash   hash.Hash
+	size   int64
+	info   contentInfo
+	sample []byte
+	// utf8Tail holds the start of a rune cut off by the end of a chunk.
+	utf8Tail []byte
+	// line holds the start of the current line, up to the marker length, and
+	// lineLen counts its bytes.
+	line     [14]byte
+	lineLen  int
+	run      int
+	brackets int
+	// nonchar counts the bytes of a U+FFFE or U+FFFF seen so far.
+	nonchar int
+	last    byte
+}
+
+func newContentScanner() *contentScanner {
+	return &contentScanner{hash: sha256.New()}
+}
+
+func (s *contentScanner) Write(p []byte) (int, error) {
+	s.hash.Write(p)
+	s.size += int64(len(p))
+	if len(s.sample) < binarySampleSize {
+		s.sample = append(s.sample, p[:min(len(p), binarySampleSize-len(s.sample))]...)
+	}
+	s.checkUTF8(p)
+	for _, c := range p {
+		switch c {
+		case '\n':
+			s.info.lines++
+			s.lineLen = 0
+		case '`':
+			s.run++
+			s.info.backticks = max(s.info.backticks, s.run)
+		case '<', '&':
+			s.info.xmlSpecial = true
+		case '>':
+			if s.brackets >= 2 {
+				s.info.xmlSpecial = true
+			}
+		}
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			s.info.xmlInvalid = true
+		}
+		s.checkNonchar(c)
+		if c != '`' {
+			s.run = 0
+		}
+		if c == ']' {
+			s.brackets++
+		} else {
+			s.brackets = 0
+		}
+		if c != '\n' {
+			if s.lineLen < len(s.line) {
+				s.line[s.lineLen] = c
+				s.lineLen++
+				s.checkMarker()
+			}
+		}
+	}
+	if len(p) > 0 {
+		s.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
+
+// checkNonchar notes the encoding of U+FFFE or U+FFFF, EF BF BE or EF BF BF,
+// which may be cut across chunks.
+func (s *contentScanner) checkNonchar(c byte) {
+	switch {
+	case s.nonchar == 2 && (c == 0xBE || c == 0xBF):
+		s.info.xmlInvalid = true
+		s.nonchar = 0
+	case c == 0xEF:
+		s.nonchar = 1
+	case s.nonchar == 1 && c == 0xBF:
+		s.nonchar = 2
+	default:
+		s.nonchar = 0
+	}
+}
+
+// checkMarker notes a line that has just grown to start like a marker.
+func (s *contentScanner) checkMarker() {
+	prefix := s.line[:s.lineLen]
+	if string(prefix) == "--- BEGIN FILE" || string(prefix) == "--- END FILE" {
+		s.info.markerLine = true
+	}
+}
+
+// checkUTF8 validates p, carrying a rune cut off at its end over to the
+// next chunk.
+func (s *contentScanner) checkUTF8(p []byte) {
+	if s.info.invalidUTF8 {
+		return
+	}
+	if len(s.utf8Tail) > 0 {
+		// Finish the rune the last chunk cut off.
+		joined := append(s.utf8Tail, p[:min(len(p), utf8.UTFMax)]...)
+		if !utf8.FullRune(joined) {
+			s.utf8Tail = joined
+			return
+		}
+		r, size := utf8.DecodeRune(joined)
+		if r == utf8.RuneError && size == 1 {
+			s.info.invalidUTF8 = true
+			return
+		}
+		p = p[size-len(s.utf8Tail):]
+		s.utf8Tail = nil
+	}
+	complete, tail := splitRuneTail(p)
+	if !utf8.Valid(complete) {
+		s.info.invalidUTF8 = true
+		return
+	}
+	s.utf8Tail = append([]byte(nil), tail...)
+}
+
+// finish returns the contentInfo of everything written.
+func (s *contentScanner) finish() contentInfo {
+	info := s.info
+	info.sum = hex.EncodeToString(s.hash.Sum(nil))
+	info.binary = isLikelyBinary(s.sample)
+	if len(s.utf8Tail) > 0 {
+		info.invalidUTF8 = true
+	}
+	if s.size > 0 && s.last != '\n' {
+		info.lines++
+	}
+	info.newlineEnd = s.size > 0 && s.last == '\n'
+	if info.binary {
+		info.lines = 0
+	}
+	return info
+}
+
+// scanContent returns the contentInfo of contents held in memory.
+func scanContent(data []byte) contentInfo {
+	scanner := newContentScanner()
+	_, _ = scanner.Write(data)
+	return scanner.finish()
+}
+
+// splitRuneTail splits off the start of a UTF-8 sequence that p ends in the
+// middle of, if any.
+func splitRuneTail(p []byte) ([]byte, []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], p[i:]
+			}
+			break
+		}
+	}
+	return p, nil
+}
+
+// scanFile reads the entry's file once to gather its contentInfo and size.
+func (c Combiner) scanFile(entry *fileEntry, buf []byte) error {
+	scanner := newContentScanner()
+	if err := c.copyFile(scanner, *entry, buf); err != nil {
+		return err
+	}
+	entry.contentInfo = scanner.finish()
+	entry.size = scanner.size
+	return nil
+}
+
+// copyFile copies the entry's file to w through buf.
+func (c Combiner) copyFile(w io.Writer, entry fileEntry, buf []byte) error {
+	fullPath := filepath.Join(entry.root, filepath.FromSlash(entry.rel))
+	file, err := c.FS.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", entry.display, err)
+	}
+	defer file.Close()
+	// Hiding WriteTo and ReadFrom keeps io.CopyBuffer to the buffer given.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{file}, buf); err != nil {
+		return fmt.Errorf("read %s: %w", entry.display, err)
+	}
+	return nil
+}
+
+// streamBody writes the entry's contents straight from its file to w, encoded
+// for the format and cut as the budget decided, checking that the file did
+// not change since it was scanned. contents, when not nil, also receives the
+// contents before they are encoded.
+func (c Combiner) streamBody(w io.Writer, opts Options, entry fileEntry, buf []byte, contents io.Writer) error {
+	out := w
+	var flush func() error
+	switch {
+	case opts.Format.structured() && base64Content(entry):
+		encoder := base64.NewEncoder(base64.StdEncoding, w)
+		out, flush = encoder, encoder.Close
+	case opts.Format.structured():
+		encoder := &jsonStringWriter{w: w}
+		out, flush = encoder, encoder.Close
+	case opts.Format == FormatXML:
+		encoder := &xmlWriter{w: w, cdata: entry.xmlSpecial}
+		out, flush = encoder, encoder.Close
+	}
+	in := out
+	if contents != nil {
+		in = io.MultiWriter(contents, out)
+	}
+	cut := entry.truncated
+	if cut != nil {
+		in = &cutWriter{w: in, headEnd: cut.headEnd, tailStart: cut.tailStart, marker: omittedMarker(cut.totalLines-cut.keptLines, cut.totalLines)}
+	}
+	if err := c.copyUnchanged(in, entry, buf); err != nil {
+		return err
+	}
+	// Only the structured formats keep contents without a final newline. A
+	// cut that kept no tail already ends with its marker's.
+	if !opts.Format.structured() && !entry.newlineEnd && (cut == nil || cut.tailStart < entry.size) {
+		if _, err := out.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	if flush != nil {
+		return flush()
+	}
+	return nil
+}
+
+// copyUnchanged copies the entry's file to w through buf, failing when the
+// file changed since it was scanned.
+func (c Combiner) copyUnchanged(w io.Writer, entry fileEntry, buf []byte) error {
+	check := sha256.New()
+	if err := c.copyFile(io.MultiWriter(check, w), entry, buf); err != nil {
+		return err
+	}
+	if hex.EncodeToString(check.Sum(nil)) != entry.sum {
+		return fmt.Errorf("read %s: file changed while it was being combined", entry.display)
+	}
+	return nil
+}
+
+// cutWriter writes contents written to it in chunks to w, leaving out the
+// bytes from headEnd to tailStart and writing marker in their place.
+type cutWriter struct {
+	w         io.Writer
+	headEnd   int64
+	tailStart int64
+	marker    string
+	offset    int64
+	marked    bool
+}
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	start, end := c.offset, c.offset+int64(len(p))
+	c.offset = end
+	if start < c.headEnd {
+		if _, err := c.w.Write(p[:min(end, c.headEnd)-start]); err != nil {
+			return 0, err
+		}
+	}
+	if !c.marked && end >= c.headEnd {
+		c.marked = true
+		if _, err := io.WriteString(c.w, c.marker); err != nil {
+			return 0, err
+		}
+	}
+	if end > c.tailStart {
+		if _, err := c.w.Write(p[max(start, c.tailStart)-start:]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// xmlWriter applies xmlContent to contents written to it in chunks, holding
+// back a rune or a "]]" cut off at the end of a chunk until the next one.
+// cdata is set when the contents are written inside a CDATA section.
+type xmlWriter struct {
+	w       io.Writer
+	cdata   bool
+	pending []byte
+}
+
+func (x *xmlWriter) Write(p []byte) (int, error) {
+	x.pending = append(x.pending, p...)
+	complete, _ := splitRuneTail(x.pending)
+	for held := 0; held < 2 && len(complete) > 0 && complete[len(complete)-1] == ']'; held++ {
+		complete = complete[:len(complete)-1]
+	}
+	if _, err := x.w.Write(xmlContent(complete, x.cdata)); err != nil {
+		return 0, err
+	}
+	x.pending = append(x.pending[:0], x.pending[len(complete):]...)
+	return len(p), nil
+}
+
+// Close writes what is held back.
+func (x *xmlWriter) Close() error {
+	_, err := x.w.Write(xmlContent(x.pending, x.cdata))
+	x.pending = nil
+	return err
+}
+
+// jsonStringWriter writes contents written to it in chunks as the inside of
+// a JSON string, escaped as marshalJSON escapes them, holding back a rune cut
+// off at the end of a chunk until the next one.
+type jsonStringWriter struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (j *jsonStringWriter) Write(p []byte) (int, error) {
+	j.pending = append(j.pending, p...)
+	complete, tail := splitRuneTail(j.pending)
+	if err := j.encode(complete); err != nil {
+		return 0, err
+	}
+	j.pending = append(j.pending[:0], tail...)
+	return len(p), nil
+}
+
+// Close writes what is held back.
+func (j *jsonStringWriter) Close() error {
+	err := j.encode(j.pending)
+	j.pending = nil
+	return err
+}
+
+func (j *jsonStringWriter) encode(text []byte) error {
+	if len(text) == 0 {
+		return nil
+	}
+	payload, err := marshalJSON(string(text), "")
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(payload[1 : len(payload)-1])
+	return err
+}
+
+// contentSentinel stands in for streamed contents in an encoded file record.
+// It cannot clash with the rest of the record, since paths cannot hold NUL.
+const contentSentinel = "\x00content\x00"
+
+// splitRecord splits an encoded record around the contents, which were
+// encoded as contentSentinel, leaving the quotes on either side.
+func splitRecord(record []byte) ([]byte, []byte, error) {
+	encoded := []byte(`"\u0000content\u0000"`)
+	i := bytes.Index(record, encoded)
+	if i < 0 {
+		return nil, nil, fmt.Errorf("encoded record has no contents")
+	}
+	return record[:i+1], record[i+len(encoded)-1:], nil
+}
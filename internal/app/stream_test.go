@@ -0,0 +1,229 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aatuh/weaver/internal/adapters/fs"
+)
+
+// writeChunks writes data to w in chunks of size n.
+func writeChunks(t *testing.T, w io.Writer, data []byte, n int) {
+	t.Helper()
+	for len(data) > 0 {
+		chunk := data[:min(n, len(data))]
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		data = data[len(chunk):]
+	}
+}
+
+func TestStreamingMatchesInMemoryProcessing(t *testing.T) {
+	inputs := []string{
+		"",
+		"plain\n",
+		"no newline",
+		"é€😀 runes   cut anywhere\n",
+		"]]> and ]]]]> and ]] > and ]]",
+		"if a < b && c {}\n",
+		"``` and `````\n",
+		"--- BEGIN FILE: a ---\n",
+		"x\n--- END FILE: a ---",
+		"bell\x07 \x0c\x08 \"quote\" \\ \t\r\n",
+		"broken \xe2\x82 rune and \xff byte",
+		"\x00\x01\x02 binary",
+		"crlf\r\n]]\r\nend",
+		"nonchar \xef\xbf\xbe and \xef\xbf\xbf",
+	}
+	for _, input := range inputs {
+		data := []byte(input)
+		want := scanContent(data)
+		wantJSON, err := marshalJSON(input, "")
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		for _, n := range []int{1, 2, 3, 5, 4096} {
+			scanner := newContentScanner()
+			writeChunks(t, scanner, data, n)
+			if got := scanner.finish(); got != want {
+				t.Fatalf("%q in chunks of %d: scanned %+v, want %+v", input, n, got, want)
+			}
+
+			for _, cdata := range []bool{false, true} {
+				var xmlOut bytes.Buffer
+				xmlEncoder := &xmlWriter{w: &xmlOut, cdata: cdata}
+				writeChunks(t, xmlEncoder, data, n)
+				if err := xmlEncoder.Close(); err != nil {
+					t.Fatalf("close: %v", err)
+				}
+				if got := xmlOut.String(); got != string(xmlContent(data, cdata)) {
+					t.Fatalf("%q in chunks of %d: XML %q, want %q", input, n, got, xmlContent(data, cdata))
+				}
+			}
+
+			var jsonOut bytes.Buffer
+			jsonEncoder := &jsonStringWriter{w: &jsonOut}
+			writeChunks(t, jsonEncoder, data, n)
+			if err := jsonEncoder.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			if got := `"` + jsonOut.String() + `"`; got != string(wantJSON) {
+				t.Fatalf("%q in chunks of %d: JSON %s, want %s", input, n, got, wantJSON)
+			}
+		}
+	}
+}
+
+// streamingFS reads files only through Open, and can change a file between
+// the scan and the write.
+type streamingFS struct {
+	fs.OSFS
+	opened  map[string]int
+	changed string
+}
+
+func (f streamingFS) ReadFile(path string) ([]byte, error) {
+	return nil, fmt.Errorf("read of %s was not expected", path)
+}
+
+func (f streamingFS) Open(path string) (iofs.File, error) {
+	f.opened[filepath.Base(path)]++
+	if filepath.Base(path) == f.changed && f.opened[f.changed] > 1 {
+		if err := os.WriteFile(path, []byte("changed\n"), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return f.OSFS.Open(path)
+}
+
+func TestCombinerStreamsFilesWithoutReadingThemWhole(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"big.txt":  strings.Repeat("é€😀 <&> ]]> ``` line\n", 5000),
+		"noeol.go": "package main",
+		"data.bin": "\x00\x01\x02",
+	}
+	writeFiles(t, root, files)
+
+	for _, format := range []Format{FormatText, FormatMarkdown, FormatXML, FormatJSON, FormatJSONL} {
+		opts := rootOptions(root)
+		opts.Format = format
+		var streamed, counted bytes.Buffer
+		opts.Output = &streamed
+		streaming := Combiner{FS: streamingFS{opened: map[string]int{}}, Clock: fixedClock}
+		if err := streaming.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("%s: combine: %v", format, err)
+		}
+		// Counting tokens streams the files too, and changes only the header.
+		opts.Output = &counted
+		opts.Tokens = fixedCounter{}
+		if err := streaming.Combine(context.Background(), opts); err != nil {
+			t.Fatalf("%s: combine: %v", format, err)
+		}
+		want := counted.String()
+		for _, line := range []string{"# Tokens: 0 (fixed)\n", "- Tokens: 0 (fixed)\n", "<tokens>0 (fixed)</tokens>\n"} {
+			want = strings.Replace(want, line, "", 1)
+		}
+		want = strings.Replace(want, `"tokens":0,"tokenizer":"fixed",`, "", 1)
+		want = strings.Replace(want, "\n    \"tokens\": 0,\n    \"tokenizer\": \"fixed\",", "", 1)
+		if streamed.String() != want {
+			t.Fatalf("%s: output differs when counting tokens:\n%s\nwant:\n%s", format, streamed.String(), want)
+		}
+
+		// So does fitting a budget, cutting big.txt as it is written.
+		for _, policy := range []BudgetPolicy{BudgetDrop, BudgetTruncate} {
+			var budgeted bytes.Buffer
+			opts.Output = &budgeted
+			opts.MaxBytes = 4000
+			opts.BudgetPolicy = policy
+			if err := streaming.Combine(context.Background(), opts); err != nil {
+				t.Fatalf("%s, %s: combine: %v", format, policy, err)
+			}
+			if budgeted.Len() > 4000 || !strings.Contains(budgeted.String(), "noeol.go") {
+				t.Fatalf("%s, %s: expected noeol.go within 4000 bytes, got %d:\n%s", format, policy, budgeted.Len(), budgeted.String())
+			}
+		}
+	}
+
+	opts := rootOptions(root)
+	opts.Output = io.Discard
+	changing := Combiner{FS: streamingFS{opened: map[string]int{}, changed: "noeol.go"}, Clock: fixedClock}
+	if err := changing.Combine(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "changed while") {
+		t.Fatalf("expected a file changed between reads to fail, got %v", err)
+	}
+}
+
+// fixedCounter counts no tokens.
+type fixedCounter struct{}
+
+func (fixedCounter) Name() string          { return "fixed" }
+func (fixedCounter) Count(text []byte) int { return 0 }
+
+func TestStreamedSectionsMatchLoadedOnes(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"lines.md": "first é€😀\n<&> ]]> ```\nmiddle\n\nlast line\n",
+		"noeol.go": "package main\n\nfunc main() {}",
+		"crlf.txt": "one ]]\r\ntwo\r\nthree\r\n",
+	}
+	writeFiles(t, root, files)
+
+	for name, data := range files {
+		raw := strings.SplitAfter(data, "\n")
+		if raw[len(raw)-1] == "" {
+			raw = raw[:len(raw)-1]
+		}
+		offset := func(lines int) int64 { return int64(len(strings.Join(raw[:lines], ""))) }
+		for _, kept := range [][2]int{{-1, -1}, {1, 1}, {0, 1}, {1, 0}, {0, 0}} {
+			for _, format := range []Format{FormatText, FormatMarkdown, FormatXML, FormatJSON, FormatJSONL} {
+				opts := rootOptions(root)
+				opts.Format = format
+				entry := fileEntry{root: root, display: name, index: 1, collectedFile: collectedFile{rel: name, size: int64(len(data))}, contentInfo: scanContent([]byte(data))}
+
+				body := data
+				if !format.structured() && !strings.HasSuffix(body, "\n") {
+					body += "\n"
+				}
+				if head, tail := kept[0], kept[1]; head >= 0 {
+					lines := strings.SplitAfter(body, "\n")
+					if lines[len(lines)-1] == "" {
+						lines = lines[:len(lines)-1]
+					}
+					entry.truncated = &truncation{display: name, keptLines: head + tail, totalLines: len(lines), headEnd: offset(head), tailStart: offset(len(raw) - tail)}
+					body = strings.Join(lines[:head], "") + omittedMarker(len(lines)-head-tail, len(lines)) + strings.Join(lines[len(lines)-tail:], "")
+				}
+				loaded := entry
+				loaded.body = []byte(body)
+				if format == FormatXML {
+					loaded.body = xmlContent(loaded.body, entry.xmlSpecial)
+				}
+
+				var streamed, want bytes.Buffer
+				for _, section := range []struct {
+					out   *bytes.Buffer
+					entry fileEntry
+				}{{&streamed, entry}, {&want, loaded}} {
+					writer := bufio.NewWriter(section.out)
+					if err := (Combiner{FS: streamingFS{opened: map[string]int{}}}).writeSection(writer, opts, section.entry, make([]byte, 3)); err != nil {
+						t.Fatalf("%s, %s, %v: write: %v", name, format, kept, err)
+					}
+					if err := writer.Flush(); err != nil {
+						t.Fatalf("flush: %v", err)
+					}
+				}
+				if streamed.String() != want.String() {
+					t.Fatalf("%s, %s, %v: streamed section\n%q\nwant\n%q", name, format, kept, streamed.String(), want.String())
+				}
+			}
+		}
+	}
+}
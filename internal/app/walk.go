@@ -0,0 +1,252 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aatuh/weaver/internal/filter"
+)
+
+// collectedFile is a file chosen by the walk. Its size, modification time
+// and mode are known only when a maximum file size is set or a structured
+// format or file metadata needs them.
+type collectedFile struct {
+	rel       string
+	size      int64
+	oversized bool
+	modTime   time.Time
+	mode      fs.FileMode
+}
+
+// walkedDir holds what the walk found in a directory, in name order: files,
+// subdirectories to descend into, and the error that stopped it, if any.
+// Each directory is filled by the goroutine that walks it.
+type walkedDir struct {
+	items []walkedItem
+}
+
+// walkedItem is one file, subdirectory or error of a walkedDir.
+type walkedItem struct {
+	file collectedFile
+	dir  *walkedDir
+	err  error
+}
+
+// walkRoot holds the filter and nested rules of a root being walked.
+type walkRoot struct {
+	filter filter.PathFilter
+	nested *filter.NestedRules
+}
+
+// walker walks roots on up to Options.Jobs goroutines. A directory is walked
+// on a goroutine of its own while one is free, and otherwise by the goroutine
+// that found it, depth first. Since each directory keeps its findings in name
+// order, the result does not depend on which goroutine walked what.
+//
+// Once the walk fails, whatever comes after the failure in walk order is no
+// longer walked. What comes before it still is, so the first error in walk
+// order is found however the goroutines raced.
+type walker struct {
+	c           Combiner
+	ctx         context.Context
+	maxDepth    int
+	maxFileSize int64
+	needInfo    bool
+	// slots holds a token for each goroutine walking besides the caller.
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	// failing is set once failed is.
+	failing atomic.Bool
+	mu      sync.Mutex
+	// failed is the walk position of the earliest failure so far: the
+	// root's index, then the index of each entry on the way down.
+	failed []int
+}
+
+// collectFiles walks every root and returns each root's files in the order
+// of filepath.WalkDir: depth first, in name order. Subdirectories are not
+// entered when the filter's decision says not to descend, as with fs.SkipDir.
+// When the walk fails, the error returned is the first one in that order.
+func (c Combiner) collectFiles(ctx context.Context, opts Options) ([][]collectedFile, error) {
+	w := &walker{
+		c:           c,
+		ctx:         ctx,
+		maxDepth:    opts.MaxDepth,
+		maxFileSize: opts.MaxFileSize,
+		needInfo:    opts.Format.structured() || opts.FileMetadata,
+		slots:       make(chan struct{}, jobCount(opts)-1),
+	}
+	dirs := make([]*walkedDir, len(opts.Roots))
+	for i, rootPath := range opts.Roots {
+		root := walkRoot{filter: opts.Filters[i]}
+		if len(opts.NestedRules) > 0 {
+			root.nested = opts.NestedRules[i]
+		}
+		dirs[i] = &walkedDir{}
+		w.run(func() { w.walkDir(root, dirs[i], rootPath, "", []int{i}) })
+	}
+	w.wg.Wait()
+
+	files := make([][]collectedFile, len(dirs))
+	for i, dir := range dirs {
+		var err error
+		if files[i], err = dir.flatten(nil); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// run calls walk on a goroutine of its own when one is free, and otherwise
+// before returning.
+func (w *walker) run(walk func()) {
+	select {
+	case w.slots <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			defer func() { <-w.slots }()
+			walk()
+		}()
+	default:
+		walk()
+	}
+}
+
+// walkDir fills node with what the filter keeps of dir, at rel in the root
+// and at pos in walk order. The directory's nested rules are loaded before its
+// entries are evaluated.
+func (w *walker) walkDir(root walkRoot, node *walkedDir, dir, rel string, pos []int) {
+	fail := func(err error, at []int) {
+		node.items = append(node.items, walkedItem{err: err})
+		w.fail(at)
+	}
+	if w.stopped(pos) {
+		return
+	}
+	if err := w.ctx.Err(); err != nil {
+		fail(err, pos)
+		return
+	}
+	if err := w.c.loadNestedRules(root.nested, dir, rel); err != nil {
+		fail(err, pos)
+		return
+	}
+	entries, err := w.c.FS.ReadDir(dir)
+	if err != nil {
+		fail(err, pos)
+		return
+	}
+	for i, entry := range entries {
+		childPos := append(pos[:len(pos):len(pos)], i)
+		if w.stopped(childPos) {
+			return
+		}
+		if err := w.ctx.Err(); err != nil {
+			fail(err, childPos)
+			return
+		}
+		childPath := filepath.Join(dir, entry.Name())
+		childRel := path.Join(rel, entry.Name())
+		if entry.IsDir() {
+			if !w.descend(root, childRel) {
+				continue
+			}
+			child := &walkedDir{}
+			node.items = append(node.items, walkedItem{dir: child})
+			w.run(func() { w.walkDir(root, child, childPath, childRel, childPos) })
+			continue
+		}
+		file, ok, err := w.visitFile(root, entry, childPath, childRel)
+		if err != nil {
+			fail(err, childPos)
+			return
+		}
+		if ok {
+			node.items = append(node.items, walkedItem{file: file})
+		}
+	}
+}
+
+// fail notes a failure at pos in walk order.
+func (w *walker) fail(pos []int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed == nil || slices.Compare(pos, w.failed) < 0 {
+		w.failed = pos
+		w.failing.Store(true)
+	}
+}
+
+// stopped reports whether pos comes after a failure in walk order, so there
+// is no need to walk it. A directory comes before its entries.
+func (w *walker) stopped(pos []int) bool {
+	if !w.failing.Load() {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Compare(pos, w.failed) > 0
+}
+
+// descend reports whether the walk enters the directory at rel.
+func (w *walker) descend(root walkRoot, rel string) bool {
+	if w.maxDepth >= 0 && strings.Count(rel, "/") >= w.maxDepth {
+		return false
+	}
+	return root.filter.Evaluate(rel, true).Descend
+}
+
+// visitFile returns the file at rel, and whether the filter includes it.
+func (w *walker) visitFile(root walkRoot, entry fs.DirEntry, fullPath, rel string) (collectedFile, bool, error) {
+	if w.maxDepth >= 0 && strings.Count(rel, "/") > w.maxDepth {
+		return collectedFile{}, false, nil
+	}
+	if !root.filter.Evaluate(rel, false).Include {
+		return collectedFile{}, false, nil
+	}
+	file := collectedFile{rel: rel}
+	if w.maxFileSize > 0 || w.needInfo {
+		info, err := entry.Info()
+		if err == nil && entry.Type()&fs.ModeSymlink != 0 {
+			// A link is read through, so it is measured by its target.
+			info, err = w.c.FS.Stat(fullPath)
+		}
+		if err != nil {
+			return collectedFile{}, false, fmt.Errorf("stat %s: %w", rel, err)
+		}
+		file.size = info.Size()
+		file.modTime = info.ModTime()
+		file.mode = info.Mode()
+		file.oversized = w.maxFileSize > 0 && file.size > w.maxFileSize
+	}
+	return file, true, nil
+}
+
+// flatten appends the files of d and its subdirectories to files, in walk
+// order, stopping at the first error.
+func (d *walkedDir) flatten(files []collectedFile) ([]collectedFile, error) {
+	for _, item := range d.items {
+		switch {
+		case item.err != nil:
+			return nil, item.err
+		case item.dir != nil:
+			var err error
+			if files, err = item.dir.flatten(files); err != nil {
+				return nil, err
+			}
+		default:
+			files = append(files, item.file)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aatuh/weaver/internal/adapters/fs"
+	"github.com/aatuh/weaver/internal/filter"
+	"github.com/aatuh/weaver/internal/gitignore"
+)
+
+// writeWalkTree writes a root with nested .gitignore files, a directory its rules
+// skip and files at several depths.
+func writeWalkTree(t testing.TB, dirs, filesPerDir int) string {
+	t.Helper()
+	root := t.TempDir()
+	write := func(name, content string) {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	write(".gitignore", "*.log\nvendor/\n")
+	for d := 0; d < dirs; d++ {
+		dir := fmt.Sprintf("pkg%02d/sub%d/leaf", d, d%3)
+		if d%4 == 0 {
+			write(fmt.Sprintf("pkg%02d/.gitignore", d), "!keep.log\nsub0/\n")
+		}
+		for f := 0; f < filesPerDir; f++ {
+			write(fmt.Sprintf("pkg%02d/file%d.go", d, f), "package pkg\n")
+			write(fmt.Sprintf("%s/file%d.go", dir, f), "package leaf\n")
+		}
+		write(fmt.Sprintf("pkg%02d/keep.log", d), "log\n")
+		write(fmt.Sprintf("pkg%02d/vendor/dep.go", d), "package dep\n")
+	}
+	return root
+}
+
+// walkDirFiles collects the files of root with filepath.WalkDir and the same
+// rules as collectFiles, for comparison.
+func walkDirFiles(t *testing.T, root string, maxDepth int) []string {
+	t.Helper()
+	nested := filter.NewNestedRules(".gitignore")
+	pathFilter := filter.NewRuleSetFilter([]filter.RuleSet{{Mode: filter.ModeBlacklist, Nested: nested}}, filter.ModeBlacklist)
+	var files []string
+	err := filepath.WalkDir(root, func(path string, entry iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := ""
+		if path != root {
+			rel = filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator)))
+		}
+		depth := strings.Count(rel, "/")
+		if entry.IsDir() {
+			if rel != "" && ((maxDepth >= 0 && depth >= maxDepth) || !pathFilter.Evaluate(rel, true).Descend) {
+				return iofs.SkipDir
+			}
+			data, err := os.ReadFile(filepath.Join(path, ".gitignore"))
+			if err == nil {
+				matcher, err := gitignore.ParseWithOptions(strings.NewReader(string(data)), gitignore.ParseOptions{})
+				if err != nil {
+					return err
+				}
+				nested.Add(rel, matcher)
+			}
+			return nil
+		}
+		if (maxDepth < 0 || depth <= maxDepth) && pathFilter.Evaluate(rel, false).Include {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	return files
+}
+
+// listingFS records the directories listed, and can fail or slow down
+// listing them.
+type listingFS struct {
+	fs.OSFS
+	delay time.Duration
+	fail  map[string]bool
+
+	mu     *sync.Mutex
+	listed map[string]bool
+}
+
+func (f listingFS) ReadDir(path string) ([]iofs.DirEntry, error) {
+	if f.listed != nil {
+		f.mu.Lock()
+		f.listed[filepath.Base(path)] = true
+		f.mu.Unlock()
+	}
+	time.Sleep(f.delay)
+	if f.fail[filepath.Base(path)] {
+		return nil, fmt.Errorf("list %s: refused", path)
+	}
+	return f.OSFS.ReadDir(path)
+}
+
+func walkOptions(roots []string, jobs, maxDepth int) Options {
+	opts := Options{MaxDepth: maxDepth, Jobs: jobs}
+	for _, root := range roots {
+		nested := filter.NewNestedRules(".gitignore")
+		opts.Roots = append(opts.Roots, root)
+		opts.RootLabels = append(opts.RootLabels, filepath.Base(root))
+		opts.NestedRules = append(opts.NestedRules, nested)
+		opts.Filters = append(opts.Filters, filter.NewRuleSetFilter([]filter.RuleSet{{Mode: filter.ModeBlacklist, Nested: nested}}, filter.ModeBlacklist))
+	}
+	return opts
+}
+
+func TestCollectFilesMatchesWalkDirForAnyJobs(t *testing.T) {
+	roots := []string{writeWalkTree(t, 12, 3), writeWalkTree(t, 5, 2), t.TempDir()}
+	for _, maxDepth := range []int{-1, 0, 2} {
+		want := make([][]string, len(roots))
+		for i, root := range roots {
+			want[i] = walkDirFiles(t, root, maxDepth)
+		}
+		for _, jobs := range []int{1, 3, 64} {
+			listed := map[string]bool{}
+			combiner := Combiner{FS: listingFS{mu: &sync.Mutex{}, listed: listed}}
+			collected, err := combiner.collectFiles(context.Background(), walkOptions(roots, jobs, maxDepth))
+			if err != nil {
+				t.Fatalf("collect: %v", err)
+			}
+			for i := range roots {
+				var got []string
+				for _, file := range collected[i] {
+					got = append(got, file.rel)
+				}
+				if !reflect.DeepEqual(got, want[i]) {
+					t.Fatalf("depth %d, %d jobs, root %d: collected\n%v\nwant\n%v", maxDepth, jobs, i, got, want[i])
+				}
+			}
+			if listed["vendor"] {
+				t.Fatalf("depth %d, %d jobs: expected the skipped vendor directories not to be listed", maxDepth, jobs)
+			}
+		}
+	}
+}
+
+func TestCollectFilesReportsTheFirstErrorInWalkOrder(t *testing.T) {
+	roots := []string{writeWalkTree(t, 8, 1), writeWalkTree(t, 8, 1)}
+	for _, jobs := range []int{1, 4, 64} {
+		// Every leaf directory fails, as does pkg05 near the end of the
+		// first root. pkg00 skips its sub0, so pkg01's leaf comes first.
+		combiner := Combiner{FS: listingFS{fail: map[string]bool{"pkg05": true, "leaf": true}}}
+		_, err := combiner.collectFiles(context.Background(), walkOptions(roots, jobs, -1))
+		want := fmt.Sprintf("list %s: refused", filepath.Join(roots[0], "pkg01", "sub1", "leaf"))
+		if err == nil || err.Error() != want {
+			t.Fatalf("%d jobs: expected %q, got %v", jobs, want, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		combiner = Combiner{FS: fs.OSFS{}}
+		if _, err := combiner.collectFiles(ctx, walkOptions(roots, jobs, -1)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%d jobs: expected a canceled walk to fail, got %v", jobs, err)
+		}
+	}
+}
+
+func TestCollectFilesStopsAfterTheFirstError(t *testing.T) {
+	roots := []string{writeWalkTree(t, 8, 1), writeWalkTree(t, 8, 1)}
+	listed := map[string]bool{}
+	combiner := Combiner{FS: listingFS{fail: map[string]bool{"pkg01": true}, mu: &sync.Mutex{}, listed: listed}}
+	_, err := combiner.collectFiles(context.Background(), walkOptions(roots, 1, -1))
+	if want := fmt.Sprintf("list %s: refused", filepath.Join(roots[0], "pkg01")); err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+	if !listed["pkg00"] || listed["pkg02"] || listed["pkg07"] {
+		t.Fatalf("expected the walk to stop at pkg01, listed %v", listed)
+	}
+}
+
+// BenchmarkCollectFilesJobs walks several roots on a filesystem where every
+// directory listing waits, as on a network filesystem.
+func BenchmarkCollectFilesJobs(b *testing.B) {
+	var roots []string
+	for i := 0; i < 12; i++ {
+		roots = append(roots, writeWalkTree(b, 8, 2))
+	}
+	for _, jobs := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			combiner := Combiner{FS: listingFS{delay: 200 * time.Microsecond}}
+			for i := 0; i < b.N; i++ {
+				if _, err := combiner.collectFiles(context.Background(), walkOptions(roots, jobs, -1)); err != nil {
+					b.Fatalf("collect: %v", err)
+				}
+			}
+		})
+	}
+}
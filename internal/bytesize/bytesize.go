@@ -0,0 +1,66 @@
+// Package bytesize parses and formats human-readable byte counts.
+package bytesize
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// units maps suffixes to multipliers. As in GNU coreutils, "K", "M" and "G"
+// (and "KiB" and so on) are powers of 1024, while "KB", "MB" and "GB" are powers of 1000.
+var units = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+}
+
+// Parse reads a non-negative size such as "512", "64K", "10MB" or "1.5GiB".
+// Units are case-insensitive.
+func Parse(value string) (int64, error) {
+	text := strings.TrimSpace(value)
+	end := 0
+	for end < len(text) && (text[end] >= '0' && text[end] <= '9' || text[end] == '.') {
+		end++
+	}
+	number, unit := text[:end], strings.ToLower(strings.TrimSpace(text[end:]))
+	multiplier, ok := units[unit]
+	if number == "" || !ok {
+		return 0, fmt.Errorf("invalid size %q (use bytes or a unit such as 512K, 10MB or 1GiB)", value)
+	}
+	if !strings.Contains(number, ".") {
+		n, err := strconv.ParseInt(number, 10, 64)
+		if err != nil || n > (1<<63-1)/multiplier {
+			return 0, fmt.Errorf("invalid size %q", value)
+		}
+		return n * multiplier, nil
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f*float64(multiplier) >= 1<<63 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(f * float64(multiplier)), nil
+}
+
+// Format renders n bytes with a binary unit, such as "512 B" or "1.5 MiB".
+func Format(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	value := float64(n) / (1 << 10)
+	i := 0
+	for value >= 1<<10 && i < len(units)-1 {
+		value /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -0,0 +1,43 @@
+package bytesize
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	cases := map[string]int64{
+		"0":      0,
+		"512":    512,
+		"512b":   512,
+		"64K":    64 << 10,
+		"64 KiB": 64 << 10,
+		"10MB":   10 * 1000 * 1000,
+		"1.5GiB": 3 << 29,
+		" 2m ":   2 << 20,
+		"1.5kb":  1500,
+	}
+	for input, want := range cases {
+		got, err := Parse(input)
+		if err != nil || got != want {
+			t.Fatalf("Parse(%q) = %d, %v, want %d", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"", "MB", "-1", "10XB", "1.2.3K", "99999999999G"} {
+		if _, err := Parse(input); err == nil {
+			t.Fatalf("Parse(%q): expected an error", input)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		1536:       "1.5 KiB",
+		2 << 30:    "2.0 GiB",
+		5000 << 40: "5000.0 TiB",
+	}
+	for input, want := range cases {
+		if got := Format(input); got != want {
+			t.Fatalf("Format(%d) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+// Package configfile reads weaver.yaml and weaver.toml project files.
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/app"
+	"github.com/aatuh/weaver/internal/bytesize"
+	"github.com/aatuh/weaver/internal/filter"
+	"github.com/aatuh/weaver/internal/presets"
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+// Names lists the file names Find looks for.
+var Names = []string{"weaver.yaml", "weaver.yml", "weaver.toml"}
+
+// Error is a problem in a config file, located by line.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+func errorAt(line int, format string, args ...any) *Error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Rule is one entry of the ordered rule list: a rule file or a group of inline patterns.
+type Rule struct {
+	Mode filter.Mode
+	// File is the rule file path, resolved against the config file's directory.
+	File string
+	// Patterns are inline patterns, evaluated together as one rule set.
+	Patterns []string
+	// PatternLines holds the config line of each pattern.
+	PatternLines []int
+	// Preset names a built-in blacklist; such rules have no file or patterns.
+	Preset string
+	// Root limits the rule to the root with this label.
+	Root       string
+	IgnoreCase bool
+	Line       int
+}
+
+// Settings are the options a config file can set. Nil pointers and empty
+// slices leave the option to flags and defaults.
+type Settings struct {
+	Roots              []string
+	Out                *string
+	Format             *app.Format
+	IncludeTree        *bool
+	IncludeTreeCompact *bool
+	MaxDepth           *int
+	Jobs               *int
+	SkipContents       *bool
+	SkipBinary         *bool
+	MaxFileSize        *int64
+	SkipOversize       *bool
+	FileMetadata       *bool
+	NoTimestamp        *bool
+	MaxBytes           *int64
+	MaxLines           *int64
+	BudgetPolicy       *app.BudgetPolicy
+	CountTokens        *bool
+	Tokenizer          *string
+	MaxTokens          *int64
+	RespectGitignore   *bool
+	GitExcludes        *bool
+	StrictGitignore    *bool
+	IgnoreCase         *bool
+	Rules              []Rule
+}
+
+// Profile is a named set of settings layered over the file's top-level settings.
+type Profile struct {
+	Name string
+	// Extends names the profiles whose settings apply first, in order.
+	Extends []string
+	Line    int
+	Settings
+}
+
+// File is a loaded config file. Its top-level settings apply to every profile.
+type File struct {
+	Path     string
+	Profiles map[string]Profile
+	Settings
+}
+
+// Find returns the config file in dir, or "" if there is none. Having more
+// than one of the recognised names in the same directory is an error.
+func Find(dir string) (string, error) {
+	found := ""
+	for _, name := range Names {
+		candidate := filepath.Join(dir, name)
+		info, err := os.Stat(candidate)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return "", fmt.Errorf("stat config: %w", err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		if found != "" {
+			return "", fmt.Errorf("found both %s and %s; choose one with -config", filepath.Base(found), name)
+		}
+		found = candidate
+	}
+	return found, nil
+}
+
+// Load reads and validates a config file. The format follows the extension:
+// .toml files are TOML and anything else is YAML.
+func Load(path string) (*File, error) {
+	// #nosec G304 -- config path is user-specified by design.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	return Parse(data, path)
+}
+
+// Parse decodes config data read from path. Relative paths in the file are
+// resolved against the directory of path.
+func Parse(data []byte, path string) (*File, error) {
+	file, err := parse(data, path)
+	var configErr *Error
+	if errors.As(err, &configErr) && configErr.File == "" {
+		configErr.File = path
+	}
+	return file, err
+}
+
+func parse(data []byte, path string) (*File, error) {
+	var root *Node
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		root, err = parseTOML(data)
+	} else {
+		root, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if root.Kind != KindMap {
+		return nil, errorAt(root.Line, "expected a mapping of settings at the top level")
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("resolve config directory: %w", err)
+	}
+	d := decoder{dir: dir}
+	file := &File{Path: path, Profiles: map[string]Profile{}}
+	file.Settings, err = d.settings(root, map[string]func(*Node) error{
+		"profiles": func(n *Node) error {
+			profiles, err := d.profiles(n)
+			file.Profiles = profiles
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range file.ProfileNames() {
+		if _, err := file.resolve(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// ProfileNames returns the profile names in sorted order.
+func (f *File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns the settings for a profile: the top-level settings, then each
+// extended profile, then the profile itself. An empty name selects the top level.
+// Later layers replace options and roots, and add their rules after earlier ones.
+func (f *File) Resolve(name string) (Settings, error) {
+	if name == "" {
+		return f.Settings, nil
+	}
+	if _, ok := f.Profiles[name]; !ok {
+		if len(f.Profiles) == 0 {
+			return Settings{}, fmt.Errorf("%s defines no profiles", f.Path)
+		}
+		return Settings{}, fmt.Errorf("%s has no profile %q (profiles: %s)", f.Path, name, strings.Join(f.ProfileNames(), ", "))
+	}
+	profile, err := f.resolve(name, nil)
+	if err != nil {
+		return Settings{}, err
+	}
+	return merge(f.Settings, profile), nil
+}
+
+// resolve layers a profile over the profiles it extends. Each ancestor is
+// applied once, before every profile that extends it, so a profile reached
+// along two paths does not add its rules twice.
+func (f *File) resolve(name string, stack []string) (Settings, error) {
+	var order []string
+	if err := f.lineage(name, stack, &order); err != nil {
+		return Settings{}, err
+	}
+	var settings Settings
+	for _, ancestor := range order {
+		settings = merge(settings, f.Profiles[ancestor].Settings)
+	}
+	return settings, nil
+}
+
+// lineage appends name to order after the profiles it extends, depth first,
+// skipping profiles already there. stack holds the profiles being visited, to
+// report cycles.
+func (f *File) lineage(name string, stack []string, order *[]string) error {
+	profile := f.Profiles[name]
+	if i := slices.Index(stack, name); i >= 0 {
+		return errorAt(profile.Line, "extends cycle: %s", strings.Join(append(slices.Clone(stack[i:]), name), " -> "))
+	}
+	if slices.Contains(*order, name) {
+		return nil
+	}
+	stack = append(stack, name)
+	for _, parent := range profile.Extends {
+		if _, ok := f.Profiles[parent]; !ok {
+			return errorAt(profile.Line, "profile %q extends unknown profile %q", name, parent)
+		}
+		if err := f.lineage(parent, stack, order); err != nil {
+			return err
+		}
+	}
+	*order = append(*order, name)
+	return nil
+}
+
+// merge layers top over base.
+func merge(base, top Settings) Settings {
+	out := base
+	if len(top.Roots) > 0 {
+		out.Roots = top.Roots
+	}
+	for _, field := range []struct{ dst, src **bool }{
+		{&out.IncludeTree, &top.IncludeTree},
+		{&out.IncludeTreeCompact, &top.IncludeTreeCompact},
+		{&out.SkipContents, &top.SkipContents},
+		{&out.SkipBinary, &top.SkipBinary},
+		{&out.SkipOversize, &top.SkipOversize},
+		{&out.FileMetadata, &top.FileMetadata},
+		{&out.NoTimestamp, &top.NoTimestamp},
+		{&out.CountTokens, &top.CountTokens},
+		{&out.RespectGitignore, &top.RespectGitignore},
+		{&out.GitExcludes, &top.GitExcludes},
+		{&out.StrictGitignore, &top.StrictGitignore},
+		{&out.IgnoreCase, &top.IgnoreCase},
+	} {
+		if *field.src != nil {
+			*field.dst = *field.src
+		}
+	}
+	if top.Out != nil {
+		out.Out = top.Out
+	}
+	if top.Format != nil {
+		out.Format = top.Format
+	}
+	if top.MaxDepth != nil {
+		out.MaxDepth = top.MaxDepth
+	}
+	if top.Jobs != nil {
+		out.Jobs = top.Jobs
+	}
+	if top.MaxFileSize != nil {
+		out.MaxFileSize = top.MaxFileSize
+	}
+	if top.MaxBytes != nil {
+		out.MaxBytes = top.MaxBytes
+	}
+	if top.MaxLines != nil {
+		out.MaxLines = top.MaxLines
+	}
+	if top.BudgetPolicy != nil {
+		out.BudgetPolicy = top.BudgetPolicy
+	}
+	if top.Tokenizer != nil {
+		out.Tokenizer = top.Tokenizer
+	}
+	if top.MaxTokens != nil {
+		out.MaxTokens = top.MaxTokens
+	}
+	out.Rules = append(append([]Rule(nil), base.Rules...), top.Rules...)
+	return out
+}
+
+type decoder struct {
+	dir string
+}
+
+// settings decodes the options shared by the top level and profiles. Keys in
+// extra are accepted as well and handed to their decode function.
+func (d decoder) settings(n *Node, extra map[string]func(*Node) error) (Settings, error) {
+	var s Settings
+	for _, key := range n.Keys {
+		value := n.Map[key]
+		line := n.KeyLines[key]
+		var err error
+		switch key {
+		case "roots":
+			var roots []string
+			if roots, err = d.stringList(key, value); err == nil {
+				for _, root := range roots {
+					s.Roots = append(s.Roots, d.path(root))
+				}
+			}
+		case "out":
+			var out string
+			if out, err = d.stringValue(key, value); err == nil {
+				if out != "-" {
+					out = d.path(out)
+				}
+				s.Out = &out
+			}
+		case "format":
+			var name string
+			if name, err = d.stringValue(key, value); err == nil {
+				var format app.Format
+				if format, err = app.ParseFormat(name); err != nil {
+					err = errorAt(value.Line, "%v", err)
+				}
+				s.Format = &format
+			}
+		case "max-depth":
+			var depth int
+			if depth, err = d.intValue(key, value); err == nil {
+				if depth < -1 {
+					err = errorAt(value.Line, "max-depth must be -1 (no limit) or a non-negative integer")
+				}
+				s.MaxDepth = &depth
+			}
+		case "jobs":
+			var jobs int
+			if jobs, err = d.intValue(key, value); err == nil {
+				if jobs < 0 {
+					err = errorAt(value.Line, "jobs must be 0 (one per CPU) or positive")
+				}
+				s.Jobs = &jobs
+			}
+		case "include-tree":
+			s.IncludeTree, err = d.boolValue(key, value)
+		case "include-tree-compact":
+			s.IncludeTreeCompact, err = d.boolValue(key, value)
+		case "skip-contents":
+			s.SkipContents, err = d.boolValue(key, value)
+		case "skip-binary":
+			s.SkipBinary, err = d.boolValue(key, value)
+		case "max-file-size":
+			s.MaxFileSize, err = d.sizeValue(key, value)
+		case "max-bytes":
+			s.MaxBytes, err = d.sizeValue(key, value)
+		case "max-lines":
+			s.MaxLines, err = d.limitValue(key, value)
+		case "max-tokens":
+			s.MaxTokens, err = d.limitValue(key, value)
+		case "count-tokens":
+			s.CountTokens, err = d.boolValue(key, value)
+		case "tokenizer":
+			var name string
+			if name, err = d.stringValue(key, value); err == nil {
+				if _, err = tokenizer.New(name); err != nil {
+					err = errorAt(value.Line, "%v", err)
+				}
+				s.Tokenizer = &name
+			}
+		case "budget-policy":
+			var name string
+			if name, err = d.stringValue(key, value); err == nil {
+				var policy app.BudgetPolicy
+				if policy, err = app.ParseBudgetPolicy(name); err != nil {
+					err = errorAt(value.Line, "%v", err)
+				}
+				s.BudgetPolicy = &policy
+			}
+		case "skip-oversize":
+			s.SkipOversize, err = d.boolValue(key, value)
+		case "file-metadata":
+			s.FileMetadata, err = d.boolValue(key, value)
+		case "no-timestamp":
+			s.NoTimestamp, err = d.boolValue(key, value)
+		case "respect-gitignore":
+			s.RespectGitignore, err = d.boolValue(key, value)
+		case "git-excludes":
+			s.GitExcludes, err = d.boolValue(key, value)
+		case "strict-gitignore":
+			s.StrictGitignore, err = d.boolValue(key, value)
+		case "ignore-case":
+			s.IgnoreCase, err = d.boolValue(key, value)
+		case "rules":
+			s.Rules, err = d.rules(value)
+		default:
+			if decode, ok := extra[key]; ok {
+				err = decode(value)
+				break
+			}
+			err = errorAt(line, "unknown key %q", key)
+		}
+		if err != nil {
+			return Settings{}, err
+		}
+	}
+	return s, nil
+}
+
+func (d decoder) profiles(n *Node) (map[string]Profile, error) {
+	if n.Kind != KindMap {
+		return nil, errorAt(n.Line, "profiles must be a mapping of profile names to settings")
+	}
+	profiles := make(map[string]Profile, len(n.Keys))
+	for _, name := range n.Keys {
+		value := n.Map[name]
+		profile := Profile{Name: name, Line: n.KeyLines[name]}
+		if value.Kind != KindMap {
+			return nil, errorAt(profile.Line, "profile %q must be a mapping of settings", name)
+		}
+		settings, err := d.settings(value, map[string]func(*Node) error{
+			"extends": func(n *Node) error {
+				var err error
+				profile.Extends, err = d.stringList("extends", n)
+				return err
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		profile.Settings = settings
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+func (d decoder) rules(n *Node) ([]Rule, error) {
+	if n.Kind != KindList {
+		return nil, errorAt(n.Line, "rules must be a list")
+	}
+	rules := make([]Rule, 0, len(n.List))
+	for _, item := range n.List {
+		if item.Kind != KindMap {
+			return nil, errorAt(item.Line, "each rule must be a mapping with a mode and a file or patterns")
+		}
+		rule := Rule{Line: item.Line}
+		hasMode := false
+		for _, key := range item.Keys {
+			value := item.Map[key]
+			var err error
+			switch key {
+			case "mode":
+				var mode string
+				if mode, err = d.stringValue(key, value); err == nil {
+					rule.Mode, err = parseMode(mode, value.Line)
+					hasMode = true
+				}
+			case "file":
+				var file string
+				if file, err = d.stringValue(key, value); err == nil {
+					rule.File = d.path(file)
+				}
+			case "patterns":
+				err = d.patterns(&rule, value)
+			case "preset":
+				var name string
+				if name, err = d.stringValue(key, value); err == nil {
+					if rule.Preset, err = presets.Canonical(name); err != nil {
+						err = errorAt(value.Line, "%v", err)
+					}
+				}
+			case "root":
+				rule.Root, err = d.stringValue(key, value)
+			case "ignore-case":
+				var ignoreCase *bool
+				if ignoreCase, err = d.boolValue(key, value); err == nil {
+					rule.IgnoreCase = *ignoreCase
+				}
+			default:
+				err = errorAt(item.KeyLines[key], "unknown rule key %q", key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		sources := 0
+		for _, set := range []bool{rule.File != "", len(rule.Patterns) > 0, rule.Preset != ""} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return nil, errorAt(item.Line, "rule needs exactly one of file, patterns or preset")
+		}
+		if rule.Preset != "" {
+			if hasMode && rule.Mode != filter.ModeBlacklist {
+				return nil, errorAt(item.Line, "presets are blacklists; remove the mode")
+			}
+		} else if !hasMode {
+			return nil, errorAt(item.Line, "rule needs a mode (blacklist or whitelist)")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (d decoder) patterns(rule *Rule, n *Node) error {
+	items := []*Node{n}
+	if n.Kind == KindList {
+		items = n.List
+	}
+	for _, item := range items {
+		if item.Kind != KindScalar || strings.TrimSpace(item.Value) == "" {
+			return errorAt(item.Line, "patterns must be a non-empty string or a list of them")
+		}
+		if strings.ContainsAny(item.Value, "\r\n") {
+			return errorAt(item.Line, "a pattern cannot span lines")
+		}
+		rule.Patterns = append(rule.Patterns, item.Value)
+		rule.PatternLines = append(rule.PatternLines, item.Line)
+	}
+	return nil
+}
+
+func parseMode(value string, line int) (filter.Mode, error) {
+	switch value {
+	case "blacklist":
+		return filter.ModeBlacklist, nil
+	case "whitelist":
+		return filter.ModeWhitelist, nil
+	}
+	return 0, errorAt(line, "mode must be \"blacklist\" or \"whitelist\", got %q", value)
+}
+
+func (d decoder) path(value string) string {
+	if filepath.IsAbs(value) {
+		return filepath.Clean(value)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(value))
+}
+
+func (d decoder) stringValue(key string, n *Node) (string, error) {
+	if n.Kind != KindScalar || n.Value == "" {
+		return "", errorAt(n.Line, "%s must be a non-empty string", key)
+	}
+	return n.Value, nil
+}
+
+// stringList accepts a single string or a list of strings.
+func (d decoder) stringList(key string, n *Node) ([]string, error) {
+	if n.Kind != KindList {
+		value, err := d.stringValue(key, n)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	values := make([]string, 0, len(n.List))
+	for _, item := range n.List {
+		value, err := d.stringValue(key, item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (d decoder) boolValue(key string, n *Node) (*bool, error) {
+	if n.Kind == KindScalar && !n.Quoted {
+		switch n.Value {
+		case "true":
+			value := true
+			return &value, nil
+		case "false":
+			value := false
+			return &value, nil
+		}
+	}
+	return nil, errorAt(n.Line, "%s must be true or false", key)
+}
+
+// sizeValue accepts a byte count or a size with a unit, such as 10MB.
+func (d decoder) sizeValue(key string, n *Node) (*int64, error) {
+	text, err := d.stringValue(key, n)
+	if err != nil {
+		return nil, err
+	}
+	size, err := bytesize.Parse(text)
+	if err != nil {
+		return nil, errorAt(n.Line, "%s: %v", key, err)
+	}
+	return &size, nil
+}
+
+// limitValue accepts 0 (no limit) or a positive integer.
+func (d decoder) limitValue(key string, n *Node) (*int64, error) {
+	value, err := d.intValue(key, n)
+	if err != nil {
+		return nil, err
+	}
+	if value < 0 {
+		return nil, errorAt(n.Line, "%s must be 0 (no limit) or a positive integer", key)
+	}
+	limit := int64(value)
+	return &limit, nil
+}
+
+func (d decoder) intValue(key string, n *Node) (int, error) {
+	if n.Kind == KindScalar && !n.Quoted {
+		if value, err := strconv.Atoi(n.Value); err == nil {
+			return value, nil
+		}
+	}
+	return 0, errorAt(n.Line, "%s must be an integer", key)
+}
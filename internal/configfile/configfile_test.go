@@ -0,0 +1,259 @@
+package configfile
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aatuh/weaver/internal/filter"
+)
+
+const yamlConfig = `# Bundle for code review.
+roots: [api, "web"]
+out: build/combined.txt
+max-depth: 4
+max-file-size: 1MiB
+include-tree: true
+skip-binary: true
+respect-gitignore: true
+rules:
+  - mode: blacklist
+    file: .gitignore
+  - mode: whitelist
+    root: web
+    ignore-case: true
+    patterns:
+      - "*.ts"
+      - 'docs/' # trailing comment
+  - mode: blacklist
+    patterns: "*_test.go"
+`
+
+const tomlConfig = `# Bundle for code review.
+roots = ["api", "web"]
+out = "build/combined.txt"
+max-depth = 4
+max-file-size = 1_048_576
+include-tree = true
+skip-binary = true
+respect-gitignore = true
+
+[[rules]]
+mode = "blacklist"
+file = ".gitignore"
+
+[[rules]]
+mode = "whitelist"
+root = "web"
+ignore-case = true
+patterns = [
+  "*.ts",
+  'docs/', # trailing comment
+]
+
+[[rules]]
+mode = "blacklist"
+patterns = "*_test.go"
+`
+
+func TestParseYAMLAndTOMLAgree(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile, err := Parse([]byte(yamlConfig), filepath.Join(dir, "weaver.yaml"))
+	if err != nil {
+		t.Fatalf("parse yaml: %v", err)
+	}
+	tomlFile, err := Parse([]byte(tomlConfig), filepath.Join(dir, "weaver.toml"))
+	if err != nil {
+		t.Fatalf("parse toml: %v", err)
+	}
+
+	s := yamlFile.Settings
+	if want := []string{filepath.Join(dir, "api"), filepath.Join(dir, "web")}; !reflect.DeepEqual(s.Roots, want) {
+		t.Fatalf("roots = %v, want %v", s.Roots, want)
+	}
+	if s.Out == nil || *s.Out != filepath.Join(dir, "build", "combined.txt") {
+		t.Fatalf("unexpected out %v", s.Out)
+	}
+	if s.MaxDepth == nil || *s.MaxDepth != 4 || s.IncludeTree == nil || !*s.IncludeTree || s.SkipContents != nil {
+		t.Fatalf("unexpected options %+v", s)
+	}
+	if s.MaxFileSize == nil || *s.MaxFileSize != 1<<20 {
+		t.Fatalf("unexpected max-file-size %v", s.MaxFileSize)
+	}
+	if len(s.Rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(s.Rules))
+	}
+	web := s.Rules[1]
+	if web.Mode != filter.ModeWhitelist || web.Root != "web" || !web.IgnoreCase || !reflect.DeepEqual(web.Patterns, []string{"*.ts", "docs/"}) {
+		t.Fatalf("unexpected web rule %+v", web)
+	}
+	if !reflect.DeepEqual(web.PatternLines, []int{16, 17}) {
+		t.Fatalf("pattern lines = %v", web.PatternLines)
+	}
+	if s.Rules[0].File != filepath.Join(dir, ".gitignore") {
+		t.Fatalf("expected rule files relative to the config, got %s", s.Rules[0].File)
+	}
+
+	// Lines differ between the formats; everything else must match.
+	for i := range s.Rules {
+		s.Rules[i].Line, tomlFile.Rules[i].Line = 0, 0
+		s.Rules[i].PatternLines, tomlFile.Rules[i].PatternLines = nil, nil
+	}
+	if !reflect.DeepEqual(s, tomlFile.Settings) {
+		t.Fatalf("yaml and toml settings differ:\n%+v\n%+v", s, tomlFile.Settings)
+	}
+}
+
+func TestParseReportsErrorsWithLineNumbers(t *testing.T) {
+	cases := []struct {
+		name   string
+		file   string
+		config string
+		want   string
+	}{
+		{"unknown key", "weaver.yaml", "out: x\nmax_depth: 2\n", "weaver.yaml:2: unknown key \"max_depth\""},
+		{"bad bool", "weaver.yaml", "include-tree: yes\n", "weaver.yaml:1: include-tree must be true or false"},
+		{"bad depth", "weaver.toml", "\nmax-depth = -3\n", "weaver.toml:2: max-depth must be -1"},
+		{"bad jobs", "weaver.yaml", "jobs: -2\n", "weaver.yaml:1: jobs must be 0 (one per CPU) or positive"},
+		{"bad size", "weaver.yaml", "max-file-size: 10 parsecs\n", "weaver.yaml:1: max-file-size: invalid size"},
+		{"bad policy", "weaver.toml", "budget-policy = \"shrink\"\n", "weaver.toml:1: budget policy must be \"drop\" or \"truncate\""},
+		{"bad format", "weaver.yaml", "format: html\n", "weaver.yaml:1: format must be one of text, markdown, xml, json, jsonl"},
+		{"unknown tokenizer", "weaver.yaml", "tokenizer: words\n", "weaver.yaml:1: unknown tokenizer \"words\""},
+		{"bad mode", "weaver.yaml", "rules:\n  - mode: allow\n    file: a\n", "weaver.yaml:2: mode must be \"blacklist\" or \"whitelist\""},
+		{"file and patterns", "weaver.yaml", "rules:\n  - mode: blacklist\n    file: a\n    patterns: [b]\n", "weaver.yaml:2: rule needs exactly one of file, patterns or preset"},
+		{"unknown preset", "weaver.yaml", "rules:\n  - preset: cobol\n", "weaver.yaml:2: unknown preset \"cobol\""},
+		{"unquoted glob", "weaver.yaml", "rules:\n  - mode: blacklist\n    patterns: *.log\n", "weaver.yaml:3: values starting with \"*\" must be quoted"},
+		{"bad indentation", "weaver.yaml", "out: x\n  roots: y\n", "weaver.yaml:2: unexpected indentation"},
+		{"duplicate key", "weaver.yaml", "out: x\nout: y\n", "weaver.yaml:2: duplicate key \"out\""},
+		{"toml unknown rule key", "weaver.toml", "[[rules]]\nmode = \"blacklist\"\npattern = \"*.log\"\n", "weaver.toml:3: unknown rule key \"pattern\""},
+		{"toml unquoted string", "weaver.toml", "out = combined.txt\n", "weaver.toml:1: unsupported value \"combined.txt\""},
+		{"toml table twice", "weaver.toml", "[a]\nx = 1\n[a]\n", "weaver.toml:3: table \"a\" is already defined"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.config), tc.file)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.HasPrefix(err.Error(), tc.want) {
+				t.Fatalf("error = %q, want prefix %q", err.Error(), tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveLayersExtendedProfiles(t *testing.T) {
+	config := `skip-binary: true
+rules:
+  - mode: blacklist
+    file: .gitignore
+profiles:
+  review:
+    max-depth: 3
+    rules:
+      - mode: blacklist
+        patterns: ["*_test.go"]
+  docs:
+    include-tree: true
+    rules:
+      - mode: whitelist
+        patterns: ["*.md"]
+  full-context:
+    extends: [review, docs]
+    max-depth: -1
+`
+	file, err := Parse([]byte(config), filepath.Join(t.TempDir(), "weaver.yaml"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := file.ProfileNames(); !reflect.DeepEqual(got, []string{"docs", "full-context", "review"}) {
+		t.Fatalf("profile names = %v", got)
+	}
+
+	s, err := file.Resolve("full-context")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if s.MaxDepth == nil || *s.MaxDepth != -1 {
+		t.Fatalf("expected the profile's own max-depth to win, got %v", s.MaxDepth)
+	}
+	if s.IncludeTree == nil || !*s.IncludeTree || s.SkipBinary == nil || !*s.SkipBinary {
+		t.Fatalf("expected inherited and top-level options, got %+v", s)
+	}
+	var order []string
+	for _, rule := range s.Rules {
+		source := strings.Join(rule.Patterns, ",")
+		if rule.File != "" {
+			source = filepath.Base(rule.File)
+		}
+		order = append(order, rule.Mode.String()+":"+source)
+	}
+	if want := []string{"blacklist:.gitignore", "blacklist:*_test.go", "whitelist:*.md"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("rules = %v, want %v", order, want)
+	}
+
+	if _, err := file.Resolve("missing"); err == nil || !strings.Contains(err.Error(), "profiles: docs, full-context, review") {
+		t.Fatalf("expected unknown profile error listing profiles, got %v", err)
+	}
+}
+
+func TestResolveAppliesSharedAncestorsOnce(t *testing.T) {
+	config := `
+profiles:
+  base:
+    max-depth: 1
+    rules:
+      - mode: blacklist
+        patterns: ["*.log"]
+  left:
+    extends: base
+    max-depth: 2
+  right:
+    extends: base
+    rules:
+      - mode: blacklist
+        patterns: ["*.tmp"]
+  both:
+    extends: [left, right]
+`
+	file, err := Parse([]byte(config), "weaver.yaml")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	s, err := file.Resolve("both")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	var patterns []string
+	for _, rule := range s.Rules {
+		patterns = append(patterns, rule.Patterns...)
+	}
+	if want := []string{"*.log", "*.tmp"}; !reflect.DeepEqual(patterns, want) {
+		t.Fatalf("rules = %v, want %v", patterns, want)
+	}
+	if s.MaxDepth == nil || *s.MaxDepth != 2 {
+		t.Fatalf("expected left's max-depth to survive base being shared, got %v", s.MaxDepth)
+	}
+}
+
+func TestParseRejectsBadProfileExtends(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"cycle", "profiles:\n  a:\n    extends: b\n  b:\n    extends: a\n", "weaver.yaml:2: extends cycle: a -> b -> a"},
+		{"indirect cycle", "profiles:\n  a:\n    extends: b\n  b:\n    extends: c\n  c:\n    extends: b\n", "weaver.yaml:4: extends cycle: b -> c -> b"},
+		{"unknown", "profiles:\n  a:\n    extends: nope\n", "weaver.yaml:2: profile \"a\" extends unknown profile \"nope\""},
+		{"unknown key", "profiles:\n  a:\n    extend: b\n", "weaver.yaml:3: unknown key \"extend\""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.config), "weaver.yaml")
+			if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+				t.Fatalf("error = %v, want prefix %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package configfile
+
+// Kind identifies the shape of a parsed config value.
+type Kind int
+
+const (
+	KindScalar Kind = iota
+	KindMap
+	KindList
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindMap:
+		return "mapping"
+	case KindList:
+		return "list"
+	default:
+		return "scalar"
+	}
+}
+
+// Node is a parsed config value together with the line it was read from.
+// YAML and TOML documents both parse into nodes, so validation is shared.
+type Node struct {
+	Kind Kind
+	Line int
+
+	// Value holds the text of a scalar. Quoted scalars are always strings.
+	Value  string
+	Quoted bool
+
+	// Keys lists the keys of a mapping in document order.
+	Keys []string
+	Map  map[string]*Node
+	// KeyLines records the line of each key, which may differ from the value's line.
+	KeyLines map[string]int
+
+	List []*Node
+}
+
+func newMap(line int) *Node {
+	return &Node{Kind: KindMap, Line: line, Map: map[string]*Node{}, KeyLines: map[string]int{}}
+}
+
+// set adds a key to a mapping. It reports false if the key already exists.
+func (n *Node) set(key string, line int, value *Node) bool {
+	if _, ok := n.Map[key]; ok {
+		return false
+	}
+	n.Keys = append(n.Keys, key)
+	n.Map[key] = value
+	n.KeyLines[key] = line
+	return true
+}
@@ -0,0 +1,355 @@
+package configfile
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tomlParser struct {
+	src     string
+	pos     int
+	line    int
+	root    *Node
+	current *Node
+	// defined holds the tables opened by a [header], which may not be opened twice.
+	defined map[*Node]bool
+	// tableArrays holds the lists created by [[header]] rather than by an array value.
+	tableArrays map[*Node]bool
+}
+
+// parseTOML reads the TOML subset config files need: tables, arrays of tables,
+// dotted keys, basic and literal strings, integers, booleans, arrays and inline
+// tables. Multi-line strings, floats and dates are rejected with an error.
+func parseTOML(data []byte) (*Node, error) {
+	p := &tomlParser{
+		src:         strings.TrimPrefix(string(data), "\ufeff"),
+		line:        1,
+		root:        newMap(1),
+		defined:     map[*Node]bool{},
+		tableArrays: map[*Node]bool{},
+	}
+	p.current = p.root
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.src) {
+			return p.root, nil
+		}
+		var err error
+		if p.src[p.pos] == '[' {
+			err = p.parseHeader()
+		} else {
+			err = p.parseKeyValue(p.current)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func (p *tomlParser) skipBlank() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.pos++
+			p.line++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipSpaces() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skipSpaces()
+	if p.pos < len(p.src) && p.src[p.pos] == '#' {
+		p.skipComment()
+	}
+	if p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+		return errorAt(p.line, "expected end of line, found %q", p.src[p.pos:p.lineEnd()])
+	}
+	return nil
+}
+
+func (p *tomlParser) lineEnd() int {
+	end := strings.IndexByte(p.src[p.pos:], '\n')
+	if end == -1 {
+		return len(p.src)
+	}
+	return p.pos + end
+}
+
+func (p *tomlParser) parseHeader() error {
+	line := p.line
+	array := strings.HasPrefix(p.src[p.pos:], "[[")
+	closing := "]"
+	p.pos++
+	if array {
+		closing = "]]"
+		p.pos++
+	}
+	p.skipSpaces()
+	keys, err := p.parseKeyPath()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if !strings.HasPrefix(p.src[p.pos:], closing) {
+		return errorAt(line, "expected %q to close the table header", closing)
+	}
+	p.pos += len(closing)
+
+	parent := p.root
+	for _, key := range keys[:len(keys)-1] {
+		if parent, err = p.descend(parent, key, line); err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+	existing, exists := parent.Map[last]
+	if array {
+		if !exists {
+			existing = &Node{Kind: KindList, Line: line}
+			parent.set(last, line, existing)
+			p.tableArrays[existing] = true
+		} else if !p.tableArrays[existing] {
+			return errorAt(line, "key %q is already defined", last)
+		}
+		table := newMap(line)
+		existing.List = append(existing.List, table)
+		p.current = table
+		return nil
+	}
+	if !exists {
+		existing = newMap(line)
+		parent.set(last, line, existing)
+	} else if existing.Kind != KindMap || p.defined[existing] {
+		return errorAt(line, "table %q is already defined", strings.Join(keys, "."))
+	}
+	p.defined[existing] = true
+	p.current = existing
+	return nil
+}
+
+// descend returns the table stored under key, creating it if needed. For an
+// array of tables it returns the most recent element, as TOML specifies.
+func (p *tomlParser) descend(parent *Node, key string, line int) (*Node, error) {
+	child, ok := parent.Map[key]
+	if !ok {
+		child = newMap(line)
+		parent.set(key, line, child)
+		return child, nil
+	}
+	if child.Kind == KindList && p.tableArrays[child] && len(child.List) > 0 {
+		return child.List[len(child.List)-1], nil
+	}
+	if child.Kind != KindMap {
+		return nil, errorAt(line, "key %q is not a table", key)
+	}
+	return child, nil
+}
+
+// parseKeyPath reads a bare, quoted or dotted key.
+func (p *tomlParser) parseKeyPath() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.src) {
+			return nil, errorAt(p.line, "expected a key")
+		}
+		var key string
+		switch c := p.src[p.pos]; {
+		case c == '"' || c == '\'':
+			node, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			key = node.Value
+		default:
+			start := p.pos
+			for p.pos < len(p.src) && isBareKeyChar(p.src[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, errorAt(p.line, "expected a key, found %q", p.src[p.pos:p.lineEnd()])
+			}
+			key = p.src[start:p.pos]
+		}
+		keys = append(keys, key)
+		p.skipSpaces()
+		if p.pos >= len(p.src) || p.src[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseKeyValue(table *Node) error {
+	line := p.line
+	keys, err := p.parseKeyPath()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+		return errorAt(line, "expected \"=\" after key %q", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpaces()
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys[:len(keys)-1] {
+		if table, err = p.descend(table, key, line); err != nil {
+			return err
+		}
+	}
+	if !table.set(keys[len(keys)-1], line, value) {
+		return errorAt(line, "duplicate key %q", strings.Join(keys, "."))
+	}
+	return nil
+}
+
+func (p *tomlParser) parseValue() (*Node, error) {
+	if p.pos >= len(p.src) {
+		return nil, errorAt(p.line, "expected a value")
+	}
+	switch p.src[p.pos] {
+	case '"', '\'':
+		return p.parseString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	line := p.line
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	if token == "true" || token == "false" {
+		return &Node{Kind: KindScalar, Line: line, Value: token}, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(token, "_", ""), 10, 64); err == nil && token != "" {
+		return &Node{Kind: KindScalar, Line: line, Value: strings.ReplaceAll(token, "_", "")}, nil
+	}
+	if token == "" {
+		return nil, errorAt(line, "expected a value")
+	}
+	return nil, errorAt(line, "unsupported value %q (strings must be quoted)", token)
+}
+
+func (p *tomlParser) parseString() (*Node, error) {
+	line := p.line
+	quote := p.src[p.pos]
+	if strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(quote), 3)) {
+		return nil, errorAt(line, "multi-line strings are not supported")
+	}
+	end := -1
+	for i := p.pos + 1; i < len(p.src) && p.src[i] != '\n'; i++ {
+		if quote == '"' && p.src[i] == '\\' {
+			i++
+			continue
+		}
+		if p.src[i] == quote {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return nil, errorAt(line, "unterminated string")
+	}
+	raw := p.src[p.pos : end+1]
+	p.pos = end + 1
+	if quote == '\'' {
+		return &Node{Kind: KindScalar, Line: line, Value: raw[1 : len(raw)-1], Quoted: true}, nil
+	}
+	value, err := strconv.Unquote(raw)
+	if err != nil {
+		return nil, errorAt(line, "invalid string %s", raw)
+	}
+	return &Node{Kind: KindScalar, Line: line, Value: value, Quoted: true}, nil
+}
+
+// parseArray reads an array, which may span lines and contain comments.
+func (p *tomlParser) parseArray() (*Node, error) {
+	list := &Node{Kind: KindList, Line: p.line}
+	p.pos++
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.src) {
+			return nil, errorAt(list.Line, "unterminated array")
+		}
+		if p.src[p.pos] == ']' {
+			p.pos++
+			return list, nil
+		}
+		item, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list.List = append(list.List, item)
+		p.skipBlank()
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos < len(p.src) && p.src[p.pos] == ']' {
+			p.pos++
+			return list, nil
+		}
+		return nil, errorAt(p.line, "expected \",\" or \"]\" in array")
+	}
+}
+
+// parseInlineTable reads a one-line table such as { mode = "whitelist", file = "allow.txt" }.
+func (p *tomlParser) parseInlineTable() (*Node, error) {
+	table := newMap(p.line)
+	p.pos++
+	p.skipSpaces()
+	if p.pos < len(p.src) && p.src[p.pos] == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos < len(p.src) && p.src[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+		return nil, errorAt(p.line, "expected \",\" or \"}\" in inline table")
+	}
+}
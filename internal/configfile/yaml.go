@@ -0,0 +1,329 @@
+package configfile
+
+import (
+	"strconv"
+	"strings"
+)
+
+type yamlLine struct {
+	line   int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML reads the YAML subset config files need: block mappings and sequences,
+// flow sequences of scalars, and plain or quoted scalars. Anchors, tags, block
+// scalars and flow mappings are rejected with an error rather than misread.
+func parseYAML(data []byte) (*Node, error) {
+	lines, err := splitYAMLLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return newMap(1), nil
+	}
+	p := &yamlParser{lines: lines}
+	node, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, errorAt(p.lines[p.pos].line, "unexpected indentation")
+	}
+	return node, nil
+}
+
+// splitYAMLLines drops comments and blank lines and measures indentation.
+func splitYAMLLines(text string) ([]yamlLine, error) {
+	text = strings.TrimPrefix(text, "\ufeff")
+	var out []yamlLine
+	for i, raw := range strings.Split(text, "\n") {
+		lineNo := i + 1
+		content := strings.TrimRight(stripYAMLComment(strings.TrimRight(raw, "\r")), " \t")
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		indent := 0
+		for indent < len(content) && content[indent] == ' ' {
+			indent++
+		}
+		if content[indent] == '\t' {
+			return nil, errorAt(lineNo, "tabs are not allowed in indentation")
+		}
+		body := content[indent:]
+		if indent == 0 && (body == "---" || body == "...") {
+			if body == "---" && len(out) == 0 {
+				continue
+			}
+			return nil, errorAt(lineNo, "multiple documents are not supported")
+		}
+		out = append(out, yamlLine{line: lineNo, indent: indent, text: body})
+	}
+	return out, nil
+}
+
+// stripYAMLComment removes a '#' comment that starts a line or follows whitespace, outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (p *yamlParser) parseBlock(indent int) (*Node, error) {
+	l := p.lines[p.pos]
+	if isSeqItem(l.text) {
+		return p.parseSeq(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	return parseYAMLValue(l.text, l.line)
+}
+
+func (p *yamlParser) parseSeq(indent int) (*Node, error) {
+	list := &Node{Kind: KindList, Line: p.lines[p.pos].line}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, errorAt(l.line, "unexpected indentation")
+		}
+		if !isSeqItem(l.text) {
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				return nil, errorAt(l.line, "empty list item")
+			}
+			item, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list.List = append(list.List, item)
+			continue
+		}
+		// The item's content continues as a block at its own column, so
+		// "- mode: blacklist" starts a mapping whose keys line up below it.
+		column := indent + len(l.text) - len(rest)
+		p.lines[p.pos] = yamlLine{line: l.line, indent: column, text: rest}
+		item, err := p.parseBlock(column)
+		if err != nil {
+			return nil, err
+		}
+		list.List = append(list.List, item)
+	}
+	return list, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (*Node, error) {
+	m := newMap(p.lines[p.pos].line)
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, errorAt(l.line, "unexpected indentation")
+		}
+		key, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			if isSeqItem(l.text) {
+				return nil, errorAt(l.line, "unexpected list item")
+			}
+			return nil, errorAt(l.line, "expected \"key: value\"")
+		}
+		p.pos++
+
+		var child *Node
+		var err error
+		switch {
+		case value != "":
+			child, err = parseYAMLValue(value, l.line)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			child, err = p.parseBlock(p.lines[p.pos].indent)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text):
+			// A sequence may sit at the same indentation as its key.
+			child, err = p.parseSeq(indent)
+		default:
+			child = &Node{Kind: KindScalar, Line: l.line}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !m.set(key, l.line, child) {
+			return nil, errorAt(l.line, "duplicate key %q", key)
+		}
+	}
+	return m, nil
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" (or "key:") at the first ": " outside a quoted key.
+func splitYAMLKey(text string) (string, string, bool) {
+	if isSeqItem(text) || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	var key, rest string
+	if text[0] == '"' || text[0] == '\'' {
+		end := closingQuote(text)
+		if end == -1 {
+			return "", "", false
+		}
+		unquoted, err := unquoteYAML(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		key, rest = unquoted, text[end+1:]
+	} else {
+		colon := strings.Index(text, ": ")
+		if colon == -1 {
+			if !strings.HasSuffix(text, ":") {
+				return "", "", false
+			}
+			colon = len(text) - 1
+		}
+		key, rest = strings.TrimSpace(text[:colon]), text[colon:]
+	}
+	if rest == ":" {
+		return key, "", true
+	}
+	if !strings.HasPrefix(rest, ": ") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(rest[2:]), true
+}
+
+func parseYAMLValue(text string, line int) (*Node, error) {
+	switch text[0] {
+	case '[':
+		return parseYAMLFlowSeq(text, line)
+	case '{':
+		if strings.TrimSpace(text[1:]) == "}" {
+			return newMap(line), nil
+		}
+		return nil, errorAt(line, "flow mappings are not supported; use an indented block")
+	case '|', '>':
+		return nil, errorAt(line, "block scalars are not supported; use a quoted string")
+	case '*', '&', '!', '%', '@', '`':
+		return nil, errorAt(line, "values starting with %q must be quoted", text[:1])
+	}
+	return parseYAMLScalar(text, line)
+}
+
+func parseYAMLScalar(text string, line int) (*Node, error) {
+	if text[0] != '"' && text[0] != '\'' {
+		return &Node{Kind: KindScalar, Line: line, Value: text}, nil
+	}
+	end := closingQuote(text)
+	if end == -1 {
+		return nil, errorAt(line, "unterminated quoted string")
+	}
+	if end != len(text)-1 {
+		return nil, errorAt(line, "unexpected text after quoted string")
+	}
+	value, err := unquoteYAML(text)
+	if err != nil {
+		return nil, errorAt(line, "invalid quoted string %s", text)
+	}
+	return &Node{Kind: KindScalar, Line: line, Value: value, Quoted: true}, nil
+}
+
+// parseYAMLFlowSeq reads a one-line flow sequence of scalars, such as ["*.go", docs/].
+func parseYAMLFlowSeq(text string, line int) (*Node, error) {
+	if !strings.HasSuffix(text, "]") {
+		return nil, errorAt(line, "flow sequences must close on the same line")
+	}
+	list := &Node{Kind: KindList, Line: line}
+	inner := text[1 : len(text)-1]
+	start := 0
+	var quote byte
+	for i := 0; i <= len(inner); i++ {
+		if i < len(inner) {
+			c := inner[i]
+			switch {
+			case quote == '"' && c == '\\':
+				i++
+				continue
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c == '[' || c == '{':
+				return nil, errorAt(line, "nested flow collections are not supported")
+			case c != ',':
+				continue
+			}
+		}
+		item := strings.TrimSpace(inner[start:i])
+		start = i + 1
+		if item == "" {
+			// Allow "[]" and a trailing comma, but not "[a,,b]".
+			if i == len(inner) && (len(list.List) > 0 || strings.TrimSpace(inner) == "") {
+				continue
+			}
+			return nil, errorAt(line, "empty item in flow sequence")
+		}
+		node, err := parseYAMLValue(item, line)
+		if err != nil {
+			return nil, err
+		}
+		list.List = append(list.List, node)
+	}
+	return list, nil
+}
+
+// closingQuote returns the index of the quote closing the string that starts text, or -1.
+func closingQuote(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote:
+			if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func unquoteYAML(text string) (string, error) {
+	if text[0] == '\'' {
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	return strconv.Unquote(text)
+}
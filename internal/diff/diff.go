@@ -0,0 +1,187 @@
+// Package diff compares texts line by line and formats the result as a unified diff.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// Unified returns a unified diff from a to b, with three lines of context and
+// the given file names, or "" when the texts are equal.
+func Unified(oldName, newName string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+	oldLines, newLines := splitLines(string(a)), splitLines(string(b))
+	ops := edits(oldLines, newLines)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	// i and j count the old and new lines before ops[start].
+	i, j := 0, 0
+	for start := 0; start < len(ops); {
+		if ops[start] == opEqual {
+			i++
+			j++
+			start++
+			continue
+		}
+		// Extend the hunk while changes are at most 2*context lines apart.
+		end := start
+		for last := start; last < len(ops); {
+			end = last + 1
+			for end < len(ops) && ops[end] != opEqual {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next] == opEqual && next-end < 2*context {
+				next++
+			}
+			if next == len(ops) || ops[next] == opEqual {
+				break
+			}
+			last = next
+		}
+
+		lead := min(context, start)
+		oldStart, newStart := i-lead, j-lead
+		var body strings.Builder
+		oldCount, newCount := 0, 0
+		x, y := oldStart, newStart
+		trail := end
+		for trail < len(ops) && ops[trail] == opEqual && trail-end < context {
+			trail++
+		}
+		for _, op := range ops[start-lead : trail] {
+			switch op {
+			case opEqual:
+				writeLine(&body, ' ', oldLines[x])
+				x++
+				y++
+				oldCount++
+				newCount++
+			case opDelete:
+				writeLine(&body, '-', oldLines[x])
+				x++
+				oldCount++
+			case opInsert:
+				writeLine(&body, '+', newLines[y])
+				y++
+				newCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		out.WriteString(body.String())
+
+		i, j = x, y
+		start = trail
+	}
+	return out.String()
+}
+
+// hunkRange formats the 1-based start and length of a hunk side. An empty
+// side names the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func writeLine(out *strings.Builder, prefix byte, line string) {
+	out.WriteByte(prefix)
+	out.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// splitLines splits text after each newline; the last line may lack one.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edits returns the shortest edit script from a to b, found with Myers'
+// O(ND) algorithm. Each step's frontier is kept to trace the path back.
+func edits(a, b []string) []opKind {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		// Keep the frontier this step reads, for diagonals -d-1 to d+1.
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, n, m int) []opKind {
+	var ops []opKind
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		frontier := trace[d]
+		at := func(k int) int { return frontier[k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, opEqual)
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, opInsert)
+			} else {
+				ops = append(ops, opDelete)
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,52 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedFormatsHunks(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+	want := "--- a.txt\n+++ b.txt\n" +
+		"@@ -1,5 +1,5 @@\n one\n-two\n+2\n three\n four\n five\n" +
+		"@@ -8,3 +8,4 @@\n eight\n nine\n ten\n+eleven\n"
+	if got := Unified("a.txt", "b.txt", []byte(a), []byte(b)); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnifiedMergesNearbyChanges(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n"
+	b := "1\nX\n3\n4\n5\n6\nY\n8\n"
+	got := Unified("a", "b", []byte(a), []byte(b))
+	if strings.Count(got, "@@ -") != 1 || !strings.Contains(got, "@@ -1,8 +1,8 @@\n") {
+		t.Fatalf("expected a single hunk, got:\n%s", got)
+	}
+}
+
+func TestUnifiedEdgeCases(t *testing.T) {
+	if got := Unified("a", "b", []byte("same\n"), []byte("same\n")); got != "" {
+		t.Fatalf("expected no diff, got %q", got)
+	}
+	if got, want := Unified("a", "b", nil, []byte("new\n")), "--- a\n+++ b\n@@ -0,0 +1 @@\n+new\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := Unified("a", "b", []byte("x\n"), []byte("x")), "--- a\n+++ b\n@@ -1 +1 @@\n-x\n+x\n\\ No newline at end of file\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestEditsFindShortestScript(t *testing.T) {
+	a := strings.Split("a b c a b b a", " ")
+	b := strings.Split("c b a b a c", " ")
+	changes := 0
+	for _, op := range edits(a, b) {
+		if op != opEqual {
+			changes++
+		}
+	}
+	if changes != 5 {
+		t.Fatalf("expected 5 edits, got %d", changes)
+	}
+}
@@ -0,0 +1,78 @@
+package filter
+
+import "github.com/aatuh/weaver/internal/gitignore"
+
+// RuleMatch describes a rule that matched a path or one of its parent directories.
+type RuleMatch struct {
+	// RuleSet is the index of the rule set in evaluation order.
+	RuleSet int
+	Mode    Mode
+	Rule    gitignore.Rule
+	// Path is the root-relative path the rule matched: the path itself or a parent directory.
+	Path string
+}
+
+// Explanation lists the rules that matched a path and the resulting decision.
+type Explanation struct {
+	Matches  []RuleMatch
+	Decision Decision
+	// Excluded reports that the path was excluded by an explicit path list, such as the output file.
+	Excluded bool
+}
+
+// Explainer is implemented by filters that can report why they decided a path.
+type Explainer interface {
+	Explain(path string, isDir bool) Explanation
+}
+
+// Explain reports every rule in every rule set that matched the path or a parent directory.
+func (f RuleSetFilter) Explain(path string, isDir bool) Explanation {
+	var matches []RuleMatch
+	for i, rules := range f.RuleSets {
+		matches = append(matches, rules.explain(i, path, isDir)...)
+	}
+	return Explanation{Matches: matches, Decision: f.Evaluate(path, isDir)}
+}
+
+// Explain reports every rule that matched the path or a parent directory.
+func (f GitIgnoreFilter) Explain(path string, isDir bool) Explanation {
+	matches := RuleSet{Mode: f.Mode, Matcher: f.Matcher}.explain(0, path, isDir)
+	return Explanation{Matches: matches, Decision: f.Evaluate(path, isDir)}
+}
+
+// Explain reports explicit exclusions, or defers to the inner filter.
+func (f ExcludePathFilter) Explain(path string, isDir bool) Explanation {
+	if _, ok := f.Excluded[path]; ok {
+		return Explanation{Decision: f.Evaluate(path, isDir), Excluded: true}
+	}
+	if explainer, ok := f.Inner.(Explainer); ok {
+		return explainer.Explain(path, isDir)
+	}
+	return Explanation{Decision: f.Inner.Evaluate(path, isDir)}
+}
+
+func (r RuleSet) explain(index int, path string, isDir bool) []RuleMatch {
+	var matches []RuleMatch
+	add := func(target string, targetIsDir bool) {
+		matcherPath := target
+		if r.Prefix != "" {
+			matcherPath = r.Prefix + "/" + target
+		}
+		for _, rule := range r.Matcher.MatchAll(matcherPath, targetIsDir) {
+			matches = append(matches, RuleMatch{RuleSet: index, Mode: r.Mode, Rule: rule, Path: target})
+		}
+		if r.Nested != nil {
+			for _, rule := range r.Nested.matchAll(target, targetIsDir) {
+				matches = append(matches, RuleMatch{RuleSet: index, Mode: r.Mode, Rule: rule, Path: target})
+			}
+		}
+	}
+
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' {
+			add(path[:i], true)
+		}
+	}
+	add(path, isDir)
+	return matches
+}
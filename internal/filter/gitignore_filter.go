@@ -3,41 +3,33 @@ package filter
 import "github.com/aatuh/weaver/internal/gitignore"
 
 // GitIgnoreFilter evaluates paths using gitignore rules.
+// With Strict set, paths are evaluated with git's exact semantics (see gitignore.Matcher.MatchStrict).
 type GitIgnoreFilter struct {
 	Mode    Mode
 	Matcher *gitignore.Matcher
+	Strict  bool
 }
 
 func (f GitIgnoreFilter) Evaluate(path string, isDir bool) Decision {
-	matched, negated := matchRules(f.Mode, f.Matcher, path, isDir)
+	matched, negated := RuleSet{Mode: f.Mode, Matcher: f.Matcher}.match(path, isDir, f.Strict)
 	return decisionForMatch(f.Mode, matched, negated)
 }
 
-func matchRules(mode Mode, matcher *gitignore.Matcher, path string, isDir bool) (bool, bool) {
+// matchRules returns whether any rule matched and whether the last match was negated.
+// Outside strict mode, whitelist directory rules also match everything below the directory;
+// in strict mode that is handled by evaluating parent directories instead.
+func matchRules(mode Mode, matcher *gitignore.Matcher, path string, isDir, strict bool) (bool, bool) {
 	if matcher == nil {
 		return false, false
 	}
-	rules := matcher.Rules()
-	if len(rules) == 0 {
-		return false, false
-	}
-
-	matched := false
-	negated := false
-	for _, rule := range rules {
-		var ruleMatches bool
-		if mode == ModeWhitelist && rule.DirOnly {
-			ruleMatches = rule.MatchDescendant(path, isDir)
-		} else {
-			ruleMatches = rule.Match(path, isDir)
-		}
-		if ruleMatches {
-			matched = true
-			negated = rule.Negate
-		}
+	var rule gitignore.Rule
+	var ok bool
+	if mode == ModeWhitelist && !strict {
+		rule, ok = matcher.MatchDescendant(path, isDir)
+	} else {
+		rule, ok = matcher.Match(path, isDir)
 	}
-
-	return matched, negated
+	return ok, ok && rule.Negate
 }
 
 func decisionForMatch(mode Mode, matched, negated bool) Decision {
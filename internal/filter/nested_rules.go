@@ -0,0 +1,116 @@
+package filter
+
+import (
+	"sync"
+
+	"github.com/aatuh/weaver/internal/gitignore"
+)
+
+// NestedRules holds rule files discovered in directories while walking a root.
+// Each matcher applies to paths below the directory it was loaded from, and
+// matchers from deeper directories take precedence over shallower ones, as in git.
+// Rule files in directories above the root, up to the top of its repository,
+// apply too and are shallower than any found in the walk.
+type NestedRules struct {
+	FileName string
+	// IgnoreCase makes the discovered rules match regardless of letter case.
+	IgnoreCase bool
+
+	mu        sync.RWMutex
+	matchers  map[string]*gitignore.Matcher
+	ancestors []ancestorRules
+}
+
+// ancestorRules is a rule file above the root. prefix is the root's path
+// relative to the directory the file was loaded from.
+type ancestorRules struct {
+	prefix  string
+	matcher *gitignore.Matcher
+}
+
+// NewNestedRules returns an empty set of nested rules loaded from files named fileName.
+func NewNestedRules(fileName string) *NestedRules {
+	return &NestedRules{FileName: fileName, matchers: map[string]*gitignore.Matcher{}}
+}
+
+// Add registers the matcher loaded from dir, a slash-separated path relative to the root ("" for the root itself).
+func (n *NestedRules) Add(dir string, matcher *gitignore.Matcher) {
+	if matcher == nil || len(matcher.Rules()) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.matchers == nil {
+		n.matchers = map[string]*gitignore.Matcher{}
+	}
+	n.matchers[dir] = matcher
+}
+
+// AddAncestor registers the matcher loaded from a directory above the root,
+// where prefix is the root's slash-separated path relative to that directory.
+// Ancestors are added shallowest first.
+func (n *NestedRules) AddAncestor(prefix string, matcher *gitignore.Matcher) {
+	if matcher == nil || len(matcher.Rules()) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ancestors = append(n.ancestors, ancestorRules{prefix: prefix, matcher: matcher})
+}
+
+func (n *NestedRules) match(mode Mode, path string, isDir, strict bool) (bool, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if len(n.matchers) == 0 && len(n.ancestors) == 0 {
+		return false, false
+	}
+
+	matched := false
+	negated := false
+	decide := func(matcher *gitignore.Matcher, rel string) {
+		if m, neg := matchRules(mode, matcher, rel, isDir, strict); m {
+			matched = true
+			negated = neg
+		}
+	}
+	apply := func(dir, rel string) {
+		if matcher, ok := n.matchers[dir]; ok {
+			decide(matcher, rel)
+		}
+	}
+
+	for _, ancestor := range n.ancestors {
+		decide(ancestor.matcher, ancestor.prefix+"/"+path)
+	}
+	apply("", path)
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		apply(path[:i], path[i+1:])
+	}
+	return matched, negated
+}
+
+// matchAll returns every nested rule matching the path, shallowest rule file first.
+func (n *NestedRules) matchAll(path string, isDir bool) []gitignore.Rule {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var matches []gitignore.Rule
+	for _, ancestor := range n.ancestors {
+		matches = append(matches, ancestor.matcher.MatchAll(ancestor.prefix+"/"+path, isDir)...)
+	}
+	if matcher, ok := n.matchers[""]; ok {
+		matches = append(matches, matcher.MatchAll(path, isDir)...)
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		if matcher, ok := n.matchers[path[:i]]; ok {
+			matches = append(matches, matcher.MatchAll(path[i+1:], isDir)...)
+		}
+	}
+	return matches
+}
@@ -3,15 +3,54 @@ package filter
 import "github.com/aatuh/weaver/internal/gitignore"
 
 // RuleSet bundles a matcher with its evaluation mode.
+// Nested rules, when set, are evaluated after Matcher and take precedence over it.
+// Prefix, when set, is joined in front of paths before Matcher sees them, for rules
+// anchored above the walked root (such as a repository's info/exclude).
 type RuleSet struct {
 	Mode    Mode
 	Matcher *gitignore.Matcher
+	Nested  *NestedRules
+	Prefix  string
+}
+
+// match reports whether the rule set matched the path and whether the deciding rule was negated.
+// In strict mode a parent directory matched by a non-negated rule decides for the path, as in git.
+func (r RuleSet) match(path string, isDir, strict bool) (bool, bool) {
+	if strict {
+		for i := 0; i < len(path); i++ {
+			if path[i] != '/' {
+				continue
+			}
+			if matched, negated := r.matchPath(path[:i], true, strict); matched && !negated {
+				return true, false
+			}
+		}
+	}
+	return r.matchPath(path, isDir, strict)
+}
+
+func (r RuleSet) matchPath(path string, isDir, strict bool) (bool, bool) {
+	matcherPath := path
+	if r.Prefix != "" {
+		matcherPath = r.Prefix + "/" + path
+	}
+	matched, negated := matchRules(r.Mode, r.Matcher, matcherPath, isDir, strict)
+	if r.Nested != nil {
+		if nestedMatched, nestedNegated := r.Nested.match(r.Mode, path, isDir, strict); nestedMatched {
+			matched = true
+			negated = nestedNegated
+		}
+	}
+	return matched, negated
 }
 
 // RuleSetFilter applies multiple rule sets in order, letting later matches override earlier ones.
+// With Strict set, each rule set is evaluated with git's exact semantics: a path below a
+// directory the rule set matched cannot be re-included or re-excluded by that rule set.
 type RuleSetFilter struct {
 	BaseMode Mode
 	RuleSets []RuleSet
+	Strict   bool
 }
 
 // NewRuleSetFilter returns a filter that evaluates rule sets in order.
@@ -22,6 +61,14 @@ func NewRuleSetFilter(ruleSets []RuleSet, baseMode Mode) PathFilter {
 	return RuleSetFilter{BaseMode: baseMode, RuleSets: ruleSets}
 }
 
+// NewStrictRuleSetFilter returns a filter that evaluates rule sets in order with git's exact semantics.
+func NewStrictRuleSetFilter(ruleSets []RuleSet, baseMode Mode) PathFilter {
+	if len(ruleSets) == 0 {
+		return GitIgnoreFilter{Mode: baseMode, Strict: true}
+	}
+	return RuleSetFilter{BaseMode: baseMode, RuleSets: ruleSets, Strict: true}
+}
+
 func (f RuleSetFilter) Evaluate(path string, isDir bool) Decision {
 	baseDecision := decisionForMatch(f.BaseMode, false, false)
 	if len(f.RuleSets) == 0 {
@@ -31,7 +78,7 @@ func (f RuleSetFilter) Evaluate(path string, isDir bool) Decision {
 	matchedAny := false
 	decision := baseDecision
 	for _, rules := range f.RuleSets {
-		matched, negated := matchRules(rules.Mode, rules.Matcher, path, isDir)
+		matched, negated := rules.match(path, isDir, f.Strict)
 		if !matched {
 			continue
 		}
@@ -61,3 +61,47 @@ func TestRuleSetFilterBaselineWhitelist(t *testing.T) {
 		t.Fatalf("expected other.txt to be excluded by whitelist baseline")
 	}
 }
+
+func TestRuleSetFilterNestedRulesDeeperWins(t *testing.T) {
+	nested := NewNestedRules(".gitignore")
+	nested.Add("", mustMatcherForRuleSet(t, "*.log\n"))
+	nested.Add("pkg", mustMatcherForRuleSet(t, "!keep.log\n/build/\n"))
+
+	filter := NewRuleSetFilter([]RuleSet{{Mode: ModeBlacklist, Nested: nested}}, ModeBlacklist)
+
+	if got := filter.Evaluate("debug.log", false).Include; got {
+		t.Fatalf("expected debug.log to be excluded by root rules")
+	}
+	if got := filter.Evaluate("pkg/keep.log", false).Include; !got {
+		t.Fatalf("expected pkg/keep.log to be re-included by nested rules")
+	}
+	if got := filter.Evaluate("keep.log", false).Include; got {
+		t.Fatalf("expected keep.log outside pkg to stay excluded")
+	}
+	if got := filter.Evaluate("pkg/build", true).Descend; got {
+		t.Fatalf("expected pkg/build to be skipped")
+	}
+	if got := filter.Evaluate("build", true).Descend; !got {
+		t.Fatalf("expected anchored nested rule not to match at the root")
+	}
+}
+
+func TestStrictRuleSetFilterExcludedParentWins(t *testing.T) {
+	rules := "assets/\n!assets/secret.txt\n"
+
+	blacklist := NewStrictRuleSetFilter([]RuleSet{{Mode: ModeBlacklist, Matcher: mustMatcherForRuleSet(t, rules)}}, ModeBlacklist)
+	if got := blacklist.Evaluate("assets/secret.txt", false).Include; got {
+		t.Fatalf("expected assets/secret.txt to stay excluded under an excluded parent")
+	}
+
+	whitelist := NewStrictRuleSetFilter([]RuleSet{{Mode: ModeWhitelist, Matcher: mustMatcherForRuleSet(t, rules)}}, ModeWhitelist)
+	if got := whitelist.Evaluate("assets/secret.txt", false).Include; !got {
+		t.Fatalf("expected assets/secret.txt to stay included under a whitelisted parent")
+	}
+	if got := whitelist.Evaluate("assets/img.png", false).Include; !got {
+		t.Fatalf("expected assets/img.png to be included")
+	}
+	if got := whitelist.Evaluate("other.txt", false).Include; got {
+		t.Fatalf("expected other.txt to be excluded")
+	}
+}
@@ -0,0 +1,304 @@
+package gitignore
+
+import (
+	"path"
+	"strings"
+)
+
+// ruleKind selects how a compiled rule is matched.
+type ruleKind uint8
+
+const (
+	// kindGlob rules are matched with wildmatch.
+	kindGlob ruleKind = iota
+	// kindLiteral rules contain no glob characters and are compared directly.
+	kindLiteral
+	// kindSuffix rules are a base-name "*" followed by a literal, such as "*.log".
+	kindSuffix
+	// kindPrefix rules are a literal followed by "*", such as "build*" or "out/tmp*".
+	kindPrefix
+)
+
+// compileRule fills in the fields Match uses to avoid wildmatch for simple patterns.
+func compileRule(rule Rule) Rule {
+	rule.compiled = true
+	rule.kind = kindGlob
+	rule.literal = ""
+	rule.glob = rule.Pattern
+	rule.baseName = !rule.HasSlash
+
+	// "**/name" matches name at any depth, exactly like the base-name pattern "name".
+	if rest, ok := strings.CutPrefix(rule.glob, "**/"); ok && rest != "" && !strings.Contains(rest, "/") {
+		rule.glob = rest
+		rule.baseName = true
+	}
+
+	glob := rule.glob
+	switch {
+	case glob == "":
+	case !hasGlobChars(glob):
+		rule.kind = kindLiteral
+		rule.literal = glob
+	case rule.baseName && glob[0] == '*' && !hasGlobChars(glob[1:]):
+		rule.kind = kindSuffix
+		rule.literal = glob[1:]
+	case glob[len(glob)-1] == '*' && !hasGlobChars(glob[:len(glob)-1]):
+		rule.kind = kindPrefix
+		rule.literal = glob[:len(glob)-1]
+	}
+	return rule
+}
+
+func hasGlobChars(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+// match applies a compiled rule's pattern, ignoring DirOnly.
+func (r *Rule) match(pathValue string) bool {
+	target := pathValue
+	if r.baseName {
+		target = path.Base(pathValue)
+	}
+	switch r.kind {
+	case kindLiteral:
+		return r.equal(target, r.literal)
+	case kindSuffix:
+		return len(target) >= len(r.literal) && r.equal(target[len(target)-len(r.literal):], r.literal)
+	case kindPrefix:
+		if len(target) < len(r.literal) || !r.equal(target[:len(r.literal)], r.literal) {
+			return false
+		}
+		// Under pathname matching the trailing "*" cannot cross a slash.
+		return r.baseName || strings.IndexByte(target[len(r.literal):], '/') == -1
+	case kindGlob:
+	}
+	flags := 0
+	if r.IgnoreCase {
+		flags |= wmCaseFold
+	}
+	if !r.baseName {
+		flags |= wmPathname
+	}
+	return wildmatch(r.glob, target, flags)
+}
+
+func (r *Rule) equal(a, b string) bool {
+	if r.IgnoreCase {
+		return equalFoldASCII(a, b)
+	}
+	return a == b
+}
+
+// equalFoldASCII compares strings ignoring ASCII letter case only, as git does.
+func equalFoldASCII(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] && toLower(a[i]) != toLower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII lower-cases ASCII letters, returning s itself when it has none.
+func lowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if isUpper(s[i]) {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				b[j] = toLower(b[j])
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// ruleIndex narrows the rules worth trying for a path. Rule indices in each list are ascending.
+type ruleIndex struct {
+	// byName holds literal base-name rules keyed by the name.
+	byName map[string][]int
+	// byPath holds literal rules with a slash keyed by the full path.
+	byPath map[string][]int
+	// byExt holds suffix rules keyed by the text after the last '.' of their suffix.
+	byExt map[string][]int
+	// byDirPrefix holds rules with a slash keyed by their leading literal directories,
+	// so "docs/api/*.md" is only tried for paths below "docs/api".
+	byDirPrefix map[string][]int
+	// byFirstByte holds base-name globs keyed by the bytes their first character can match.
+	byFirstByte map[byte][]int
+	// scan holds the rules that must be tried for every path.
+	scan []int
+}
+
+// buildIndex indexes the rules whose IgnoreCase equals fold. A folded index is keyed
+// by lower-cased text and must be consulted with a lower-cased path.
+func buildIndex(rules []Rule, fold bool) ruleIndex {
+	index := ruleIndex{
+		byName:      map[string][]int{},
+		byPath:      map[string][]int{},
+		byExt:       map[string][]int{},
+		byDirPrefix: map[string][]int{},
+		byFirstByte: map[byte][]int{},
+	}
+	key := func(s string) string { return s }
+	if fold {
+		key = lowerASCII
+	}
+	for i, rule := range rules {
+		if rule.IgnoreCase != fold {
+			continue
+		}
+		switch {
+		case rule.kind == kindLiteral && rule.baseName:
+			name := key(rule.literal)
+			index.byName[name] = append(index.byName[name], i)
+		case rule.kind == kindLiteral:
+			literal := key(rule.literal)
+			index.byPath[literal] = append(index.byPath[literal], i)
+		case rule.kind == kindSuffix && strings.Contains(rule.literal, "."):
+			ext := key(extension(rule.literal))
+			index.byExt[ext] = append(index.byExt[ext], i)
+		case !rule.baseName && literalDirPrefix(rule.glob) != "":
+			prefix := key(literalDirPrefix(rule.glob))
+			index.byDirPrefix[prefix] = append(index.byDirPrefix[prefix], i)
+		case rule.baseName && len(firstBytes(rule.glob)) > 0:
+			for _, c := range firstBytes(rule.glob) {
+				if fold {
+					c = toLower(c)
+				}
+				index.byFirstByte[c] = appendUnique(index.byFirstByte[c], i)
+			}
+		default:
+			index.scan = append(index.scan, i)
+		}
+	}
+	return index
+}
+
+// appendUnique appends i unless it is already last, which happens when a bracket
+// expression lists both cases of a letter in a folded index.
+func appendUnique(indices []int, i int) []int {
+	if len(indices) > 0 && indices[len(indices)-1] == i {
+		return indices
+	}
+	return append(indices, i)
+}
+
+// literalDirPrefix returns the leading directories of a slash pattern that contain no glob characters.
+func literalDirPrefix(pattern string) string {
+	end := 0
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '/' {
+			if hasGlobChars(pattern[:i]) {
+				break
+			}
+			end = i
+		}
+	}
+	return pattern[:end]
+}
+
+// firstBytes returns the bytes a pattern's first character can match, or nil when
+// it can match anything (a wildcard or a negated or complex bracket expression).
+func firstBytes(glob string) []byte {
+	if glob == "" {
+		return nil
+	}
+	switch glob[0] {
+	case '*', '?':
+		return nil
+	case '\\':
+		if len(glob) < 2 {
+			return nil
+		}
+		return []byte{glob[1]}
+	case '[':
+		return bracketBytes(glob)
+	}
+	return []byte{glob[0]}
+}
+
+// bracketBytes expands a simple leading bracket expression such as "[a-c_]".
+func bracketBytes(glob string) []byte {
+	end := strings.IndexByte(glob[1:], ']') + 1
+	if end <= 1 {
+		return nil
+	}
+	members := glob[1:end]
+	if strings.ContainsAny(members, "!^[\\") {
+		return nil
+	}
+	out := make([]byte, 0, len(members))
+	for i := 0; i < len(members); i++ {
+		if i+2 < len(members) && members[i+1] == '-' {
+			for c := int(members[i]); c <= int(members[i+2]); c++ {
+				out = append(out, byte(c))
+			}
+			i += 2
+			continue
+		}
+		out = append(out, members[i])
+	}
+	return out
+}
+
+func extension(name string) string {
+	dot := strings.LastIndexByte(name, '.')
+	if dot == -1 {
+		return ""
+	}
+	return name[dot+1:]
+}
+
+// lastMatch returns the index of the last rule matching the path, or -1.
+// With dirOnly set, only directory rules are considered.
+func (m *Matcher) lastMatch(pathValue string, isDir, dirOnly bool) int {
+	best := -1
+	consider := func(indices []int) {
+		for i := len(indices) - 1; i >= 0; i-- {
+			idx := indices[i]
+			if idx <= best {
+				return
+			}
+			rule := &m.rules[idx]
+			if dirOnly && !rule.DirOnly {
+				continue
+			}
+			if rule.DirOnly && !isDir {
+				continue
+			}
+			if rule.match(pathValue) {
+				best = idx
+				return
+			}
+		}
+	}
+
+	m.index.candidates(pathValue, consider)
+	if m.folded {
+		m.foldIndex.candidates(lowerASCII(pathValue), consider)
+	}
+	return best
+}
+
+// candidates passes every list of rules that may match the path to consider.
+func (index *ruleIndex) candidates(pathValue string, consider func([]int)) {
+	base := path.Base(pathValue)
+	consider(index.byName[base])
+	consider(index.byPath[pathValue])
+	if strings.IndexByte(base, '.') != -1 {
+		consider(index.byExt[extension(base)])
+	}
+	if base != "" {
+		consider(index.byFirstByte[base[0]])
+	}
+	for i := 0; i < len(pathValue); i++ {
+		if pathValue[i] == '/' {
+			consider(index.byDirPrefix[pathValue[:i]])
+		}
+	}
+	consider(index.scan)
+}
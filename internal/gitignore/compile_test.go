@@ -0,0 +1,218 @@
+package gitignore
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+// linearMatch is the uncompiled reference: every rule is tried with wildmatch, last match wins.
+func linearMatch(rules []Rule, pathValue string, isDir bool) int {
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.DirOnly && !isDir {
+			continue
+		}
+		flags := 0
+		if rule.IgnoreCase {
+			flags = wmCaseFold
+		}
+		if rule.HasSlash {
+			if wildmatch(rule.Pattern, pathValue, flags|wmPathname) {
+				return i
+			}
+			continue
+		}
+		if wildmatch(rule.Pattern, path.Base(pathValue), flags) {
+			return i
+		}
+	}
+	return -1
+}
+
+// syntheticIgnoreFile builds a large ignore file mixing the pattern shapes found in real projects.
+func syntheticIgnoreFile(lines int) string {
+	shapes := []func(i int) string{
+		func(i int) string { return fmt.Sprintf("name%d", i) },
+		func(i int) string { return fmt.Sprintf("*.ext%d", i) },
+		func(i int) string { return fmt.Sprintf("/build%d/", i) },
+		func(i int) string { return fmt.Sprintf("pkg%d/**/gen", i) },
+		func(i int) string { return fmt.Sprintf("tmp%d*", i) },
+		func(i int) string { return fmt.Sprintf("**/cache%d/", i) },
+		func(i int) string { return fmt.Sprintf("docs/%d/*.md", i) },
+		func(i int) string { return fmt.Sprintf("!keep%d.ext%d", i, i) },
+		func(i int) string { return fmt.Sprintf("[a-c]file%d.[ch]", i) },
+		func(i int) string { return fmt.Sprintf("src/*/out%d", i) },
+	}
+	var b strings.Builder
+	for i := 0; i < lines; i++ {
+		b.WriteString(shapes[i%len(shapes)](i))
+		b.WriteByte('\n')
+	}
+	b.WriteString("*.log\n!important.log\nnode_modules/\n")
+	return b.String()
+}
+
+func syntheticPaths(count int) []string {
+	dirs := []string{"", "src/app/", "pkg30/a/b/", "docs/6/", "web/node_modules/lib/", "cache5/x/", "build2/"}
+	names := []string{"main.go", "debug.log", "important.log", "name10", "x.ext11", "tmp24file", "gen", "bfile28.h", "out39", "readme.md"}
+	paths := make([]string, 0, count)
+	for i := 0; len(paths) < count; i++ {
+		paths = append(paths, dirs[i%len(dirs)]+names[(i/len(dirs))%len(names)])
+	}
+	return paths
+}
+
+func TestMatcherIndexAgreesWithLinearScan(t *testing.T) {
+	paths := syntheticPaths(500)
+	for _, p := range syntheticPaths(200) {
+		paths = append(paths, strings.ToUpper(p), strings.ToUpper(p[:1])+p[1:])
+	}
+	for _, ignoreCase := range []bool{false, true} {
+		matcher, err := ParseWithOptions(strings.NewReader(syntheticIgnoreFile(600)), ParseOptions{IgnoreCase: ignoreCase})
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		rules := matcher.Rules()
+		for _, p := range paths {
+			for _, isDir := range []bool{false, true} {
+				want := linearMatch(rules, p, isDir)
+				rule, ok := matcher.Match(p, isDir)
+				if !ok {
+					if want != -1 {
+						t.Fatalf("%s (dir=%v, icase=%v): expected rule %q, got no match", p, isDir, ignoreCase, rules[want].Raw)
+					}
+					continue
+				}
+				if want == -1 || rules[want].Raw != rule.Raw {
+					t.Fatalf("%s (dir=%v, icase=%v): got rule %q, linear scan disagrees (%d)", p, isDir, ignoreCase, rule.Raw, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMatcherIndexed(b *testing.B) {
+	matcher, err := Parse(strings.NewReader(syntheticIgnoreFile(600)))
+	if err != nil {
+		b.Fatalf("parse: %v", err)
+	}
+	paths := syntheticPaths(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matcher.Match(paths[i%len(paths)], false)
+	}
+}
+
+// BenchmarkMatcherLinearScan measures Matcher.Match as it was before rules were
+// indexed: every rule tried with wildmatch, last match wins.
+func BenchmarkMatcherLinearScan(b *testing.B) {
+	matcher, err := Parse(strings.NewReader(syntheticIgnoreFile(600)))
+	if err != nil {
+		b.Fatalf("parse: %v", err)
+	}
+	rules := matcher.Rules()
+	paths := syntheticPaths(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(rules, paths[i%len(paths)], false)
+	}
+}
+
+// BenchmarkMatcherPathMatchScan measures the matcher weaver had before wildmatch:
+// every rule tried in turn, splitting the path on each call and matching each
+// segment with path.Match, backtracking on "**".
+func BenchmarkMatcherPathMatchScan(b *testing.B) {
+	matcher, err := Parse(strings.NewReader(syntheticIgnoreFile(600)))
+	if err != nil {
+		b.Fatalf("parse: %v", err)
+	}
+	rules := make([]segmentRule, 0, len(matcher.Rules()))
+	for _, rule := range matcher.Rules() {
+		rules = append(rules, newSegmentRule(rule))
+	}
+	paths := syntheticPaths(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pathValue := paths[i%len(paths)]
+		for j := len(rules) - 1; j >= 0; j-- {
+			if rules[j].match(pathValue, false) {
+				break
+			}
+		}
+	}
+}
+
+// segmentRule is a rule as the path.Match matcher held it.
+type segmentRule struct {
+	Rule
+	segments []string
+}
+
+func newSegmentRule(rule Rule) segmentRule {
+	r := segmentRule{Rule: rule}
+	for _, segment := range strings.Split(rule.Pattern, "/") {
+		if segment == "" {
+			continue
+		}
+		if segment != "**" {
+			for strings.Contains(segment, "**") {
+				segment = strings.ReplaceAll(segment, "**", "*")
+			}
+		}
+		r.segments = append(r.segments, segment)
+	}
+	return r
+}
+
+func (r segmentRule) match(pathValue string, isDir bool) bool {
+	if r.DirOnly && !isDir {
+		return false
+	}
+	if r.HasSlash {
+		return matchPathSegments(r.segments, splitPathSegments(pathValue))
+	}
+	if len(r.segments) != 1 {
+		return false
+	}
+	matched, err := path.Match(r.segments[0], path.Base(pathValue))
+	return err == nil && matched
+}
+
+func splitPathSegments(pathValue string) []string {
+	parts := strings.Split(pathValue, "/")
+	out := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func matchPathSegments(patternSegments, pathSegments []string) bool {
+	for pi, pattern := range patternSegments {
+		if pattern == "**" {
+			if pi == len(patternSegments)-1 {
+				return true
+			}
+			for i := pi; i <= len(pathSegments); i++ {
+				if matchPathSegments(patternSegments[pi+1:], pathSegments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if pi >= len(pathSegments) {
+			return false
+		}
+		if matched, err := path.Match(pattern, pathSegments[pi]); err != nil || !matched {
+			return false
+		}
+	}
+	return len(patternSegments) == len(pathSegments)
+}
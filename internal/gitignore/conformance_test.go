@@ -0,0 +1,147 @@
+package gitignore
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateFixtures = flag.Bool("update", false, "re-record testdata/check-ignore.json with the local git binary")
+
+const checkIgnoreFixture = "testdata/check-ignore.json"
+
+// conformanceCase is a set of patterns and the paths git check-ignore was asked about.
+// Paths ending in "/" are directories. IgnoreCase cases are recorded with core.ignorecase.
+type conformanceCase struct {
+	Name       string            `json:"name"`
+	IgnoreCase bool              `json:"ignoreCase,omitempty"`
+	Patterns   []string          `json:"patterns"`
+	Paths      []conformancePath `json:"paths"`
+}
+
+type conformancePath struct {
+	Path    string `json:"path"`
+	Ignored bool   `json:"ignored"`
+}
+
+func loadConformanceCases(t *testing.T) []conformanceCase {
+	t.Helper()
+	data, err := os.ReadFile(checkIgnoreFixture)
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	var cases []conformanceCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	return cases
+}
+
+func TestMatchStrictConformsToGitCheckIgnore(t *testing.T) {
+	cases := loadConformanceCases(t)
+	if *updateFixtures {
+		cases = recordConformanceCases(t, cases)
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			patterns := strings.NewReader(strings.Join(tc.Patterns, "\n") + "\n")
+			matcher, err := ParseWithOptions(patterns, ParseOptions{IgnoreCase: tc.IgnoreCase})
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			for _, p := range tc.Paths {
+				isDir := strings.HasSuffix(p.Path, "/")
+				rule, ok := matcher.MatchStrict(strings.TrimSuffix(p.Path, "/"), isDir)
+				got := ok && !rule.Negate
+				if got != p.Ignored {
+					t.Errorf("%s: ignored=%v, git says %v (rule %q)", p.Path, got, p.Ignored, rule.Raw)
+				}
+			}
+		})
+	}
+}
+
+// recordConformanceCases asks git check-ignore for the expected answer of every path
+// and rewrites the fixture file.
+func recordConformanceCases(t *testing.T, cases []conformanceCase) []conformanceCase {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Fatalf("git is required to record fixtures: %v", err)
+	}
+
+	for i := range cases {
+		repo := t.TempDir()
+		runGit(t, repo, "init", "-q")
+		writeFixtureFile(t, filepath.Join(repo, ".gitignore"), strings.Join(cases[i].Patterns, "\n")+"\n")
+		for _, p := range cases[i].Paths {
+			full := filepath.Join(repo, filepath.FromSlash(strings.TrimSuffix(p.Path, "/")))
+			if strings.HasSuffix(p.Path, "/") {
+				if err := os.MkdirAll(full, 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				continue
+			}
+			writeFixtureFile(t, full, "")
+		}
+		for j, p := range cases[i].Paths {
+			args := []string{"-c", fmt.Sprintf("core.ignorecase=%t", cases[i].IgnoreCase)}
+			args = append(args, "check-ignore", "-q", "--no-index", "--", strings.TrimSuffix(p.Path, "/"))
+			cmd := exec.Command("git", args...)
+			cmd.Dir = repo
+			cmd.Env = isolatedGitEnv(repo)
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			switch {
+			case err == nil:
+				cases[i].Paths[j].Ignored = true
+			case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+				cases[i].Paths[j].Ignored = false
+			default:
+				t.Fatalf("%s: git check-ignore %s: %v", cases[i].Name, p.Path, err)
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(cases, "", "  ")
+	if err != nil {
+		t.Fatalf("encode fixture: %v", err)
+	}
+	writeFixtureFile(t, checkIgnoreFixture, string(data)+"\n")
+	return cases
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = isolatedGitEnv(dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// isolatedGitEnv keeps user and system configuration (and their excludes files) out of recordings.
+func isolatedGitEnv(home string) []string {
+	return append(os.Environ(),
+		"HOME="+home,
+		"XDG_CONFIG_HOME="+filepath.Join(home, ".config"),
+		"GIT_CONFIG_NOSYSTEM=1",
+	)
+}
+
+func writeFixtureFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package gitignore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Repository describes the git work tree that contains a directory.
+type Repository struct {
+	WorkTree  string
+	GitDir    string
+	CommonDir string
+}
+
+// FindRepository walks up from dir looking for a .git directory or file.
+// The boolean result is false when dir is not inside a git work tree.
+func FindRepository(dir string) (Repository, bool, error) {
+	current, err := filepath.Abs(dir)
+	if err != nil {
+		return Repository{}, false, err
+	}
+	for {
+		dotGit := filepath.Join(current, ".git")
+		info, err := os.Stat(dotGit)
+		switch {
+		case err == nil && info.IsDir():
+			return newRepository(current, dotGit)
+		case err == nil:
+			gitDir, err := readGitDirFile(dotGit)
+			if err != nil {
+				return Repository{}, false, err
+			}
+			return newRepository(current, gitDir)
+		case !errors.Is(err, os.ErrNotExist):
+			return Repository{}, false, err
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			return Repository{}, false, nil
+		}
+		current = parent
+	}
+}
+
+func newRepository(workTree, gitDir string) (Repository, bool, error) {
+	repo := Repository{WorkTree: workTree, GitDir: gitDir, CommonDir: gitDir}
+	// Linked work trees keep info/exclude and config in the common directory.
+	// #nosec G304 -- path is derived from the discovered git directory.
+	data, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		repo.CommonDir = filepath.Clean(common)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return Repository{}, false, err
+	}
+	return repo, true, nil
+}
+
+func readGitDirFile(dotGit string) (string, error) {
+	// #nosec G304 -- path is derived from the directory being scanned.
+	data, err := os.ReadFile(dotGit)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(data))
+	gitDir, ok := strings.CutPrefix(line, "gitdir:")
+	if !ok {
+		return "", fmt.Errorf("invalid git file %s", dotGit)
+	}
+	gitDir = strings.TrimSpace(gitDir)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(dotGit), gitDir)
+	}
+	return filepath.Clean(gitDir), nil
+}
+
+// InfoExcludePath returns the path of the repository's info/exclude file.
+func (r Repository) InfoExcludePath() string {
+	return filepath.Join(r.CommonDir, "info", "exclude")
+}
+
+// GlobalExcludesFile resolves the user's global excludes file the way git does:
+// core.excludesFile from the repository or global config, falling back to
+// $XDG_CONFIG_HOME/git/ignore (or ~/.config/git/ignore).
+// A relative core.excludesFile is resolved against the work tree, where git
+// runs, or the home directory outside one.
+// repo may be the zero value when the root is not inside a git work tree.
+func GlobalExcludesFile(repo Repository) (string, error) {
+	home, _ := os.UserHomeDir()
+	xdgHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgHome == "" && home != "" {
+		xdgHome = filepath.Join(home, ".config")
+	}
+
+	// Later files override earlier ones, matching git's config precedence.
+	configFiles := make([]string, 0, 3)
+	if xdgHome != "" {
+		configFiles = append(configFiles, filepath.Join(xdgHome, "git", "config"))
+	}
+	if home != "" {
+		configFiles = append(configFiles, filepath.Join(home, ".gitconfig"))
+	}
+	if repo.CommonDir != "" {
+		configFiles = append(configFiles, filepath.Join(repo.CommonDir, "config"))
+	}
+
+	value := ""
+	for _, configFile := range configFiles {
+		found, ok, err := readConfigValue(configFile, "core", "excludesfile")
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", configFile, err)
+		}
+		if ok {
+			value = found
+		}
+	}
+
+	if value == "" {
+		if xdgHome == "" {
+			return "", nil
+		}
+		return filepath.Join(xdgHome, "git", "ignore"), nil
+	}
+	if rest, ok := strings.CutPrefix(value, "~/"); ok && home != "" {
+		return filepath.Join(home, filepath.FromSlash(rest)), nil
+	}
+	path := filepath.FromSlash(value)
+	if !filepath.IsAbs(path) {
+		switch {
+		case repo.WorkTree != "":
+			path = filepath.Join(repo.WorkTree, path)
+		case home != "":
+			path = filepath.Join(home, path)
+		}
+	}
+	return path, nil
+}
+
+// readConfigValue returns the last value of section.key in a git config file.
+// Section and key names are compared case-insensitively; subsections are ignored.
+func readConfigValue(configPath, section, key string) (string, bool, error) {
+	// #nosec G304 -- git config locations are fixed by git conventions.
+	file, err := os.Open(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	defer file.Close()
+
+	value := ""
+	found := false
+	inSection := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end == -1 {
+				continue
+			}
+			name := strings.TrimSpace(line[1:end])
+			if strings.ContainsAny(name, " \t\"") {
+				name = "" // subsections such as [core "x"] never hold core.excludesFile
+			}
+			inSection = strings.EqualFold(name, section)
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" {
+				continue
+			}
+		}
+		if !inSection {
+			continue
+		}
+		name, raw, hasValue := strings.Cut(line, "=")
+		if !strings.EqualFold(strings.TrimSpace(name), key) {
+			continue
+		}
+		if !hasValue {
+			value = ""
+		} else {
+			value = parseConfigValue(raw)
+		}
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+	return value, found, nil
+}
+
+func parseConfigValue(raw string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(raw[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(b.String())
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
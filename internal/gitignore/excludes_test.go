@@ -0,0 +1,192 @@
+package gitignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: " ~/.gitignore_global ", want: "~/.gitignore_global"},
+		{raw: ` "with spaces.ignore"`, want: "with spaces.ignore"},
+		{raw: ` "a;b#c" ; comment`, want: "a;b#c"},
+		{raw: " plain # comment", want: "plain"},
+		{raw: ` "say \"hi\""`, want: `say "hi"`},
+		{raw: ` C:\\ignore`, want: `C:\ignore`},
+		{raw: ` tab\there`, want: "tab\there"},
+		{raw: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := parseConfigValue(tt.raw); got != tt.want {
+			t.Fatalf("parseConfigValue(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestReadConfigValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		want      string
+		wantFound bool
+	}{
+		{name: "plain", config: "[core]\n\texcludesFile = a.ignore\n", want: "a.ignore", wantFound: true},
+		{name: "case-insensitive section and key", config: "[CORE]\n\tEXCLUDESFILE = a.ignore\n", want: "a.ignore", wantFound: true},
+		{name: "last value wins", config: "[core]\nexcludesfile = a\n[core]\nexcludesfile = b\n", want: "b", wantFound: true},
+		{name: "key on the section line", config: "[core] excludesfile = a\n", want: "a", wantFound: true},
+		{name: "key without value", config: "[core]\n\texcludesfile\n", want: "", wantFound: true},
+		{name: "other section", config: "[user]\n\texcludesfile = a\n", wantFound: false},
+		{name: "subsection", config: "[core \"x\"]\n\texcludesfile = a\n", wantFound: false},
+		{name: "comments", config: "# [core]\n; excludesfile = a\n[core]\n# excludesfile = b\n", wantFound: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(configPath, []byte(tt.config), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			got, found, err := readConfigValue(configPath, "core", "excludesfile")
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if got != tt.want || found != tt.wantFound {
+				t.Fatalf("got %q, %v, want %q, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+
+	_, found, err := readConfigValue(filepath.Join(t.TempDir(), "missing"), "core", "excludesfile")
+	if err != nil || found {
+		t.Fatalf("expected a missing config to hold no value, got %v, %v", found, err)
+	}
+}
+
+func TestGlobalExcludesFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// files are written under a temporary directory holding home, xdg
+		// and the repositories.
+		files map[string]string
+		// xdg sets XDG_CONFIG_HOME to the xdg directory.
+		xdg bool
+		// repo is the directory to look up the repository from, if any.
+		repo string
+		// want is relative to the temporary directory.
+		want string
+	}{
+		{
+			name: "default without XDG_CONFIG_HOME",
+			want: "home/.config/git/ignore",
+		},
+		{
+			name: "default with XDG_CONFIG_HOME",
+			xdg:  true,
+			want: "xdg/git/ignore",
+		},
+		{
+			name:  "XDG config",
+			files: map[string]string{"xdg/git/config": "[core]\n\texcludesFile = /abs/xdg.ignore\n"},
+			xdg:   true,
+			want:  "/abs/xdg.ignore",
+		},
+		{
+			name: "home config overrides XDG config",
+			files: map[string]string{
+				"xdg/git/config":  "[core]\n\texcludesFile = /abs/xdg.ignore\n",
+				"home/.gitconfig": "[core]\n\texcludesFile = /abs/home.ignore\n",
+			},
+			xdg:  true,
+			want: "/abs/home.ignore",
+		},
+		{
+			name:  "tilde expands to home",
+			files: map[string]string{"home/.gitconfig": "[core]\n\texcludesFile = ~/global.ignore\n"},
+			want:  "home/global.ignore",
+		},
+		{
+			name:  "quoted value",
+			files: map[string]string{"home/.gitconfig": "[Core]\n\tExcludesFile = \"~/with space.ignore\" ; note\n"},
+			want:  "home/with space.ignore",
+		},
+		{
+			name:  "relative outside a repository",
+			files: map[string]string{"home/.gitconfig": "[core]\n\texcludesFile = global.ignore\n"},
+			want:  "home/global.ignore",
+		},
+		{
+			name: "repository config overrides home config",
+			files: map[string]string{
+				"home/.gitconfig":  "[core]\n\texcludesFile = /abs/home.ignore\n",
+				"repo/.git/config": "[core]\n\texcludesFile = /abs/repo.ignore\n",
+			},
+			repo: "repo",
+			want: "/abs/repo.ignore",
+		},
+		{
+			name: "relative inside a repository",
+			files: map[string]string{
+				"home/.gitconfig": "[core]\n\texcludesFile = global.ignore\n",
+				"repo/.git/HEAD":  "ref: refs/heads/main\n",
+			},
+			repo: "repo/sub",
+			want: "repo/global.ignore",
+		},
+		{
+			name: "linked work tree reads the common config",
+			files: map[string]string{
+				"main/.git/config":                "[core]\n\texcludesFile = shared.ignore\n",
+				"main/.git/worktrees/w/commondir": "../..\n",
+				"work/.git":                       "gitdir: ../main/.git/worktrees/w\n",
+			},
+			repo: "work",
+			want: "work/shared.ignore",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			for name, content := range tt.files {
+				full := filepath.Join(base, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			t.Setenv("HOME", filepath.Join(base, "home"))
+			t.Setenv("XDG_CONFIG_HOME", "")
+			if tt.xdg {
+				t.Setenv("XDG_CONFIG_HOME", filepath.Join(base, "xdg"))
+			}
+
+			var repo Repository
+			if tt.repo != "" {
+				dir := filepath.Join(base, filepath.FromSlash(tt.repo))
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				found, ok, err := FindRepository(dir)
+				if err != nil || !ok {
+					t.Fatalf("find repository: %v, %v", ok, err)
+				}
+				repo = found
+			}
+			got, err := GlobalExcludesFile(repo)
+			if err != nil {
+				t.Fatalf("global excludes: %v", err)
+			}
+			want := filepath.FromSlash(tt.want)
+			if !filepath.IsAbs(want) {
+				want = filepath.Join(base, want)
+			}
+			if got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -12,26 +12,50 @@ import (
 )
 
 // Rule represents a single .gitignore pattern.
+// Source and Line record where the rule was read from, when known.
+// IgnoreCase rules match regardless of ASCII letter case, like git's core.ignorecase.
 type Rule struct {
-	Raw      string
-	Pattern  string
-	Negate   bool
-	DirOnly  bool
-	Anchored bool
-	HasSlash bool
-
-	segments       []string
-	segmentPattern string
+	Raw        string
+	Source     string
+	Line       int
+	Pattern    string
+	Negate     bool
+	DirOnly    bool
+	Anchored   bool
+	HasSlash   bool
+	IgnoreCase bool
+
+	compiled bool
+	kind     ruleKind
+	glob     string
+	literal  string
+	baseName bool
 }
 
-// Matcher stores compiled rules.
+// Matcher stores compiled rules and indexes them so that a path is only
+// tried against rules that can plausibly match it.
 type Matcher struct {
 	rules []Rule
+	index ruleIndex
+	// foldIndex holds the IgnoreCase rules, keyed by lower-cased names and paths.
+	foldIndex ruleIndex
+	folded    bool
 }
 
 // NewMatcher creates a matcher from pre-parsed rules.
 func NewMatcher(rules []Rule) *Matcher {
-	return &Matcher{rules: rules}
+	compiled := make([]Rule, len(rules))
+	folded := false
+	for i, rule := range rules {
+		compiled[i] = compileRule(rule)
+		folded = folded || rule.IgnoreCase
+	}
+	return &Matcher{
+		rules:     compiled,
+		index:     buildIndex(compiled, false),
+		foldIndex: buildIndex(compiled, true),
+		folded:    folded,
+	}
 }
 
 // Rules returns the parsed rules in order.
@@ -39,8 +63,82 @@ func (m *Matcher) Rules() []Rule {
 	return m.rules
 }
 
+// Match returns the last rule matching the path itself, without looking at parent directories.
+func (m *Matcher) Match(pathValue string, isDir bool) (Rule, bool) {
+	if m == nil {
+		return Rule{}, false
+	}
+	if idx := m.lastMatch(pathValue, isDir, false); idx != -1 {
+		return m.rules[idx], true
+	}
+	return Rule{}, false
+}
+
+// MatchAll returns every rule matching the path itself, in file order.
+func (m *Matcher) MatchAll(pathValue string, isDir bool) []Rule {
+	if m == nil {
+		return nil
+	}
+	var matches []Rule
+	for _, rule := range m.rules {
+		if rule.Match(pathValue, isDir) {
+			matches = append(matches, rule)
+		}
+	}
+	return matches
+}
+
+// MatchDescendant returns the last rule matching the path, where directory rules
+// also match everything below the directories they match.
+func (m *Matcher) MatchDescendant(pathValue string, isDir bool) (Rule, bool) {
+	if m == nil {
+		return Rule{}, false
+	}
+	best := m.lastMatch(pathValue, isDir, false)
+	for i := 0; i < len(pathValue); i++ {
+		if pathValue[i] != '/' {
+			continue
+		}
+		if idx := m.lastMatch(pathValue[:i], true, true); idx > best {
+			best = idx
+		}
+	}
+	if best == -1 {
+		return Rule{}, false
+	}
+	return m.rules[best], true
+}
+
+// MatchStrict evaluates the path with git's semantics: when a parent directory is
+// excluded, the rule that excluded it decides, and the path cannot be re-included
+// by a later negated rule. The returned rule is ignored unless its Negate is set.
+func (m *Matcher) MatchStrict(pathValue string, isDir bool) (Rule, bool) {
+	for i := 0; i < len(pathValue); i++ {
+		if pathValue[i] != '/' {
+			continue
+		}
+		if rule, ok := m.Match(pathValue[:i], true); ok && !rule.Negate {
+			return rule, true
+		}
+	}
+	return m.Match(pathValue, isDir)
+}
+
+// ParseOptions controls how rules are read.
+type ParseOptions struct {
+	// Source is recorded on each rule, along with its line number, for diagnostics.
+	Source string
+	// IgnoreCase makes every rule match regardless of ASCII letter case.
+	IgnoreCase bool
+}
+
 // LoadFile loads a .gitignore file. If the file does not exist, an empty matcher is returned.
 func LoadFile(path string) (*Matcher, error) {
+	return LoadFileWithOptions(path, ParseOptions{})
+}
+
+// LoadFileWithOptions loads a .gitignore file like LoadFile. The source defaults to path.
+func LoadFileWithOptions(path string, opts ParseOptions) (*Matcher, error) {
 	// #nosec G304 -- rule files are user-specified by design.
 	file, err := os.Open(path)
 	if err != nil {
@@ -51,11 +149,25 @@ func LoadFile(path string) (*Matcher, error) {
 	}
 	defer file.Close()
 
-	return Parse(file)
+	if opts.Source == "" {
+		opts.Source = path
+	}
+	return ParseWithOptions(file, opts)
 }
 
 // Parse reads gitignore rules from a reader.
 func Parse(r io.Reader) (*Matcher, error) {
+	return ParseWithOptions(r, ParseOptions{})
+}
+
+// ParseWithSource reads gitignore rules from a reader, recording source and
+// line numbers on each rule for diagnostics.
+func ParseWithSource(r io.Reader, source string) (*Matcher, error) {
+	return ParseWithOptions(r, ParseOptions{Source: source})
+}
+
+// ParseWithOptions reads gitignore rules from a reader.
+func ParseWithOptions(r io.Reader, opts ParseOptions) (*Matcher, error) {
 	scanner := bufio.NewScanner(r)
 	rules := make([]Rule, 0)
 	lineNo := 0
@@ -63,7 +175,10 @@ func Parse(r io.Reader) (*Matcher, error) {
 	for scanner.Scan() {
 		lineNo++
 		line := strings.TrimRight(scanner.Text(), "\r")
-		line = trimTrailingWhitespace(line)
+		if lineNo == 1 {
+			line = strings.TrimPrefix(line, utf8BOM)
+		}
+		line = trimTrailingSpaces(line)
 		if line == "" {
 			continue
 		}
@@ -71,10 +186,10 @@ func Parse(r io.Reader) (*Matcher, error) {
 			continue
 		}
 
-		rule, err := parseRule(line)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: %w", lineNo, err)
-		}
+		rule := parseRule(line)
+		rule.Source = opts.Source
+		rule.Line = lineNo
+		rule.IgnoreCase = opts.IgnoreCase
 		if rule.Pattern == "" {
 			continue
 		}
@@ -88,25 +203,39 @@ func Parse(r io.Reader) (*Matcher, error) {
 	return NewMatcher(rules), nil
 }
 
+const utf8BOM = "\xef\xbb\xbf"
+
 func isComment(line string) bool {
 	return strings.HasPrefix(line, "#")
 }
 
-func trimTrailingWhitespace(line string) string {
-	for len(line) > 0 {
-		last := line[len(line)-1]
-		if last != ' ' && last != '\t' {
-			return line
-		}
-		if isEscaped(line, len(line)-1) {
-			return line
+// trimTrailingSpaces removes unescaped trailing spaces, like git's trim_trailing_spaces.
+// Tabs are kept, and a space preceded by a backslash ends the trimming.
+func trimTrailingSpaces(line string) string {
+	lastSpace := -1
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			if lastSpace == -1 {
+				lastSpace = i
+			}
+		case '\\':
+			i++
+			if i >= len(line) {
+				return line
+			}
+			lastSpace = -1
+		default:
+			lastSpace = -1
 		}
-		line = line[:len(line)-1]
+	}
+	if lastSpace != -1 {
+		return line[:lastSpace]
 	}
 	return line
 }
 
-func parseRule(line string) (Rule, error) {
+func parseRule(line string) Rule {
 	rule := Rule{Raw: line}
 
 	if strings.HasPrefix(line, "!") {
@@ -119,110 +248,27 @@ func parseRule(line string) (Rule, error) {
 		line = line[1:]
 	}
 
-	if len(line) > 0 && line[len(line)-1] == '/' && !isEscaped(line, len(line)-1) {
+	// Like git, a trailing slash always marks a directory pattern, even after a backslash.
+	if strings.HasSuffix(line, "/") {
 		rule.DirOnly = true
 		line = line[:len(line)-1]
 	}
 
-	if line == "" {
-		return rule, nil
-	}
-
 	rule.Pattern = line
 	rule.HasSlash = rule.Anchored || strings.Contains(line, "/")
-
-	if rule.HasSlash {
-		segments := splitSegments(line)
-		normalized := make([]string, 0, len(segments))
-		for _, seg := range segments {
-			seg = normalizeSegment(seg)
-			if seg == "" {
-				continue
-			}
-			if seg != "**" {
-				if err := validateSegment(seg); err != nil {
-					return rule, err
-				}
-			}
-			normalized = append(normalized, seg)
-		}
-		rule.segments = normalized
-		return rule, nil
-	}
-
-	segment := normalizeSegment(line)
-	if err := validateSegment(segment); err != nil {
-		return rule, err
-	}
-	rule.segmentPattern = segment
-	return rule, nil
-}
-
-func normalizeSegment(segment string) string {
-	if segment == "**" {
-		return segment
-	}
-	for strings.Contains(segment, "**") {
-		segment = strings.ReplaceAll(segment, "**", "*")
-	}
-	return segment
-}
-
-func validateSegment(segment string) error {
-	_, err := path.Match(segment, "validate")
-	if err != nil {
-		return fmt.Errorf("invalid pattern %q: %w", segment, err)
-	}
-	return nil
-}
-
-func splitSegments(pattern string) []string {
-	parts := strings.Split(pattern, "/")
-	out := make([]string, 0, len(parts))
-	for _, part := range parts {
-		if part == "" {
-			continue
-		}
-		out = append(out, part)
-	}
-	return out
-}
-
-func splitPath(pathValue string) []string {
-	parts := strings.Split(pathValue, "/")
-	out := make([]string, 0, len(parts))
-	for _, part := range parts {
-		if part == "" {
-			continue
-		}
-		out = append(out, part)
-	}
-	return out
-}
-
-func isEscaped(line string, index int) bool {
-	if index <= 0 {
-		return false
-	}
-	count := 0
-	for i := index - 1; i >= 0 && line[i] == '\\'; i-- {
-		count++
-	}
-	return count%2 == 1
+	return rule
 }
 
 // Match reports whether the rule matches the provided path.
+// Patterns containing a slash match the whole path; others match its base name.
 func (r Rule) Match(pathValue string, isDir bool) bool {
 	if r.DirOnly && !isDir {
 		return false
 	}
-
-	if r.HasSlash {
-		return matchSegments(r.segments, splitPath(pathValue))
+	if !r.compiled {
+		r = compileRule(r)
 	}
-
-	base := path.Base(pathValue)
-	return matchSegment(r.segmentPattern, base)
+	return r.match(pathValue)
 }
 
 // MatchDescendant reports whether the rule matches the path or any ancestor directory.
@@ -247,47 +293,12 @@ func (r Rule) MatchDescendant(pathValue string, isDir bool) bool {
 	return false
 }
 
-func matchSegment(pattern, name string) bool {
-	matched, err := path.Match(pattern, name)
-	if err != nil {
-		return false
-	}
-	return matched
-}
-
-func matchSegments(patternSegments, pathSegments []string) bool {
-	if len(patternSegments) == 0 {
-		return len(pathSegments) == 0
+// String formats the rule like git check-ignore -v: source:line:pattern.
+func (r Rule) String() string {
+	if r.Source == "" && r.Line == 0 {
+		return r.Raw
 	}
-
-	pi := 0
-	si := 0
-	for pi < len(patternSegments) {
-		pattern := patternSegments[pi]
-		if pattern == "**" {
-			if pi == len(patternSegments)-1 {
-				return true
-			}
-			nextPattern := patternSegments[pi+1:]
-			for i := si; i <= len(pathSegments); i++ {
-				if matchSegments(nextPattern, pathSegments[i:]) {
-					return true
-				}
-			}
-			return false
-		}
-
-		if si >= len(pathSegments) {
-			return false
-		}
-		if !matchSegment(pattern, pathSegments[si]) {
-			return false
-		}
-		pi++
-		si++
-	}
-
-	return si == len(pathSegments)
+	return fmt.Sprintf("%s:%d:%s", r.Source, r.Line, r.Raw)
 }
 
 // RelativeGitPath converts an OS path to a slash-separated relative path.
@@ -0,0 +1,309 @@
+package gitignore
+
+import "strings"
+
+// wildmatch flags, mirroring git's wildmatch.h.
+const (
+	wmCaseFold = 1 << iota
+	wmPathname
+)
+
+// Results of a single matching attempt. The abort results let "*" stop
+// backtracking early, exactly as git's dowild does.
+const (
+	wmMatch = iota
+	wmNoMatch
+	wmAbortAll
+	wmAbortToStarStar
+)
+
+// wildmatch reports whether text matches the glob pattern using git's wildmatch
+// semantics: "?", "*", "**" (only as a whole path component under wmPathname),
+// bracket expressions with "!" or "^" negation, ranges and POSIX classes such as
+// "[[:digit:]]", and backslash escapes. Matching is done on bytes, like git.
+func wildmatch(pattern, text string, flags int) bool {
+	return dowild(pattern, 0, text, 0, flags) == wmMatch
+}
+
+func dowild(pattern string, p int, text string, t int, flags int) int {
+	for ; p < len(pattern); p, t = p+1, t+1 {
+		pCh := pattern[p]
+		if t >= len(text) && pCh != '*' {
+			return wmAbortAll
+		}
+		var tCh byte
+		if t < len(text) {
+			tCh = text[t]
+		}
+		if flags&wmCaseFold != 0 {
+			tCh = toLower(tCh)
+			pCh = toLower(pCh)
+		}
+
+		switch pCh {
+		case '\\':
+			// Literal match with the following character; a trailing
+			// backslash can only match a NUL and therefore never matches.
+			p++
+			if p >= len(pattern) {
+				return wmNoMatch
+			}
+			// Like git, the escaped character itself is not case-folded.
+			pCh = pattern[p]
+			if tCh != pCh {
+				return wmNoMatch
+			}
+		case '?':
+			if flags&wmPathname != 0 && tCh == '/' {
+				return wmNoMatch
+			}
+		case '*':
+			matchSlash := false
+			p++
+			if p < len(pattern) && pattern[p] == '*' {
+				prev := p - 2
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				atComponentStart := prev < 0 || pattern[prev] == '/'
+				atComponentEnd := p >= len(pattern) || pattern[p] == '/' ||
+					(pattern[p] == '\\' && p+1 < len(pattern) && pattern[p+1] == '/')
+				if flags&wmPathname == 0 || (atComponentStart && atComponentEnd) {
+					// "**/" may also match nothing: try the rest of the
+					// pattern against the remaining text right away.
+					if flags&wmPathname != 0 && p < len(pattern) && pattern[p] == '/' &&
+						dowild(pattern, p+1, text, t, flags) == wmMatch {
+						return wmMatch
+					}
+					matchSlash = true
+				}
+			} else {
+				// Without wmPathname, "*" behaves like "**".
+				matchSlash = flags&wmPathname == 0
+			}
+
+			if p >= len(pattern) {
+				// A trailing "**" matches everything; a trailing "*" only
+				// when no slash is left.
+				if !matchSlash && strings.IndexByte(text[t:], '/') != -1 {
+					return wmNoMatch
+				}
+				return wmMatch
+			}
+			if !matchSlash && pattern[p] == '/' {
+				// One asterisk followed by a slash matches the next directory.
+				slash := strings.IndexByte(text[t:], '/')
+				if slash == -1 {
+					return wmNoMatch
+				}
+				// The slash itself is consumed by the loop.
+				t += slash
+				continue
+			}
+
+			for {
+				if t >= len(text) {
+					break
+				}
+				// Advance quickly when "*" is followed by a literal: the text
+				// before that literal must belong to "*".
+				if !isGlobSpecial(pattern[p]) {
+					pCh = pattern[p]
+					if flags&wmCaseFold != 0 {
+						pCh = toLower(pCh)
+					}
+					for t < len(text) {
+						tCh = text[t]
+						if !matchSlash && tCh == '/' {
+							break
+						}
+						if flags&wmCaseFold != 0 {
+							tCh = toLower(tCh)
+						}
+						if tCh == pCh {
+							break
+						}
+						t++
+					}
+					if t >= len(text) || tCh != pCh {
+						return wmNoMatch
+					}
+				}
+				matched := dowild(pattern, p, text, t, flags)
+				if matched != wmNoMatch {
+					if !matchSlash || matched != wmAbortToStarStar {
+						return matched
+					}
+				} else if !matchSlash && text[t] == '/' {
+					return wmAbortToStarStar
+				}
+				t++
+			}
+			return wmAbortAll
+		case '[':
+			next, result := matchBracket(pattern, p, tCh, flags)
+			if result != wmMatch {
+				return result
+			}
+			p = next
+		default:
+			if tCh != pCh {
+				return wmNoMatch
+			}
+		}
+	}
+
+	if t < len(text) {
+		return wmNoMatch
+	}
+	return wmMatch
+}
+
+// matchBracket matches tCh against the bracket expression starting at pattern[p] == '['.
+// It returns the index of the closing ']' and wmMatch on success.
+func matchBracket(pattern string, p int, tCh byte, flags int) (int, int) {
+	at := func(i int) byte {
+		if i < len(pattern) {
+			return pattern[i]
+		}
+		return 0
+	}
+
+	p++
+	pCh := at(p)
+	if pCh == '^' {
+		pCh = '!'
+	}
+	negated := pCh == '!'
+	if negated {
+		p++
+		pCh = at(p)
+	}
+
+	var prevCh byte
+	matched := false
+	for {
+		if pCh == 0 {
+			return p, wmAbortAll
+		}
+		switch {
+		case pCh == '\\':
+			p++
+			pCh = at(p)
+			if pCh == 0 {
+				return p, wmAbortAll
+			}
+			if tCh == pCh {
+				matched = true
+			}
+		case pCh == '-' && prevCh != 0 && at(p+1) != 0 && at(p+1) != ']':
+			p++
+			pCh = at(p)
+			if pCh == '\\' {
+				p++
+				pCh = at(p)
+				if pCh == 0 {
+					return p, wmAbortAll
+				}
+			}
+			if tCh <= pCh && tCh >= prevCh {
+				matched = true
+			} else if flags&wmCaseFold != 0 && isLower(tCh) {
+				upper := tCh - 'a' + 'A'
+				if upper <= pCh && upper >= prevCh {
+					matched = true
+				}
+			}
+			pCh = 0 // resets prevCh so "a-c-e" is not read as two ranges
+		case pCh == '[' && at(p+1) == ':':
+			start := p + 2
+			end := start
+			for end < len(pattern) && pattern[end] != ']' {
+				end++
+			}
+			if end >= len(pattern) {
+				return end, wmAbortAll
+			}
+			if end-start-1 < 0 || pattern[end-1] != ':' {
+				// No ":]", so "[" is an ordinary member of the set.
+				if tCh == '[' {
+					matched = true
+				}
+				break
+			}
+			p = end
+			class := pattern[start : end-1]
+			ok, valid := matchClass(class, tCh, flags)
+			if !valid {
+				return p, wmAbortAll
+			}
+			if ok {
+				matched = true
+			}
+			pCh = 0
+		default:
+			if tCh == pCh {
+				matched = true
+			}
+		}
+
+		prevCh = pCh
+		p++
+		pCh = at(p)
+		if pCh == ']' {
+			break
+		}
+	}
+
+	if matched == negated || (flags&wmPathname != 0 && tCh == '/') {
+		return p, wmNoMatch
+	}
+	return p, wmMatch
+}
+
+// matchClass evaluates a POSIX character class; valid is false for unknown classes.
+func matchClass(class string, c byte, flags int) (matched, valid bool) {
+	switch class {
+	case "alnum":
+		return isAlpha(c) || isDigit(c), true
+	case "alpha":
+		return isAlpha(c), true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < 0x20 || c == 0x7f, true
+	case "digit":
+		return isDigit(c), true
+	case "graph":
+		return c > 0x20 && c < 0x7f, true
+	case "lower":
+		return isLower(c), true
+	case "print":
+		return c >= 0x20 && c < 0x7f, true
+	case "punct":
+		return c > 0x20 && c < 0x7f && !isAlpha(c) && !isDigit(c), true
+	case "space":
+		return c == ' ' || (c >= '\t' && c <= '\r'), true
+	case "upper":
+		return isUpper(c) || (flags&wmCaseFold != 0 && isLower(c)), true
+	case "xdigit":
+		return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F'), true
+	}
+	return false, false
+}
+
+func isGlobSpecial(c byte) bool {
+	return c == '*' || c == '?' || c == '[' || c == '\\'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isLower(c byte) bool { return c >= 'a' && c <= 'z' }
+func isUpper(c byte) bool { return c >= 'A' && c <= 'Z' }
+func isAlpha(c byte) bool { return isLower(c) || isUpper(c) }
+
+func toLower(c byte) byte {
+	if isUpper(c) {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,35 @@
+package gitignore
+
+import "testing"
+
+func TestWildmatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		flags   int
+		want    bool
+	}{
+		{pattern: "foo/**/bar", text: "foo/bar", flags: wmPathname, want: true},
+		{pattern: "foo/**/bar", text: "foo/a/b/bar", flags: wmPathname, want: true},
+		{pattern: "**/foo", text: "foo", flags: wmPathname, want: true},
+		{pattern: "*", text: "foo/bar", flags: wmPathname, want: false},
+		{pattern: "*", text: "foo/bar", flags: 0, want: true},
+		{pattern: "foo*bar", text: "foo/bar", flags: 0, want: true},
+		{pattern: "foo?bar", text: "foo/bar", flags: wmPathname, want: false},
+		{pattern: "[[:alpha:]][[:digit:]]", text: "a1", want: true},
+		{pattern: "[[:space:]]", text: "a", want: false},
+		{pattern: "[!a-c]", text: "d", want: true},
+		{pattern: "[^a-c]", text: "b", want: false},
+		{pattern: "\\[ab]", text: "[ab]", want: true},
+		{pattern: "[a-c]", text: "B", flags: wmCaseFold, want: true},
+		{pattern: "README.md", text: "readme.MD", flags: wmCaseFold, want: true},
+		{pattern: "README.md", text: "readme.MD", want: false},
+		{pattern: "foo\\", text: "foo", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := wildmatch(tc.pattern, tc.text, tc.flags); got != tc.want {
+			t.Errorf("wildmatch(%q, %q, %d) = %v, want %v", tc.pattern, tc.text, tc.flags, got, tc.want)
+		}
+	}
+}
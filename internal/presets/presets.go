@@ -0,0 +1,66 @@
+// Package presets provides built-in blacklist rules for common ecosystems.
+package presets
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/gitignore"
+)
+
+//go:embed rules/*.gitignore
+var rules embed.FS
+
+// aliases maps alternative names to the preset that covers them.
+var aliases = map[string]string{
+	"gradle": "java",
+	"maven":  "java",
+}
+
+// Names returns the available preset names in sorted order, without aliases.
+func Names() []string {
+	entries, err := fs.ReadDir(rules, "rules")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".gitignore"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Canonical returns the preset name for name or one of its aliases.
+func Canonical(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	for _, known := range Names() {
+		if known == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(Names(), ", "))
+}
+
+// Load parses the named preset. The rule source defaults to "preset:<name>".
+func Load(name string, opts gitignore.ParseOptions) (*gitignore.Matcher, error) {
+	canonical, err := Canonical(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rules.ReadFile("rules/" + canonical + ".gitignore")
+	if err != nil {
+		return nil, fmt.Errorf("read preset %s: %w", canonical, err)
+	}
+	if opts.Source == "" {
+		opts.Source = "preset:" + canonical
+	}
+	return gitignore.ParseWithOptions(bytes.NewReader(data), opts)
+}
@@ -0,0 +1,60 @@
+package presets
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aatuh/weaver/internal/gitignore"
+)
+
+func TestEveryPresetParses(t *testing.T) {
+	for _, name := range Names() {
+		matcher, err := Load(name, gitignore.ParseOptions{})
+		if err != nil {
+			t.Fatalf("load %s: %v", name, err)
+		}
+		rules := matcher.Rules()
+		if len(rules) == 0 {
+			t.Fatalf("preset %s has no rules", name)
+		}
+		if rules[0].Source != "preset:"+name {
+			t.Fatalf("preset %s has source %q", name, rules[0].Source)
+		}
+	}
+}
+
+func TestPresetsMatchEcosystemJunk(t *testing.T) {
+	cases := []struct {
+		preset string
+		path   string
+		isDir  bool
+		want   bool
+	}{
+		{"node", "web/node_modules", true, true},
+		{"node", "package-lock.json", false, true},
+		{"node", "src/index.ts", false, false},
+		{"go", "vendor", true, true},
+		{"go", "cmd/bin", true, false},
+		{"go", "main.go", false, false},
+		{"python", "pkg/__pycache__", true, true},
+		{"maven", "target", true, true},
+	}
+	for _, tc := range cases {
+		matcher, err := Load(tc.preset, gitignore.ParseOptions{})
+		if err != nil {
+			t.Fatalf("load %s: %v", tc.preset, err)
+		}
+		if _, got := matcher.Match(tc.path, tc.isDir); got != tc.want {
+			t.Fatalf("%s: match %s = %v, want %v", tc.preset, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestCanonicalResolvesAliases(t *testing.T) {
+	if name, err := Canonical(" Gradle "); err != nil || name != "java" {
+		t.Fatalf("Canonical(gradle) = %q, %v", name, err)
+	}
+	if _, err := Canonical("cobol"); err == nil || !strings.Contains(err.Error(), "available: dotnet, go,") {
+		t.Fatalf("expected unknown preset error listing presets, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type symbolPair [2]int32
+
+type pairCount struct {
+	pair  symbolPair
+	count int
+}
+
+// pairHeap orders pairs by count, then by pair for a deterministic result.
+// Entries go stale as counts change and are checked when popped.
+type pairHeap []pairCount
+
+func (h pairHeap) Len() int { return len(h) }
+func (h pairHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count > h[j].count
+	}
+	if h[i].pair[0] != h[j].pair[0] {
+		return h[i].pair[0] < h[j].pair[0]
+	}
+	return h[i].pair[1] < h[j].pair[1]
+}
+func (h pairHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x any)   { *h = append(*h, x.(pairCount)) }
+func (h *pairHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// trainBPE learns merges until there are size tokens and returns the tokens in
+// rank order, starting with the 256 single bytes. Pieces seen once are ignored.
+func trainBPE(words map[string]int, size int) [][]byte {
+	tokens := make([][]byte, 0, size)
+	for b := 0; b < 256; b++ {
+		tokens = append(tokens, []byte{byte(b)})
+	}
+
+	keys := make([]string, 0, len(words))
+	for word, count := range words {
+		if count > 1 && len(word) > 1 {
+			keys = append(keys, word)
+		}
+	}
+	sort.Strings(keys)
+	symbols := make([][]int32, len(keys))
+	freqs := make([]int, len(keys))
+	counts := map[symbolPair]int{}
+	where := map[symbolPair][]int32{}
+	for i, word := range keys {
+		freqs[i] = words[word]
+		symbols[i] = make([]int32, len(word))
+		for j := 0; j < len(word); j++ {
+			symbols[i][j] = int32(word[j])
+		}
+		for j := 0; j+1 < len(word); j++ {
+			pair := symbolPair{symbols[i][j], symbols[i][j+1]}
+			counts[pair] += freqs[i]
+			where[pair] = append(where[pair], int32(i))
+		}
+	}
+	queue := make(pairHeap, 0, len(counts))
+	for pair, count := range counts {
+		queue = append(queue, pairCount{pair, count})
+	}
+	heap.Init(&queue)
+
+	// seen marks the words already rewritten for a merge, by the merged token.
+	seen := make([]int32, len(keys))
+	for len(tokens) < size && queue.Len() > 0 {
+		top := heap.Pop(&queue).(pairCount)
+		if counts[top.pair] != top.count || top.count < 2 {
+			continue
+		}
+		merged := int32(len(tokens))
+		tokens = append(tokens, append(append([]byte(nil), tokens[top.pair[0]]...), tokens[top.pair[1]]...))
+
+		changed := map[symbolPair]bool{}
+		for _, w := range where[top.pair] {
+			if seen[w] == merged {
+				continue
+			}
+			seen[w] = merged
+			syms := symbols[w]
+			for j := 0; j+1 < len(syms); j++ {
+				pair := symbolPair{syms[j], syms[j+1]}
+				counts[pair] -= freqs[w]
+				changed[pair] = true
+			}
+			out := syms[:0]
+			for j := 0; j < len(syms); j++ {
+				if j+1 < len(syms) && syms[j] == top.pair[0] && syms[j+1] == top.pair[1] {
+					out = append(out, merged)
+					j++
+					continue
+				}
+				out = append(out, syms[j])
+			}
+			symbols[w] = out
+			for j := 0; j+1 < len(out); j++ {
+				pair := symbolPair{out[j], out[j+1]}
+				counts[pair] += freqs[w]
+				changed[pair] = true
+				if pair[0] == merged || pair[1] == merged {
+					where[pair] = append(where[pair], w)
+				}
+			}
+		}
+		delete(where, top.pair)
+		for pair := range changed {
+			if counts[pair] <= 0 {
+				delete(counts, pair)
+				continue
+			}
+			heap.Push(&queue, pairCount{pair, counts[pair]})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// corpusPerDir caps the text selected from each corpus directory, so no
+// single source dominates the merges.
+const corpusPerDir = 24 << 20
+
+var corpusExtensions = map[string]bool{
+	".go": true, ".py": true, ".c": true, ".h": true, ".js": true, ".ts": true, ".java": true,
+	".rs": true, ".rb": true, ".sh": true, ".html": true, ".css": true, ".md": true, ".txt": true,
+	".json": true, ".yaml": true, ".yml": true, ".toml": true, ".xml": true, ".sql": true,
+}
+
+// corpus is a directory of training text and the files read from it.
+type corpus struct {
+	name  string
+	files []corpusFile
+	// digest is the SHA-256 of each file's slash-separated path, a NUL byte
+	// and its contents, in order.
+	digest string
+}
+
+type corpusFile struct {
+	path string
+	size int
+}
+
+// selectCorpus picks the text files of dir in lexical order, skipping
+// testdata and hidden directories, until corpusPerDir bytes are selected.
+func selectCorpus(name, dir string) (corpus, error) {
+	c := corpus{name: name}
+	digest := sha256.New()
+	read := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if read >= corpusPerDir {
+			return fs.SkipAll
+		}
+		if entry.IsDir() {
+			if name := entry.Name(); path != dir && (name == "testdata" || strings.HasPrefix(name, ".")) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !corpusExtensions[strings.ToLower(filepath.Ext(path))] || !entry.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || len(data) > 1<<20 || !utf8.Valid(data) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file := corpusFile{path: filepath.ToSlash(rel), size: len(data)}
+		addToDigest(digest, file.path, data)
+		c.files = append(c.files, file)
+		read += len(data)
+		return nil
+	})
+	if err != nil {
+		return corpus{}, err
+	}
+	c.digest = hex.EncodeToString(digest.Sum(nil))
+	return c, nil
+}
+
+func addToDigest(digest hash.Hash, path string, data []byte) {
+	digest.Write([]byte(path))
+	digest.Write([]byte{0})
+	digest.Write(data)
+}
+
+// readCorpus adds the pieces of the corpus files under dir to words. It fails
+// when a file is missing or differs from the one the manifest recorded.
+func readCorpus(c corpus, dir string, split func([]byte, func([]byte)), words map[string]int) error {
+	digest := sha256.New()
+	for _, file := range c.files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file.path)))
+		if err != nil {
+			return fmt.Errorf("corpus %s: %w", c.name, err)
+		}
+		if len(data) != file.size {
+			return fmt.Errorf("corpus %s: %s has %d bytes, the manifest records %d", c.name, file.path, len(data), file.size)
+		}
+		addToDigest(digest, file.path, data)
+		split(data, func(piece []byte) {
+			words[string(piece)]++
+		})
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != c.digest {
+		return fmt.Errorf("corpus %s: files under %s hash to %s, the manifest records %s", c.name, dir, sum, c.digest)
+	}
+	return nil
+}
+
+// writeManifest writes the corpora: a "corpus <name> <files> <sha256>" line
+// for each, followed by a "<size> <path>" line per file.
+func writeManifest(w io.Writer, header string, corpora []corpus) error {
+	out := bufio.NewWriter(w)
+	for _, line := range strings.Split(strings.TrimSpace(header), "\n") {
+		fmt.Fprintf(out, "# %s\n", line)
+	}
+	for _, c := range corpora {
+		fmt.Fprintf(out, "corpus %s %d %s\n", c.name, len(c.files), c.digest)
+		for _, file := range c.files {
+			fmt.Fprintf(out, "%d %s\n", file.size, file.path)
+		}
+	}
+	return out.Flush()
+}
+
+// readManifest reads the corpora written by writeManifest, ignoring comments.
+func readManifest(r io.Reader) ([]corpus, error) {
+	var corpora []corpus
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(text, "corpus "); ok {
+			fields := strings.Fields(rest)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("manifest line %d: expected a name, a file count and a hash", line)
+			}
+			count, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			corpora = append(corpora, corpus{name: fields[0], files: make([]corpusFile, 0, count), digest: fields[2]})
+			continue
+		}
+		sizeText, path, ok := strings.Cut(text, " ")
+		if !ok || len(corpora) == 0 {
+			return nil, fmt.Errorf("manifest line %d: expected a size and a path", line)
+		}
+		size, err := strconv.Atoi(sizeText)
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: %w", line, err)
+		}
+		c := &corpora[len(corpora)-1]
+		c.files = append(c.files, corpusFile{path: path, size: size})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return corpora, nil
+}
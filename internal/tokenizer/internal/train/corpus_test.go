@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+func TestManifestPinsTheCorpus(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go":             "package a\n\nfunc A() {}\n",
+		"docs/b.md":        "# Title\n\nSome text, some more text.\n",
+		"docs/c.bin":       "not a corpus file",
+		"testdata/skip.go": "package skip\n",
+		".git/config.txt":  "hidden\n",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	selected, err := selectCorpus("src", dir)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	want := []corpusFile{{path: "a.go", size: len(files["a.go"])}, {path: "docs/b.md", size: len(files["docs/b.md"])}}
+	if !reflect.DeepEqual(selected.files, want) {
+		t.Fatalf("selected %v, want %v", selected.files, want)
+	}
+
+	var manifest bytes.Buffer
+	if err := writeManifest(&manifest, "test corpus", []corpus{selected}); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	corpora, err := readManifest(&manifest)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if !reflect.DeepEqual(corpora, []corpus{selected}) {
+		t.Fatalf("manifest read back as %v, want %v", corpora, selected)
+	}
+	words := map[string]int{}
+	if err := readCorpus(corpora[0], dir, tokenizer.Split, words); err != nil {
+		t.Fatalf("read corpus: %v", err)
+	}
+	if words[" text"] != 2 {
+		t.Fatalf("expected the corpus pieces to be counted, got %v", words)
+	}
+
+	// A file changed in place, even at the same size, no longer matches.
+	if err := os.WriteFile(filepath.Join(dir, "a.go"), []byte("package b\n\nfunc A() {}\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := readCorpus(corpora[0], dir, tokenizer.Split, map[string]int{}); err == nil || !strings.Contains(err.Error(), "the manifest records") {
+		t.Fatalf("expected a changed corpus to be refused, got %v", err)
+	}
+}
+
+func TestTrainBPEMergesFrequentPairsFirst(t *testing.T) {
+	tokens := trainBPE(map[string]int{" the": 10, " then": 3, "x": 50}, 259)
+	got := make([]string, 0, len(tokens)-256)
+	for _, token := range tokens[256:] {
+		got = append(got, string(token))
+	}
+	// Ties go to the pair of lower-ranked tokens.
+	if want := []string{" t", "he", " the"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("merges = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,125 @@
+// Command train rebuilds the tokenizer's vocab.bpe. It learns byte-level BPE
+// merges from the pieces tokenizer.Split finds in a corpus of source code and
+// docs, so the vocabulary matches the counter's pre-tokenization.
+//
+// The corpus is pinned by a manifest listing the files read from each corpus
+// directory and a hash over them, so the same files always give the same
+// vocabulary. The tokenizer package runs it through go generate:
+//
+//	go generate ./internal/tokenizer
+//
+// With -select it instead picks the files from the -root directories and
+// writes a new manifest, for training on a different corpus.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aatuh/weaver/internal/tokenizer"
+)
+
+// rootFlag collects name=dir pairs.
+type rootFlag struct {
+	names []string
+	dirs  map[string]string
+}
+
+func (r *rootFlag) String() string {
+	return strings.Join(r.names, ",")
+}
+
+func (r *rootFlag) Set(value string) error {
+	name, dir, ok := strings.Cut(value, "=")
+	if !ok || name == "" || dir == "" {
+		return fmt.Errorf("expected name=dir, got %q", value)
+	}
+	if r.dirs == nil {
+		r.dirs = map[string]string{}
+	}
+	if _, ok := r.dirs[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.dirs[name] = dir
+	return nil
+}
+
+func main() {
+	var roots rootFlag
+	manifestPath := flag.String("manifest", "corpus.manifest", "Manifest of the corpus files")
+	outPath := flag.String("out", "vocab.bpe", "Vocabulary to write")
+	vocabSize := flag.Int("vocab-size", 16384, "Number of tokens in the vocabulary")
+	selectFiles := flag.Bool("select", false, "Pick the corpus files from the -root directories and write the manifest instead of training")
+	flag.Var(&roots, "root", "Corpus directory as name=dir; repeat for each corpus")
+	flag.Parse()
+
+	var err error
+	if *selectFiles {
+		err = writeSelection(*manifestPath, roots)
+	} else {
+		err = train(*manifestPath, *outPath, *vocabSize, roots)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "train:", err)
+		os.Exit(1)
+	}
+}
+
+func writeSelection(manifestPath string, roots rootFlag) error {
+	if len(roots.names) == 0 {
+		return fmt.Errorf("-select needs at least one -root")
+	}
+	corpora := make([]corpus, 0, len(roots.names))
+	for _, name := range roots.names {
+		c, err := selectCorpus(name, roots.dirs[name])
+		if err != nil {
+			return err
+		}
+		corpora = append(corpora, c)
+	}
+	file, err := os.Create(manifestPath)
+	if err != nil {
+		return err
+	}
+	header := "Corpus for vocab.bpe, written by internal/train -select and read by go generate.\n" +
+		"Each corpus line gives its name, file count and a SHA-256 over the files' paths and\n" +
+		"contents; each file line gives a size and a path under the corpus directory."
+	if err := writeManifest(file, header, corpora); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func train(manifestPath, outPath string, vocabSize int, roots rootFlag) error {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return err
+	}
+	corpora, err := readManifest(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", manifestPath, err)
+	}
+
+	words := map[string]int{}
+	for _, c := range corpora {
+		dir, ok := roots.dirs[c.name]
+		if !ok {
+			return fmt.Errorf("no -root given for corpus %s", c.name)
+		}
+		if err := readCorpus(c, dir, tokenizer.Split, words); err != nil {
+			return err
+		}
+	}
+
+	var out bytes.Buffer
+	for rank, token := range trainBPE(words, vocabSize) {
+		fmt.Fprintf(&out, "%s %d\n", base64.StdEncoding.EncodeToString(token), rank)
+	}
+	return os.WriteFile(outPath, out.Bytes(), 0o644)
+}
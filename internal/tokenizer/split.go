@@ -0,0 +1,150 @@
+package tokenizer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// split cuts text into the pieces BPE merges stay within, following the
+// cl100k pre-tokenization pattern:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Invalid UTF-8 bytes count as punctuation.
+func split(text []byte, fn func(piece []byte)) {
+	for i := 0; i < len(text); {
+		end := pieceEnd(text, i)
+		fn(text[i:end])
+		i = end
+	}
+}
+
+// Split calls fn with each piece of text in turn, as the counters see them.
+// The vocabulary trainer learns merges within these pieces.
+func Split(text []byte, fn func(piece []byte)) {
+	split(text, fn)
+}
+
+type runeClass int
+
+const (
+	classOther runeClass = iota
+	classLetter
+	classNumber
+	classSpace
+)
+
+func classAt(text []byte, i int) (runeClass, rune, int) {
+	if i >= len(text) {
+		return classOther, 0, 0
+	}
+	r, size := rune(text[i]), 1
+	if r >= utf8.RuneSelf {
+		r, size = utf8.DecodeRune(text[i:])
+		if r == utf8.RuneError {
+			return classOther, r, size
+		}
+	}
+	switch {
+	case unicode.IsLetter(r):
+		return classLetter, r, size
+	case unicode.IsNumber(r):
+		return classNumber, r, size
+	case unicode.IsSpace(r):
+		return classSpace, r, size
+	}
+	return classOther, r, size
+}
+
+// skipClass returns the end of the run of class starting at i.
+func skipClass(text []byte, i int, class runeClass) int {
+	for i < len(text) {
+		c, _, size := classAt(text, i)
+		if c != class {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+func pieceEnd(text []byte, i int) int {
+	class, r, size := classAt(text, i)
+
+	// Contractions: 's 't 're 've 'm 'll 'd, in any case.
+	if r == '\'' {
+		for _, suffix := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+			if hasPrefixFold(text[i+1:], suffix) {
+				return i + 1 + len(suffix)
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if class == classLetter {
+		return skipClass(text, i+size, classLetter)
+	}
+	if class != classNumber && r != '\r' && r != '\n' {
+		if next, _, _ := classAt(text, i+size); next == classLetter {
+			return skipClass(text, i+size, classLetter)
+		}
+	}
+
+	// \p{N}{1,3}
+	if class == classNumber {
+		end := i + size
+		for n := 1; n < 3; n++ {
+			c, _, s := classAt(text, end)
+			if c != classNumber {
+				break
+			}
+			end += s
+		}
+		return end
+	}
+
+	// ' ?[^\s\p{L}\p{N}]+[\r\n]*'
+	start := i
+	if r == ' ' {
+		start++
+	}
+	if c, _, _ := classAt(text, start); c == classOther && start < len(text) {
+		end := skipClass(text, start, classOther)
+		for end < len(text) && (text[end] == '\r' || text[end] == '\n') {
+			end++
+		}
+		return end
+	}
+
+	if class != classSpace {
+		return i + size
+	}
+	// \s*[\r\n]+ takes whitespace through its last line break.
+	end := skipClass(text, i, classSpace)
+	for j := end - 1; j >= i; j-- {
+		if text[j] == '\r' || text[j] == '\n' {
+			return j + 1
+		}
+	}
+	// \s+(?!\S) leaves the last space to start the next piece; \s+ takes a lone one.
+	if end < len(text) {
+		_, last := utf8.DecodeLastRune(text[i:end])
+		if end-last > i {
+			return end - last
+		}
+	}
+	return end
+}
+
+func hasPrefixFold(text []byte, prefix string) bool {
+	if len(text) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if text[i]|0x20 != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
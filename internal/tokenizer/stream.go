@@ -0,0 +1,43 @@
+package tokenizer
+
+import "unicode/utf8"
+
+// lookahead is how far past a piece split may look to decide where it ends:
+// the rune that ends a run, and the one after it.
+const lookahead = 2 * utf8.UTFMax
+
+// Stream counts the tokens of a text written to it in chunks of any size. It
+// counts each piece of Split on its own as soon as no later chunk can change
+// it, holding back only the last ones, so its count matches the counter's
+// count of the whole text for counters that count pieces independently, as
+// both counters here do.
+type Stream struct {
+	counter Counter
+	pending []byte
+	count   int
+}
+
+// NewStream returns a Stream that counts with counter.
+func NewStream(counter Counter) *Stream {
+	return &Stream{counter: counter}
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	settled := 0
+	for settled < len(s.pending) {
+		end := pieceEnd(s.pending, settled)
+		if end+lookahead > len(s.pending) {
+			break
+		}
+		s.count += s.counter.Count(s.pending[settled:end])
+		settled = end
+	}
+	s.pending = append(s.pending[:0], s.pending[settled:]...)
+	return len(p), nil
+}
+
+// Count returns the tokens of everything written.
+func (s *Stream) Count() int {
+	return s.count + s.counter.Count(s.pending)
+}
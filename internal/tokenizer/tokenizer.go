@@ -0,0 +1,203 @@
+// Package tokenizer estimates how many tokens a language model would see in a text.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Counter counts tokens. Implementations are safe for concurrent use.
+type Counter interface {
+	Count(text []byte) int
+	// Name identifies the counter in output headers.
+	Name() string
+}
+
+// vocab holds the embedded byte-level BPE vocabulary in the tiktoken format:
+// one base64-encoded token and its rank per line. It is trained by
+// internal/train on source code and docs, splitting text with cl100k's
+// pre-tokenization pattern. Its ranks are its own, so its counts are an
+// estimate of what a model's tokenizer would report, not a match for one.
+//
+// corpus.manifest pins the files it was trained on: the Go 1.27.1 sources,
+// and /usr/lib/python3.11, /usr/include and /usr/share/doc of a Debian 12
+// system with python3.11 3.11.2-6+deb12u6 and libc6-dev 2.36-9+deb12u13.
+// Given the same files, go generate rebuilds it byte for byte, and it fails
+// when a file differs from the manifest.
+//
+//go:generate go run ./internal/train -manifest corpus.manifest -out vocab.bpe -root go=$GOROOT/src -root python=/usr/lib/python3.11 -root include=/usr/include -root doc=/usr/share/doc
+//go:embed vocab.bpe
+var vocab []byte
+
+var counters = map[string]func() (Counter, error){
+	"bpe":       loadBPE,
+	"heuristic": func() (Counter, error) { return Heuristic{}, nil },
+}
+
+// Names returns the available counter names in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns the named counter: "bpe" for the embedded vocabulary or
+// "heuristic" for a fast estimate.
+func New(name string) (Counter, error) {
+	load, ok := counters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tokenizer %q (available: %s)", name, strings.Join(Names(), ", "))
+	}
+	return load()
+}
+
+var (
+	bpeOnce    sync.Once
+	bpeCounter *BPE
+	bpeErr     error
+)
+
+func loadBPE() (Counter, error) {
+	bpeOnce.Do(func() {
+		bpeCounter, bpeErr = ParseBPE(vocab)
+	})
+	if bpeErr != nil {
+		return nil, bpeErr
+	}
+	return bpeCounter, nil
+}
+
+// BPE counts tokens with a byte-level BPE vocabulary, merging the lowest-ranked
+// pair of adjacent tokens first, as tiktoken does.
+type BPE struct {
+	ranks map[string]int
+}
+
+// ParseBPE reads a vocabulary in the tiktoken format.
+func ParseBPE(data []byte) (*BPE, error) {
+	ranks := make(map[string]int, bytes.Count(data, []byte{'\n'}))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		encoded, rankText, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("vocabulary line %d: expected a token and a rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(rankText)
+		if err != nil {
+			return nil, fmt.Errorf("vocabulary line %d: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read vocabulary: %w", err)
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("vocabulary has no token for byte %#x", b)
+		}
+	}
+	return &BPE{ranks: ranks}, nil
+}
+
+// Name implements Counter.
+func (b *BPE) Name() string {
+	return "bpe"
+}
+
+// maxPiece bounds the pieces merged as a whole; merging is quadratic in the
+// piece length, and longer runs (minified code, long whitespace) are split.
+const maxPiece = 256
+
+// Count implements Counter.
+func (b *BPE) Count(text []byte) int {
+	count := 0
+	var bounds []int
+	split(text, func(piece []byte) {
+		for len(piece) > 0 {
+			n := min(len(piece), maxPiece)
+			count += b.countPiece(piece[:n], &bounds)
+			piece = piece[n:]
+		}
+	})
+	return count
+}
+
+// countPiece merges the bytes of one piece and returns the number of tokens
+// left. scratch is reused between calls.
+func (b *BPE) countPiece(piece []byte, scratch *[]int) int {
+	if _, ok := b.ranks[string(piece)]; ok {
+		return 1
+	}
+	// bounds holds the start of every token, then the end of the piece.
+	bounds := (*scratch)[:0]
+	for i := 0; i <= len(piece); i++ {
+		bounds = append(bounds, i)
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := b.ranks[string(piece[bounds[i]:bounds[i+2]])]
+			if ok && (best == -1 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best == -1 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	*scratch = bounds
+	return len(bounds) - 1
+}
+
+// Heuristic estimates about one token per four ASCII characters of each
+// pre-tokenized piece, and one per other character, since tokenizers spend
+// at least a token on most of those. It needs no vocabulary and is much
+// faster than BPE.
+type Heuristic struct{}
+
+// Name implements Counter.
+func (Heuristic) Name() string {
+	return "heuristic"
+}
+
+// Count implements Counter.
+func (Heuristic) Count(text []byte) int {
+	count := 0
+	split(text, func(piece []byte) {
+		ascii := 0
+		for i := 0; i < len(piece); {
+			if piece[i] < utf8.RuneSelf {
+				ascii++
+				i++
+				continue
+			}
+			_, size := utf8.DecodeRune(piece[i:])
+			count++
+			i += size
+		}
+		count += (ascii + 3) / 4
+	})
+	return count
+}
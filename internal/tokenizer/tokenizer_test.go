@@ -0,0 +1,130 @@
+package tokenizer
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitFollowsCl100kPattern(t *testing.T) {
+	cases := map[string][]string{
+		"Hello world":           {"Hello", " world"},
+		"I'm here, they'LL see": {"I", "'m", " here", ",", " they", "'LL", " see"},
+		"x := 12345\n":          {"x", " :=", " ", "123", "45", "\n"},
+		"func main() {\n\treturn\n}\n": {
+			"func", " main", "()", " {\n", "\treturn", "\n", "}\n",
+		},
+		"a  b":           {"a", " ", " b"},
+		"end   ":         {"end", "   "},
+		"x\n\n    y":     {"x", "\n\n", "   ", " y"},
+		"$foo.bar_baz":   {"$foo", ".bar", "_baz"},
+		"naïve café 日本語": {"naïve", " café", " 日本語"},
+		"\xff\xfeab":     {"\xff\xfe", "ab"},
+	}
+	for input, want := range cases {
+		var got []string
+		split([]byte(input), func(piece []byte) {
+			got = append(got, string(piece))
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("split(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestBPECountsWithEmbeddedVocabulary(t *testing.T) {
+	counter, err := New("bpe")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := counter.Count(nil); got != 0 {
+		t.Fatalf("Count(nil) = %d", got)
+	}
+	// Common words and keywords are single tokens.
+	for _, text := range []string{"the", " the", " return", "func", "\n", " {\n"} {
+		if got := counter.Count([]byte(text)); got != 1 {
+			t.Fatalf("Count(%q) = %d, want 1", text, got)
+		}
+	}
+	source := []byte("package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hello, world\")\n}\n")
+	if got := counter.Count(source); got < 15 || got > 30 {
+		t.Fatalf("Count(hello world program) = %d, want 15-30", got)
+	}
+	// Pieces longer than maxPiece are merged in chunks.
+	if got := counter.Count(bytes.Repeat([]byte("a"), 10*maxPiece)); got < 10 {
+		t.Fatalf("Count(long run) = %d", got)
+	}
+}
+
+// TestCountsArePinned fixes both counters' results on a small corpus, so a
+// change to the vocabulary, the pre-tokenization or the merge order shows up
+// as a changed count rather than as drifting budgets.
+func TestCountsArePinned(t *testing.T) {
+	bpe, err := New("bpe")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	cases := []struct {
+		text           string
+		bpe, heuristic int
+	}{
+		{"package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hello, world\")\n}\n", 19, 26},
+		{"The quick brown fox jumps over the lazy dog. It's a sentence that uses every letter of the alphabet.\n", 30, 35},
+		{"{\"name\": \"weaver\", \"version\": \"1.2.3\", \"tags\": [\"cli\", \"go\"], \"private\": false}\n", 33, 34},
+		{"def fib(n):\n    if n < 2:\n        return n\n    return fib(n - 1) + fib(n - 2)\n", 33, 33},
+		{"naïve café 日本語のテキスト — ünïcödé\n", 46, 21},
+	}
+	for _, tc := range cases {
+		if got := bpe.Count([]byte(tc.text)); got != tc.bpe {
+			t.Errorf("bpe Count(%q) = %d, want %d", tc.text, got, tc.bpe)
+		}
+		if got := (Heuristic{}).Count([]byte(tc.text)); got != tc.heuristic {
+			t.Errorf("heuristic Count(%q) = %d, want %d", tc.text, got, tc.heuristic)
+		}
+	}
+}
+
+func TestHeuristicCountsPieces(t *testing.T) {
+	if got := (Heuristic{}).Count([]byte("Hello wonderful world\n")); got != 8 {
+		t.Fatalf("Count = %d, want 8", got)
+	}
+	// Each non-ASCII character counts on its own.
+	if got := (Heuristic{}).Count([]byte("日本語 café\n")); got != 6 {
+		t.Fatalf("Count = %d, want 6", got)
+	}
+	if _, err := New("words"); err == nil || !strings.Contains(err.Error(), "available: bpe, heuristic") {
+		t.Fatalf("expected an unknown tokenizer error, got %v", err)
+	}
+}
+
+func TestStreamMatchesCountingTheWholeText(t *testing.T) {
+	bpe, err := New("bpe")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	texts := []string{
+		"",
+		"package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hello, world\")\n}\n",
+		"a   1 and  \t 22 or   (x)\r\n\r\n  y   ",
+		"I'm here, they'LL see what's what'",
+		"naïve café 日本語のテキスト — ünïcödé \xff\xfe broken",
+		strings.Repeat("word ", 200) + strings.Repeat(" ", 300) + strings.Repeat("9", 50),
+	}
+	for _, counter := range []Counter{bpe, Heuristic{}} {
+		for _, text := range texts {
+			want := counter.Count([]byte(text))
+			for _, n := range []int{1, 2, 3, 7, 4096} {
+				stream := NewStream(counter)
+				for rest := []byte(text); len(rest) > 0; {
+					chunk := rest[:min(n, len(rest))]
+					stream.Write(chunk)
+					rest = rest[len(chunk):]
+				}
+				if got := stream.Count(); got != want {
+					t.Fatalf("%s: %q in chunks of %d counted %d, want %d", counter.Name(), text, n, got, want)
+				}
+			}
+		}
+	}
+}
@@ -7,24 +7,38 @@ import (
 
 // Node represents a JSON-serializable directory tree.
 type Node struct {
-	Name     string  `json:"name"`
-	Type     string  `json:"type"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Tokens is the file's token count, or the sum for a directory, when counted.
+	Tokens   int64   `json:"tokens,omitempty"`
 	Children []*Node `json:"children,omitempty"`
 }
 
 type node struct {
 	name     string
 	nodeType string
+	tokens   int64
 	children map[string]*node
 }
 
 // Build constructs a tree from relative paths.
 func Build(rootName string, paths []string) *Node {
+	return BuildWithTokens(rootName, paths, nil)
+}
+
+// BuildWithTokens constructs a tree from relative paths, where tokens[i] is the
+// token count of paths[i]. Directories carry the sum of their files.
+func BuildWithTokens(rootName string, paths []string, tokens []int64) *Node {
 	root := &node{name: rootName, nodeType: "dir", children: map[string]*node{}}
-	for _, rel := range paths {
+	for index, rel := range paths {
 		if rel == "" {
 			continue
 		}
+		var count int64
+		if index < len(tokens) {
+			count = tokens[index]
+		}
+		root.tokens += count
 		parts := strings.Split(rel, "/")
 		current := root
 		for i, part := range parts {
@@ -41,6 +55,7 @@ func Build(rootName string, paths []string) *Node {
 				child = &node{name: part, nodeType: nodeType, children: map[string]*node{}}
 				current.children[part] = child
 			}
+			child.tokens += count
 			current = child
 		}
 	}
@@ -49,7 +64,7 @@ func Build(rootName string, paths []string) *Node {
 }
 
 func toPublic(n *node) *Node {
-	result := &Node{Name: n.name, Type: n.nodeType}
+	result := &Node{Name: n.name, Type: n.nodeType, Tokens: n.tokens}
 	if len(n.children) == 0 {
 		return result
 	}